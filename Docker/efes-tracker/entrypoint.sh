@@ -1,5 +1,6 @@
 #!/bin/bash -ex
 efes ready mysql 2>/dev/null
+efes migrate up
 efes ready rabbitmq 2>/dev/null
 
 exec efes tracker
@@ -7,4 +7,6 @@ until "${mysql[@]}" -e "select 1" &>/dev/null ; do
 done
 echo "MySQL is ready."
 
+go run . migrate up
+
 exec go test -v -race -covermode atomic -coverprofile=/coverage/covprofile ./...
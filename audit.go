@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operations recorded in audit log.
+const (
+	auditCreate      = "create"
+	auditOverwrite   = "overwrite"
+	auditDelete      = "delete"
+	auditDrain       = "drain"
+	auditCleanDevice = "clean-device"
+	auditCleanDisk   = "clean-disk"
+)
+
+type auditRecord struct {
+	operation string
+	key       string
+	fid       int64
+	devids    []int64
+	clientIP  string
+	actor     string
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// writeAudit inserts a record to audit table.
+// Pass a transaction as e to make the record part of the operation.
+func writeAudit(e execer, rec auditRecord) error {
+	_, err := e.Exec("insert into audit(operation, dkey, fid, devids, client_ip, actor) values(?, ?, ?, ?, ?, ?)",
+		rec.operation, rec.key, rec.fid, formatDevids(rec.devids), rec.clientIP, rec.actor)
+	return err
+}
+
+// auditActor returns the name of the token that made the request.
+func auditActor(r *http.Request) string {
+	a := tokenFromContext(r.Context())
+	if a == nil {
+		return ""
+	}
+	return a.name
+}
+
+// getKeyOfFid returns the key of the fid. Empty string is returned if there is no such file.
+func getKeyOfFid(q queryRower, fid int64) (string, error) {
+	var key string
+	err := q.QueryRow("select dkey from file where fid=?", fid).Scan(&key)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return key, err
+}
+
+func formatDevids(devids []int64) string {
+	s := make([]string, len(devids))
+	for i, devid := range devids {
+		s[i] = strconv.FormatInt(devid, 10)
+	}
+	return strings.Join(s, ",")
+}
+
+func parseDevids(s string) []int64 {
+	devids := make([]int64, 0)
+	for _, devidString := range strings.Split(s, ",") {
+		devid, err := strconv.ParseInt(devidString, 10, 64)
+		if err != nil {
+			continue
+		}
+		devids = append(devids, devid)
+	}
+	return devids
+}
+
+func (t *Tracker) getAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.FormValue("key")
+	fid, _ := strconv.ParseInt(r.FormValue("fid"), 10, 64)
+	if key == "" && fid == 0 {
+		http.Error(w, "required parameter: key or fid", http.StatusBadRequest)
+		return
+	}
+	limit := uint64(100)
+	limitStr := r.FormValue("limit")
+	if limitStr != "" {
+		var err error
+		limit, err = strconv.ParseUint(limitStr, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid param: limit", http.StatusBadRequest)
+			return
+		}
+	}
+	var rows *sql.Rows
+	var err error
+	const columns = "select auditid, created_at, operation, dkey, fid, devids, client_ip, actor from audit "
+	if key != "" {
+		rows, err = t.db.QueryContext(r.Context(), columns+"where dkey=? order by auditid desc limit ?", key, limit)
+	} else {
+		rows, err = t.db.QueryContext(r.Context(), columns+"where fid=? order by auditid desc limit ?", fid, limit)
+	}
+	if err != nil {
+		t.internalServerError("cannot select rows", err, r, w)
+		return
+	}
+	defer rows.Close()
+	records := make([]AuditRecord, 0)
+	for rows.Next() {
+		var a AuditRecord
+		var createdAt sql.NullTime
+		var devids string
+		err = rows.Scan(&a.ID, &createdAt, &a.Operation, &a.Key, &a.Fid, &devids, &a.ClientIP, &a.Actor)
+		if err != nil {
+			t.internalServerError("cannot scan rows", err, r, w)
+			return
+		}
+		a.Time = createdAt.Time.Format(time.RFC3339)
+		a.Devids = parseDevids(devids)
+		records = append(records, a)
+	}
+	err = rows.Err()
+	if err != nil {
+		t.internalServerError("error while fetching rows", err, r, w)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(GetAudit{Records: records}) // nolint: errcheck
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	cfg := *testConfig
+	cfg.Auth.TrustedProxies = []string{"10.0.0.1"}
+	tr, err := NewTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	insertHost(t, tr)
+	_, err = tr.db.Exec("insert into device(devid, hostid) values(2, 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertToDB(t, tr.db, 42, 2, "foo")
+	insertToDB(t, tr.db, 43, 2, "bar")
+
+	go tr.Run()
+	defer tr.Shutdown()
+	<-tr.Ready
+
+	del := func(query, remoteAddr string) {
+		t.Helper()
+		req, err := http.NewRequest("POST", "/delete?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("x-forwarded-for", "1.1.1.1")
+		rr := httptest.NewRecorder()
+		tr.server.Handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v",
+				status, http.StatusOK)
+		}
+	}
+	getAudit := func(key string) []AuditRecord {
+		t.Helper()
+		req, err := http.NewRequest("GET", "/audit?key="+key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		tr.server.Handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v",
+				status, http.StatusOK)
+		}
+		var resp GetAudit
+		err = json.Unmarshal(rr.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Records
+	}
+
+	// Client address is taken from X-Forwarded-For only if the request comes from a trusted proxy.
+	del("key=foo", "10.0.0.1:1234")
+	del("fid=43", "2.2.2.2:1234")
+	records := getAudit("foo")
+	if len(records) != 1 {
+		t.Fatalf("unexpected number of records: %d", len(records))
+	}
+	rec := records[0]
+	if rec.Operation != auditDelete || rec.Fid != 42 || rec.ClientIP != "1.1.1.1" || len(rec.Devids) != 1 || rec.Devids[0] != 2 {
+		t.Errorf("unexpected audit record: %#v", rec)
+	}
+	records = getAudit("bar")
+	if len(records) != 1 || records[0].Fid != 43 || records[0].ClientIP != "2.2.2.2" {
+		t.Errorf("X-Forwarded-For of untrusted client must be ignored: %#v", records)
+	}
+
+	// Deleting a fid that does not exist does nothing.
+	del("fid=44", "2.2.2.2:1234")
+	var count int
+	err = tr.db.QueryRow("select count(*) from audit").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("missing fid must not be audited, found %d records", count)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cenkalti/log"
+	"github.com/olekukonko/tablewriter"
+)
+
+// Scopes that can be granted to an API token.
+// A token with admin scope is allowed to do everything.
+const (
+	scopeRead   = "read"
+	scopeWrite  = "write"
+	scopeDelete = "delete"
+	scopeAdmin  = "admin"
+)
+
+var allScopes = []string{scopeRead, scopeWrite, scopeDelete, scopeAdmin}
+
+type apiToken struct {
+	id     int64
+	name   string
+	scopes []string
+	// keyPrefix restricts tracker operations that take a key: get-path, get-paths, create-close and delete.
+	// It is not checked by the write server of storage servers, because uploads there are addressed by fid
+	// and the key is not known until create-close. A write token with a prefix can still upload to any open tempfile,
+	// but the upload only becomes a file when create-close is called with an allowed key.
+	keyPrefix string
+}
+
+func (a *apiToken) hasScope(scope string) bool {
+	for _, s := range a.scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *apiToken) allowsKey(key string) bool {
+	return strings.HasPrefix(key, a.keyPrefix)
+}
+
+func parseScopes(s string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !inStringList(scope, allScopes) {
+			return nil, fmt.Errorf("invalid scope: %s", scope)
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+func inStringList(value string, list []string) bool {
+	for _, current := range list {
+		if current == value {
+			return true
+		}
+	}
+	return false
+}
+
+// hashToken returns the value stored in database for a token.
+// Tokens are random so a single round of SHA-256 is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+var errInvalidToken = errors.New("invalid token")
+
+func lookupToken(ctx context.Context, db *store, token string) (*apiToken, error) {
+	var a apiToken
+	var scopes string
+	row := db.QueryRowContext(ctx, "select tokenid, name, scopes, key_prefix from api_token where token_hash=? and revoked_at is null", hashToken(token))
+	err := row.Scan(&a.id, &a.name, &scopes, &a.keyPrefix)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.scopes = strings.Split(scopes, ",")
+	return &a, nil
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("authorization")
+	const prefix = "bearer "
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+type tokenContextKey struct{}
+
+func tokenFromContext(ctx context.Context) *apiToken {
+	a, _ := ctx.Value(tokenContextKey{}).(*apiToken)
+	return a
+}
+
+// keyAllowed reports whether the token of the request is allowed to access the key.
+// It always returns true when authentication is disabled.
+func keyAllowed(r *http.Request, key string) bool {
+	a := tokenFromContext(r.Context())
+	if a == nil {
+		return true
+	}
+	return a.allowsKey(key)
+}
+
+// authenticator checks bearer tokens of incoming requests against the api_token table.
+type authenticator struct {
+	enabled bool
+	db      *store
+	log     log.Logger
+}
+
+// require wraps h so that it is only called for requests having a valid token with the given scope.
+func (a *authenticator) require(scope string, h http.HandlerFunc) http.HandlerFunc {
+	if !a.enabled {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			w.Header().Set("www-authenticate", "Bearer")
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		at, err := lookupToken(r.Context(), a.db, token)
+		if err == errInvalidToken {
+			w.Header().Set("www-authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			a.log.Errorln("cannot lookup token:", err.Error())
+			http.Error(w, "cannot lookup token", http.StatusInternalServerError)
+			return
+		}
+		if !at.hasScope(scope) {
+			http.Error(w, "token does not have scope: "+scope, http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, at)))
+	}
+}
+
+func createToken(cfg DatabaseConfig, name, scopes, keyPrefix string) error {
+	if name == "" {
+		return errors.New("token name is required")
+	}
+	scopeList, err := parseScopes(scopes)
+	if err != nil {
+		return err
+	}
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer logCloseDB(log.DefaultLogger, db)
+	_, err = db.Exec("insert into api_token(name, token_hash, scopes, key_prefix) values(?, ?, ?, ?)", name, hashToken(token), strings.Join(scopeList, ","), keyPrefix)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
+
+func listTokens(cfg DatabaseConfig) error {
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer logCloseDB(log.DefaultLogger, db)
+	rows, err := db.Query("select tokenid, name, scopes, key_prefix, created_at, revoked_at from api_token order by tokenid")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetBorder(false)
+	table.SetHeader([]string{"ID", "Name", "Scopes", "Key prefix", "Created at", "Revoked at"})
+	for rows.Next() {
+		var id int64
+		var name, scopes, keyPrefix string
+		var createdAt, revokedAt sql.NullTime
+		err = rows.Scan(&id, &name, &scopes, &keyPrefix, &createdAt, &revokedAt)
+		if err != nil {
+			return err
+		}
+		var revoked string
+		if revokedAt.Valid {
+			revoked = revokedAt.Time.Format("2006-01-02 15:04:05")
+		}
+		table.Append([]string{fmt.Sprint(id), name, scopes, keyPrefix, createdAt.Time.Format("2006-01-02 15:04:05"), revoked})
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	table.Render()
+	return nil
+}
+
+func revokeToken(cfg DatabaseConfig, id int64) error {
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer logCloseDB(log.DefaultLogger, db)
+	res, err := db.Exec("update api_token set revoked_at=current_timestamp where tokenid=? and revoked_at is null", id)
+	if err != nil {
+		return err
+	}
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if ra == 0 {
+		return fmt.Errorf("no active token with id: %d", id)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := parseScopes("read, write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scopes) != 2 || scopes[0] != scopeRead || scopes[1] != scopeWrite {
+		t.Errorf("unexpected scopes: %v", scopes)
+	}
+	_, err = parseScopes("read,foo")
+	if err == nil {
+		t.Error("invalid scope must return error")
+	}
+	_, err = parseScopes("")
+	if err == nil {
+		t.Error("empty scope must return error")
+	}
+}
+
+func TestTokenScope(t *testing.T) {
+	a := &apiToken{scopes: []string{scopeRead}, keyPrefix: "foo/"}
+	if !a.hasScope(scopeRead) {
+		t.Error("token must have read scope")
+	}
+	if a.hasScope(scopeDelete) {
+		t.Error("token must not have delete scope")
+	}
+	if !a.allowsKey("foo/bar") {
+		t.Error("token must allow key with prefix")
+	}
+	if a.allowsKey("bar/foo") {
+		t.Error("token must not allow key without prefix")
+	}
+	admin := &apiToken{scopes: []string{scopeAdmin}}
+	if !admin.hasScope(scopeDelete) {
+		t.Error("admin token must have all scopes")
+	}
+}
+
+func TestAuthenticatedTracker(t *testing.T) {
+	config := *testConfig
+	config.Auth.Enabled = true
+	tr, err := NewTracker(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	_, err = tr.db.Exec("insert into api_token(name, token_hash, scopes, key_prefix) values('reader', ?, 'read', 'foo/')", hashToken("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{"GET", "/ping", "", http.StatusOK},
+		{"GET", "/get-path?key=foo/bar", "", http.StatusUnauthorized},
+		{"GET", "/get-path?key=foo/bar", "wrong", http.StatusUnauthorized},
+		{"GET", "/get-path?key=foo/bar", "secret", http.StatusNotFound},
+		{"GET", "/get-path?key=bar/foo", "secret", http.StatusForbidden},
+		{"POST", "/delete?key=foo/bar", "secret", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		rr := httptest.NewRecorder()
+		tr.server.Handler.ServeHTTP(rr, req)
+		if rr.Code != c.code {
+			t.Errorf("%s %s returned wrong status code: got %v want %v", c.method, c.path, rr.Code, c.code)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// Events recorded in change feed.
+const (
+	changeCreate    = "create"
+	changeOverwrite = "overwrite"
+	changeDelete    = "delete"
+)
+
+// maxChangesWait is the maximum duration a /changes request can wait for new changes.
+const maxChangesWait = 60 * time.Second
+
+// recordChange appends a change to the feed in the same transaction with the operation.
+//
+// Sequence numbers are taken from the single row in change_seq table instead of an auto increment column.
+// The row stays locked until the transaction is committed, so changes become visible in sequence order
+// and a consumer reading after the last sequence it has seen never misses a change.
+// Sequence numbers also have no gaps because a rolled back transaction rolls back its increment.
+// The cost is a global lock: transactions that record changes are serialized on commit.
+// Call it as the last statement before commit to keep the lock short.
+func recordChange(tx *storeTx, event, key string, fid int64) error {
+	_, err := tx.Exec("update change_seq set seq=seq+1 where id=1")
+	if err != nil {
+		return err
+	}
+	var seq int64
+	err = tx.QueryRow("select seq from change_seq where id=1").Scan(&seq)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into file_change(seq, event, dkey, fid) values(?, ?, ?, ?)", seq, event, key, fid)
+	return err
+}
+
+func (t *Tracker) getChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var err error
+	since := uint64(0)
+	limit := uint64(1000)
+	var wait time.Duration
+
+	sinceStr := r.FormValue("since")
+	if sinceStr != "" {
+		since, err = strconv.ParseUint(sinceStr, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid param: since", http.StatusBadRequest)
+			return
+		}
+	}
+	limitStr := r.FormValue("limit")
+	if limitStr != "" {
+		limit, err = strconv.ParseUint(limitStr, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid param: limit", http.StatusBadRequest)
+			return
+		}
+	}
+	waitStr := r.FormValue("wait")
+	if waitStr != "" {
+		wait, err = time.ParseDuration(waitStr)
+		if err != nil {
+			http.Error(w, "invalid param: wait", http.StatusBadRequest)
+			return
+		}
+		if wait > maxChangesWait {
+			wait = maxChangesWait
+		}
+		// Server has a global write timeout that is shorter than long-polling duration.
+		err = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 10*time.Second))
+		if err != nil {
+			t.log.Warningln("cannot extend write deadline:", err.Error())
+		}
+	}
+
+	if since > 0 {
+		expired, err := t.cursorExpired(r, since)
+		if err != nil {
+			t.internalServerError("cannot check cursor", err, r, w)
+			return
+		}
+		if expired {
+			http.Error(w, "cursor expired: changes after since are deleted, start over with since=0", http.StatusGone)
+			return
+		}
+	}
+
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		changes, err := t.selectChanges(r, since, limit)
+		if err != nil {
+			t.internalServerError("cannot select changes", err, r, w)
+			return
+		}
+		if len(changes) > 0 || wait == 0 {
+			lastSeq := since
+			if len(changes) > 0 {
+				lastSeq = changes[len(changes)-1].Seq
+			}
+			w.Header().Set("content-type", "application/json")
+			encoder := json.NewEncoder(w)
+			encoder.Encode(GetChanges{Changes: changes, LastSeq: lastSeq}) // nolint: errcheck
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			wait = 0
+		case <-r.Context().Done():
+			return
+		case <-t.shutdown:
+			wait = 0
+		}
+	}
+}
+
+func (t *Tracker) selectChanges(r *http.Request, since, limit uint64) ([]Change, error) {
+	changes := make([]Change, 0)
+	rows, err := t.db.QueryContext(r.Context(), "select seq, created_at, event, dkey, fid from file_change where seq > ? order by seq limit ?", since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c Change
+		var createdAt sql.NullTime
+		err = rows.Scan(&c.Seq, &createdAt, &c.Event, &c.Key, &c.Fid)
+		if err != nil {
+			return nil, err
+		}
+		c.Time = createdAt.Time.Format(time.RFC3339)
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// cursorExpired returns true if some of the changes after since are deleted by change feed cleaner.
+// Sequence numbers have no gaps, so comparing since with the oldest retained change is enough.
+func (t *Tracker) cursorExpired(r *http.Request, since uint64) (bool, error) {
+	var oldest sql.NullInt64
+	err := t.db.QueryRowContext(r.Context(), "select min(seq) from file_change").Scan(&oldest)
+	if err != nil {
+		return false, err
+	}
+	if oldest.Valid {
+		return since+1 < uint64(oldest.Int64), nil
+	}
+	// All changes are deleted. Cursor is expired if there were changes after it.
+	var last uint64
+	err = t.db.QueryRowContext(r.Context(), "select seq from change_seq where id=1").Scan(&last)
+	if err != nil {
+		return false, err
+	}
+	return since < last, nil
+}
+
+func (t *Tracker) changeFeedCleaner() {
+	t.log.Notice("Starting change feed cleaner...")
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	retention := time.Duration(t.config.Tracker.ChangeFeedRetention) / time.Second
+	t.workers.beat("change-feed-cleaner")
+	for {
+		select {
+		case <-ticker.C:
+			t.workers.beat("change-feed-cleaner")
+			if !t.leader.IsLeader() {
+				continue
+			}
+			res, err := t.db.Exec("delete from file_change where created_at < "+t.db.addSeconds("current_timestamp", "?"), -retention)
+			if err != nil {
+				t.log.Errorln("cannot delete old change records:", err.Error())
+				sentry.CaptureException(err)
+				continue
+			}
+			ra, err := res.RowsAffected()
+			if err != nil {
+				t.log.Errorln("Cannot get rows affected:", err)
+				continue
+			}
+			t.log.Infoln(ra, "old change records are deleted")
+		case <-t.shutdown:
+			close(t.changeFeedCleanerStopped)
+			return
+		}
+	}
+}
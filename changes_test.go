@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestChanges(t *testing.T) {
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	insertHost(t, tr)
+	_, err = tr.db.Exec("insert into device(devid, status, hostid, read_port) values(2, 'alive', 1, 5678)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.db.Exec("insert into tempfile(fid, devid) values(9, 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var since uint64
+	err = tr.db.QueryRow("select seq from change_seq").Scan(&since)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/create-close?fid=9&key=foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	tr.server.Handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	req, err = http.NewRequest("GET", "/changes?since="+strconv.FormatUint(since, 10), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	tr.server.Handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	var resp GetChanges
+	err = json.Unmarshal(rr.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Changes) != 1 {
+		t.Fatalf("unexpected number of changes: %d", len(resp.Changes))
+	}
+	c := resp.Changes[0]
+	if c.Seq != since+1 || c.Event != changeCreate || c.Key != "foo" || c.Fid != 9 {
+		t.Errorf("unexpected change: %#v", c)
+	}
+	if resp.LastSeq != c.Seq {
+		t.Errorf("unexpected last seq: got %v want %v", resp.LastSeq, c.Seq)
+	}
+}
+
+func TestChangesCursorExpired(t *testing.T) {
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	tx, err := tr.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"foo", "bar"} {
+		err = recordChange(tx, changeCreate, key, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last uint64
+	err = tr.db.QueryRow("select seq from change_seq").Scan(&last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getChanges := func(since uint64) int {
+		req, err := http.NewRequest("GET", "/changes?since="+strconv.FormatUint(since, 10), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		tr.server.Handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Change of "foo" is deleted by the cleaner.
+	_, err = tr.db.Exec("delete from file_change where seq=?", last-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := getChanges(last - 2); code != http.StatusGone {
+		t.Errorf("cursor before deleted change must be expired, got %d", code)
+	}
+	if code := getChanges(last - 1); code != http.StatusOK {
+		t.Errorf("cursor after deleted change must be valid, got %d", code)
+	}
+
+	// All changes are deleted.
+	_, err = tr.db.Exec("delete from file_change")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := getChanges(last - 1); code != http.StatusGone {
+		t.Errorf("cursor before deleted change must be expired, got %d", code)
+	}
+	if code := getChanges(last); code != http.StatusOK {
+		t.Errorf("cursor at last change must be valid, got %d", code)
+	}
+	if code := getChanges(0); code != http.StatusOK {
+		t.Errorf("cursor at the start must be valid, got %d", code)
+	}
+}
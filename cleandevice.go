@@ -1,138 +1,118 @@
 package main
 
 import (
-	"database/sql"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/getsentry/sentry-go"
 )
 
-func (s *Server) cleanDevice() {
-	s.log.Notice("Starting device cleaner...")
+func (d *serverDevice) cleanDevice() {
+	d.log.Notice("Starting device cleaner...")
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
-	period := time.Duration(s.config.Server.CleanDeviceRunPeriod) / time.Second
+	period := time.Duration(d.config.Server.CleanDeviceRunPeriod)
+	d.workers.beat(d.worker("device-cleaner"))
 	for {
 		select {
 		case <-ticker.C:
-			res, err := s.db.Exec("update device "+
-				"set last_device_clean_time=current_timestamp "+
-				"where devid=? "+
-				"and ADDDATE(last_device_clean_time, INTERVAL ? SECOND) < CURRENT_TIMESTAMP",
-				s.devid, period)
+			d.workers.beat(d.worker("device-cleaner"))
+			ok, err := d.meta.startDeviceClean(d.devid, period)
 			if err != nil {
-				s.log.Errorln("Error during updating last device clean time:", err)
+				d.log.Errorln("Error during updating last device clean time:", err)
 				continue
 			}
-			ra, err := res.RowsAffected()
-			if err != nil {
-				s.log.Errorln("Cannot get rows affected:", err)
-				continue
-			}
-			if ra == 0 {
+			if !ok {
 				continue
 			}
-			s.log.Info("Cleanup has started on database table.")
-			err = s.walkOnDeviceFiles()
+			d.log.Info("Cleanup has started on database table.")
+			begin := time.Now()
+			err = d.walkOnDeviceFiles()
+			cleanDuration.WithLabelValues(d.devidLabel(), "device").Observe(time.Since(begin).Seconds())
 			if err != nil {
-				s.log.Errorln("Error in database table cleanup:", err)
+				d.log.Errorln("Error in database table cleanup:", err)
 				sentry.CaptureException(err)
 			} else {
-				s.log.Info("Database table cleanup has finished successfully.")
+				d.log.Info("Database table cleanup has finished successfully.")
 			}
 			// Updating last_device_clean_time at the end of traversal helps to
 			// spread the load on database more uniform in time.
-			_, err = s.db.Exec("update device set last_device_clean_time=current_timestamp where devid=?", s.devid)
+			err = d.meta.finishDeviceClean(d.devid)
 			if err != nil {
-				s.log.Errorln("Error during updating last device clean time:", err)
+				d.log.Errorln("Error during updating last device clean time:", err)
 				continue
 			}
-		case <-s.shutdown:
-			close(s.deviceCleanStopped)
+		case <-d.shutdown:
+			close(d.deviceCleanStopped)
 			return
 		}
 	}
 }
 
-func (s *Server) walkOnDeviceFiles() error {
-	fids, err := s.getDeviceFids()
+func (d *serverDevice) walkOnDeviceFiles() error {
+	fids, err := d.meta.getFidsOnDevice(d.devid)
 	if err != nil {
 		return err
 	}
 	for _, fid := range fids {
-		err := s.checkFid(fid)
+		d.workers.beat(d.worker("device-cleaner"))
+		err := d.checkFid(fid)
 		if err != nil {
-			s.log.Errorf("cannot check fid [%d]: %s", fid, err.Error())
+			d.log.Errorf("cannot check fid [%d]: %s", fid, err.Error())
 		}
 	}
 	return nil
 }
 
-func (s *Server) getDeviceFids() (fids []int64, err error) {
-	rows, err := s.db.Query("select fid from file_on where devid=?", s.devid)
-	if err != nil {
-		return
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var fid int64
-		err = rows.Scan(&fid)
-		if err != nil {
-			return
-		}
-		fids = append(fids, fid)
-	}
-	err = rows.Err()
-	return
-}
-
-func (s *Server) checkFid(fid int64) error {
-	tx, err := s.db.Begin()
+func (d *serverDevice) checkFid(fid int64) error {
+	tx, err := d.db.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback() // nolint: errcheck
 
-	devids, err := s.getAllDevidsForFid(tx, fid)
+	devids, err := d.meta.getDevicesOfFid(tx, fid)
 	if err != nil {
 		return err
 	}
-	if !inList(s.devid, devids) {
+	if !inList(d.devid, devids) {
 		return nil
 	}
-	path := filepath.Join(s.config.Server.DataDir, vivify(fid))
+	path := filepath.Join(d.dir, vivify(fid))
 	_, err = os.Stat(path)
 	if os.IsNotExist(err) {
 		// delete from file_on for current devid
-		s.log.Warningf("Deleting fid [%d] from current device", fid)
-		return s.deleteFidFromCurrentDevice(tx, fid)
+		d.log.Warningf("Deleting fid [%d] from current device", fid)
+		return d.deleteFidFromCurrentDevice(tx, fid)
 	} else if err != nil {
 		return err
 	}
 	// file exist on current disk, check other disks
-	otherDevids := removeItem(s.devid, devids)
+	otherDevids := removeItem(d.devid, devids)
 	if len(otherDevids) == 0 {
 		return tx.Commit()
 	}
 	// remove fid from other disks
-	return s.deleteFidFromOtherDevices(tx, otherDevids, fid)
+	return d.deleteFidFromOtherDevices(tx, otherDevids, fid)
 }
 
-func (s *Server) deleteFidFromOtherDevices(tx *sql.Tx, otherDevids []int64, fid int64) error {
-	if s.config.Server.CleanDeviceDryRun {
-		s.log.Infof("Dry run: deleting fid [%d] from other devices: %v", fid, otherDevids)
+func (d *serverDevice) deleteFidFromOtherDevices(tx *storeTx, otherDevids []int64, fid int64) error {
+	if d.config.Server.CleanDeviceDryRun {
+		d.log.Infof("Dry run: deleting fid [%d] from other devices: %v", fid, otherDevids)
+		cleanDryRunCandidates.WithLabelValues(d.devidLabel(), "device").Add(float64(len(otherDevids)))
 		return nil
 	}
-	s.log.Warningf("Deleting fid [%d] from other devices: %v", fid, otherDevids)
-	otherDevidsString := make([]string, len(otherDevids))
-	for i, devid := range otherDevids {
-		otherDevidsString[i] = strconv.FormatInt(devid, 10)
+	d.log.Warningf("Deleting fid [%d] from other devices: %v", fid, otherDevids)
+	err := d.meta.deleteReplicas(tx, fid, otherDevids)
+	if err != nil {
+		return err
 	}
-	_, err := tx.Exec("delete from file_on where fid=? and devid in ("+strings.Join(otherDevidsString, ",")+")", fid)
+	err = d.writeCleanDeviceAudit(tx, fid, otherDevids)
+	if err != nil {
+		return err
+	}
+	err = d.deletes.enqueue(tx, otherDevids, fid)
 	if err != nil {
 		return err
 	}
@@ -140,20 +120,44 @@ func (s *Server) deleteFidFromOtherDevices(tx *sql.Tx, otherDevids []int64, fid
 	if err != nil {
 		return err
 	}
-	go s.publishDeleteTask(otherDevids, fid)
+	cleanRemoved.WithLabelValues(d.devidLabel(), "device").Add(float64(len(otherDevids)))
 	return nil
 }
 
-func (s *Server) deleteFidFromCurrentDevice(tx *sql.Tx, fid int64) error {
-	if s.config.Server.CleanDeviceDryRun {
-		s.log.Infof("Dry run: deleting fid [%d] from current device", fid)
+func (d *serverDevice) deleteFidFromCurrentDevice(tx *storeTx, fid int64) error {
+	if d.config.Server.CleanDeviceDryRun {
+		d.log.Infof("Dry run: deleting fid [%d] from current device", fid)
+		cleanDryRunCandidates.WithLabelValues(d.devidLabel(), "device").Inc()
 		return nil
 	}
-	_, err := tx.Exec("delete from file_on where fid=? and devid=?", fid, s.devid)
+	err := d.meta.deleteReplicas(tx, fid, []int64{d.devid})
+	if err != nil {
+		return err
+	}
+	err = d.writeCleanDeviceAudit(tx, fid, []int64{d.devid})
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	cleanRemoved.WithLabelValues(d.devidLabel(), "device").Inc()
+	return nil
+}
+
+func (d *serverDevice) writeCleanDeviceAudit(tx *storeTx, fid int64, devids []int64) error {
+	key, err := getKeyOfFid(tx, fid)
 	if err != nil {
 		return err
 	}
-	return tx.Commit()
+	return writeAudit(tx, auditRecord{
+		operation: auditCleanDevice,
+		key:       key,
+		fid:       fid,
+		devids:    devids,
+		actor:     d.hostname,
+	})
 }
 
 func inList(value int64, list []int64) bool {
@@ -175,48 +179,3 @@ func removeItem(value int64, list []int64) []int64 {
 	}
 	return list
 }
-
-func (s *Server) getAllDevidsForFid(tx *sql.Tx, fid int64) (devids []int64, err error) {
-	rows, err := tx.Query("select devid from file_on where fid=? for update", fid)
-	if err != nil {
-		return
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var devid int64
-		err = rows.Scan(&devid)
-		if err != nil {
-			return
-		}
-		devids = append(devids, devid)
-	}
-	err = rows.Err()
-	return
-}
-
-func (s *Server) publishDeleteTask(devids []int64, fid int64) {
-	select {
-	case conn, ok := <-s.amqp.Conn():
-		if !ok {
-			s.log.Error("Cannot publish delete task. AMQP connection is closed.")
-			return
-		}
-		ch, err := conn.Channel()
-		if err != nil {
-			s.log.Errorln("cannot open amqp channel:", err.Error())
-			return
-		}
-		for _, devid := range devids {
-			err = publishDeleteTask(ch, devid, fid)
-			if err != nil {
-				s.log.Errorln("cannot publish delete task:", err.Error())
-			}
-		}
-		err = ch.Close()
-		if err != nil {
-			s.log.Errorln("cannot close amqp channel:", err.Error())
-		}
-	case <-s.shutdown:
-		s.log.Warningf("Not sending delete task for fid=%d because shutdown is requested while waiting for amqp connection", fid)
-	}
-}
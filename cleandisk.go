@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"io"
 	"os"
 	"path/filepath"
@@ -12,57 +11,57 @@ import (
 	"github.com/getsentry/sentry-go"
 )
 
-func (s *Server) cleanDisk() {
-	s.log.Notice("Starting disk cleaner...")
+func (d *serverDevice) cleanDisk() {
+	d.log.Notice("Starting disk cleaner...")
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
-	period := time.Duration(s.config.Server.CleanDiskRunPeriod) / time.Second
+	period := time.Duration(d.config.Server.CleanDiskRunPeriod)
+	d.workers.beat(d.worker("disk-cleaner"))
 	for {
 		select {
 		case <-ticker.C:
-			res, err := s.db.Exec("update device set last_disk_clean_time=current_timestamp where devid=? and ADDDATE(last_disk_clean_time, INTERVAL ? SECOND) < CURRENT_TIMESTAMP", s.devid, period)
+			d.workers.beat(d.worker("disk-cleaner"))
+			ok, err := d.meta.startDiskClean(d.devid, period)
 			if err != nil {
-				s.log.Errorln("Error during updating last disk clean time:", err)
+				d.log.Errorln("Error during updating last disk clean time:", err)
 				continue
 			}
-			ra, err := res.RowsAffected()
-			if err != nil {
-				s.log.Errorln("Cannot get rows affected:", err)
-				continue
-			}
-			if ra == 0 {
+			if !ok {
 				continue
 			}
-			s.log.Info("Cleanup has started on data directory.")
-			err = filepath.Walk(s.config.Server.DataDir, s.visitFile)
+			d.log.Info("Cleanup has started on data directory.")
+			begin := time.Now()
+			err = filepath.Walk(d.dir, d.visitFile)
+			cleanDuration.WithLabelValues(d.devidLabel(), "disk").Observe(time.Since(begin).Seconds())
 			if err != nil {
-				s.log.Errorln("Error in data directory cleanup:", err)
+				d.log.Errorln("Error in data directory cleanup:", err)
 				sentry.CaptureException(err)
 			} else {
-				s.log.Infoln("Data directory cleanup has finished successfully.")
+				d.log.Infoln("Data directory cleanup has finished successfully.")
 			}
 			// Updating last_disk_clean_time at the end of traversal helps to
 			// spread the load on database more uniform in time.
-			_, err = s.db.Exec("update device set last_disk_clean_time=current_timestamp where devid=?", s.devid)
+			err = d.meta.finishDiskClean(d.devid)
 			if err != nil {
-				s.log.Errorln("Error during updating last disk clean time:", err)
+				d.log.Errorln("Error during updating last disk clean time:", err)
 				continue
 			}
-		case <-s.shutdown:
-			close(s.diskCleanStopped)
+		case <-d.shutdown:
+			close(d.diskCleanStopped)
 			return
 		}
 	}
 }
 
-func (s *Server) visitFile(path string, f os.FileInfo, err error) error {
+func (d *serverDevice) visitFile(path string, f os.FileInfo, err error) error {
 	select {
-	case <-s.shutdown:
+	case <-d.shutdown:
 		return io.EOF
 	default:
 	}
+	d.workers.beat(d.worker("disk-cleaner"))
 	if err != nil {
-		s.log.Errorln("Error while walking data dir:", err.Error())
+		d.log.Errorln("Error while walking data dir:", err.Error())
 		return nil
 	}
 	if f.IsDir() {
@@ -71,17 +70,17 @@ func (s *Server) visitFile(path string, f os.FileInfo, err error) error {
 	if f.Mode()&os.ModeSymlink == os.ModeSymlink {
 		return nil
 	}
-	ttl := time.Duration(s.config.Server.CleanDiskFileTTL)
+	ttl := time.Duration(d.config.Server.CleanDiskFileTTL)
 	if time.Since(f.ModTime()) < ttl {
-		s.log.Debugf("File [%s] is newer than ttl [%v]", path, ttl)
+		d.log.Debugf("File [%s] is newer than ttl [%v]", path, ttl)
 		return nil
 	}
 	ext := filepath.Ext(path)
 	if ext != ".fid" && ext != ".info" {
-		s.log.Infoln("extension is not \".fid\" or \".info\":", path, "; removing...")
-		err = s.deletePath(path)
+		d.log.Infoln("extension is not \".fid\" or \".info\":", path, "; removing...")
+		err = d.deletePath(path)
 		if err != nil {
-			s.log.Errorln("Cannot remove file:", err.Error())
+			d.log.Errorln("Cannot remove file:", err.Error())
 		}
 		return nil
 	}
@@ -89,48 +88,48 @@ func (s *Server) visitFile(path string, f os.FileInfo, err error) error {
 	fileName := strings.Split(f.Name(), ".")
 	fileID, err := strconv.ParseInt(strings.TrimLeft(fileName[0], "0,"), 10, 64)
 	if err != nil {
-		s.log.Error("Can not parse file name ", err)
+		d.log.Error("Can not parse file name ", err)
 		return nil
 	}
-	existsOnDB, err := s.fidExistsOnDatabase(fileID)
+	existsOnDB, err := d.meta.fidExistsOnDevice(d.devid, fileID)
 	if err != nil {
-		s.log.Errorln("Cannot query database:", err)
+		d.log.Errorln("Cannot query database:", err)
 		return nil
 	}
 	if existsOnDB {
 		return nil
 	}
-	s.log.Infof("Fid %d is too old and there is no record on DB for it. Deleting...", fileID)
-	err = s.deletePath(path)
+	d.log.Infof("Fid %d is too old and there is no record on DB for it. Deleting...", fileID)
+	err = d.deletePath(path)
+	if err != nil {
+		d.log.Errorln("Cannot remove file:", err.Error())
+		return nil
+	}
+	if d.config.Server.CleanDiskDryRun || ext != ".fid" {
+		return nil
+	}
+	err = writeAudit(d.db, auditRecord{
+		operation: auditCleanDisk,
+		fid:       fileID,
+		devids:    []int64{d.devid},
+		actor:     d.hostname,
+	})
 	if err != nil {
-		s.log.Errorln("Cannot remove file:", err.Error())
+		d.log.Errorln("Cannot write audit record:", err.Error())
 	}
 	return nil
 }
 
-func (s *Server) deletePath(path string) error {
-	if s.config.Server.CleanDiskDryRun {
-		s.log.Infof("Dry run: deleting path: %s", path)
+func (d *serverDevice) deletePath(path string) error {
+	if d.config.Server.CleanDiskDryRun {
+		d.log.Infof("Dry run: deleting path: %s", path)
+		cleanDryRunCandidates.WithLabelValues(d.devidLabel(), "disk").Inc()
 		return nil
 	}
-	return os.Remove(path)
-}
-
-func (s *Server) fidExistsOnDatabase(fileID int64) (bool, error) {
-	var fid int
-	switch err := s.db.QueryRow("select fid from file_on where fid=? and devid=?", fileID, s.devid).Scan(&fid); err {
-	case sql.ErrNoRows:
-		switch err = s.db.QueryRow("select fid from tempfile where fid=? and devid=?", fileID, s.devid).Scan(&fid); err {
-		case sql.ErrNoRows:
-			return false, nil
-		case nil:
-			return true, nil
-		default:
-			return true, err
-		}
-	case nil:
-		return true, nil
-	default:
-		return true, err
+	err := os.Remove(path)
+	if err != nil {
+		return err
 	}
+	cleanRemoved.WithLabelValues(d.devidLabel(), "disk").Inc()
+	return nil
 }
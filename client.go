@@ -56,6 +56,7 @@ func (c *Client) request(method, urlPath string, params url.Values, response int
 	if method == http.MethodPost {
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	}
+	c.setAuthorization(req)
 	c.log.Debugln("request method:", req.Method, "path:", req.URL.Path, "params:", params)
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -78,6 +79,13 @@ func (c *Client) request(method, urlPath string, params url.Values, response int
 	return
 }
 
+// setAuthorization adds the configured API token to the request.
+func (c *Client) setAuthorization(req *http.Request) {
+	if c.config.Client.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.Client.Token)
+	}
+}
+
 // Delete the key on Efes.
 func (c *Client) Delete(key string) error {
 	form := url.Values{}
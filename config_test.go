@@ -1,7 +1,10 @@
 package main
 
 import (
-	"database/sql"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -10,14 +13,32 @@ var testConfig *Config
 func init() {
 	testConfig = NewConfig()
 	err := testConfig.ReadFile("/etc/efes.toml")
+	if errors.Is(err, fs.ErrNotExist) {
+		// Without a config for test environment, tests run on a SQLite database that is created on the fly.
+		testConfig.Database.Driver = "sqlite"
+		testConfig.Database.DSN = filepath.Join(os.TempDir(), "efes-test.db")
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			os.Remove(testConfig.Database.DSN + suffix) // nolint: errcheck
+		}
+		db, err := openDatabase(testConfig.Database)
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+		_, err = migrateUp(db, false)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
 }
 
-func cleanDB(t *testing.T, db *sql.DB) {
+func cleanDB(t *testing.T, db *store) {
 	t.Helper()
-	tables := []string{"file_on", "tempfile", "file", "device", "host", "subnet", "rack", "zone"}
+	tables := []string{"delete_outbox", "task", "leader_lease", "host_status_history", "device_status_history", "webhook_delivery", "webhook_dead_letter", "webhook", "file_change", "audit", "api_token", "file_on", "tempfile", "file", "device", "host", "subnet", "rack", "zone"}
 	for _, table := range tables {
 		_, err := db.Exec("delete from " + table)
 		if err != nil {
@@ -25,3 +46,41 @@ func cleanDB(t *testing.T, db *sql.DB) {
 		}
 	}
 }
+
+func TestConfigDatabaseQueueWithoutBroker(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "efes.toml")
+	err := os.WriteFile(name, []byte("[tasks]\nqueue = \"database\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := NewConfig()
+	err = cfg.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AMQP.EventExchange != "" {
+		t.Fatalf("event exchange must be empty by default with database queue: %q", cfg.AMQP.EventExchange)
+	}
+	cfg.Database = testConfig.Database
+	tr, err := NewTracker(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logCloseDB(tr.log, tr.db)
+	if tr.amqp != nil {
+		t.Fatal("tracker must not connect to amqp with database queue")
+	}
+
+	err = os.WriteFile(name, []byte("[tasks]\nqueue = \"database\"\n[amqp]\nevent_exchange = \"events\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = NewConfig()
+	err = cfg.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AMQP.EventExchange != "events" {
+		t.Fatalf("explicit event exchange must be kept: %q", cfg.AMQP.EventExchange)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/olekukonko/tablewriter"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// deadDeleteTask is a delete task in the dead letter queue, or a task marked dead in the task table.
+type deadDeleteTask struct {
+	devid    int64
+	fid      int64
+	retries  int
+	err      string
+	failedAt time.Time
+}
+
+func parseDeadDeleteTask(msg amqp.Delivery) (deadDeleteTask, error) {
+	var task deadDeleteTask
+	var err error
+	task.fid, err = strconv.ParseInt(string(msg.Body), 10, 64)
+	if err != nil {
+		return task, fmt.Errorf("invalid fid in message: %q", msg.Body)
+	}
+	switch v := msg.Headers[devidHeader].(type) {
+	case int32:
+		task.devid = int64(v)
+	case int64:
+		task.devid = v
+	default:
+		return task, fmt.Errorf("message of fid %d has no devid", task.fid)
+	}
+	task.retries = deleteTaskRetries(msg)
+	task.err, _ = msg.Headers[errorHeader].(string)
+	task.failedAt = msg.Timestamp
+	return task, nil
+}
+
+// readDeadDeleteTasks calls fn with each message in the dead letter queue. The channel is in confirm mode.
+// Messages that are not acked by fn return to the queue when the channel is closed.
+func readDeadDeleteTasks(cfg *Config, fn func(ch *amqp.Channel, msg amqp.Delivery) error) error {
+	conn, err := amqp.Dial(cfg.AMQP.URL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	q, err := declareDeadDeleteQueue(ch)
+	if err != nil {
+		return err
+	}
+	err = ch.Confirm(false)
+	if err != nil {
+		return err
+	}
+	// Count is taken before reading so that unacked messages are not read again.
+	for i := 0; i < q.Messages; i++ {
+		msg, ok, err := ch.Get(q.Name, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		err = fn(ch, msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withDatabaseDeleteQueue calls fn with the task table of the database in config, which holds dead tasks of "database" queue.
+func withDatabaseDeleteQueue(cfg *Config, fn func(q *databaseDeleteQueue) error) error {
+	db, err := openDatabase(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer logCloseDB(log.DefaultLogger, db)
+	return fn(&databaseDeleteQueue{db: db, log: log.DefaultLogger})
+}
+
+func listDeadDeleteTasks(cfg *Config) error {
+	var tasks []deadDeleteTask
+	var err error
+	if cfg.Tasks.usesAMQP() {
+		err = readDeadDeleteTasks(cfg, func(ch *amqp.Channel, msg amqp.Delivery) error {
+			task, err := parseDeadDeleteTask(msg)
+			if err != nil {
+				return err
+			}
+			tasks = append(tasks, task)
+			return nil
+		})
+	} else {
+		err = withDatabaseDeleteQueue(cfg, func(q *databaseDeleteQueue) error {
+			tasks, err = q.deadTasks()
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetBorder(false)
+	table.SetHeader([]string{"Devid", "Fid", "Retries", "Failed at", "Last error"})
+	for _, task := range tasks {
+		table.Append([]string{
+			strconv.FormatInt(task.devid, 10),
+			strconv.FormatInt(task.fid, 10),
+			strconv.Itoa(task.retries),
+			task.failedAt.Format(time.RFC3339),
+			task.err,
+		})
+	}
+	table.Render()
+	return nil
+}
+
+// replayDeadDeleteTasks sends dead tasks back to the delete queues of their devices with retry count reset.
+// If devid is not zero, only tasks of that device are replayed.
+func replayDeadDeleteTasks(cfg *Config, devid int64) error {
+	if !cfg.Tasks.usesAMQP() {
+		return withDatabaseDeleteQueue(cfg, func(q *databaseDeleteQueue) error {
+			replayed, err := q.replayDeadTasks(devid)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("replayed %d tasks\n", replayed)
+			return nil
+		})
+	}
+	var replayed int
+	err := readDeadDeleteTasks(cfg, func(ch *amqp.Channel, msg amqp.Delivery) error {
+		task, err := parseDeadDeleteTask(msg)
+		if err != nil {
+			return err
+		}
+		if devid != 0 && task.devid != devid {
+			return nil
+		}
+		// Queue may not exist yet if the server of device has never run.
+		_, err = declareDeleteQueue(ch, task.devid)
+		if err != nil {
+			return err
+		}
+		err = publishConfirmed(ch, deleteQueueName(task.devid), amqp.Publishing{
+			ContentType: "text/plain",
+			Body:        msg.Body,
+		})
+		if err != nil {
+			return err
+		}
+		replayed++
+		return msg.Ack(false)
+	})
+	fmt.Printf("replayed %d tasks\n", replayed)
+	return err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Device statuses.
+const (
+	deviceAlive = "alive"
+	deviceDrain = "drain"
+	deviceDown  = "down"
+	deviceDead  = "dead"
+)
+
+// deviceTransitions lists allowed status changes of a device.
+// A dead device never comes back; it must be added again with a new devid.
+var deviceTransitions = map[string][]string{
+	deviceAlive: {deviceDrain, deviceDown, deviceDead},
+	deviceDrain: {deviceAlive, deviceDown, deviceDead},
+	deviceDown:  {deviceAlive, deviceDrain, deviceDead},
+	deviceDead:  {},
+}
+
+var errInvalidTransition = errors.New("invalid device status transition")
+
+// LastReplicaError is returned when a device holding the only copy of some files is marked as dead.
+type LastReplicaError struct {
+	Devid int64
+	Count int64
+}
+
+func (e *LastReplicaError) Error() string {
+	return fmt.Sprintf("device %d holds the only replica of %d files", e.Devid, e.Count)
+}
+
+type deviceStatusChange struct {
+	status   string
+	operator string
+	reason   string
+	force    bool
+}
+
+// setDeviceStatus changes the status of a device if the transition is allowed and records it in history.
+// It returns sql.ErrNoRows if device does not exist.
+func setDeviceStatus(ctx context.Context, db *store, devid int64, c deviceStatusChange) error {
+	if _, ok := deviceTransitions[c.status]; !ok {
+		return fmt.Errorf("%w: unknown status: %s", errInvalidTransition, c.status)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	var current string
+	err = tx.QueryRow("select status from device where devid=?"+tx.forUpdate(), devid).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current == c.status {
+		return nil
+	}
+	if !inStringList(c.status, deviceTransitions[current]) {
+		return fmt.Errorf("%w: %s -> %s", errInvalidTransition, current, c.status)
+	}
+	if c.status == deviceDead && !c.force {
+		var count int64
+		err = tx.QueryRow("select count(*) from file_on fo "+
+			"where fo.devid=? "+
+			"and not exists("+
+			"select 1 from file_on fo2 join device d on d.devid=fo2.devid "+
+			"where fo2.fid=fo.fid and fo2.devid<>fo.devid and d.status<>'dead')", devid).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return &LastReplicaError{Devid: devid, Count: count}
+		}
+	}
+	_, err = tx.Exec("update device set status=? where devid=?", c.status, devid)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into device_status_history(devid, old_status, new_status, operator, reason) values(?, ?, ?, ?, ?)",
+		devid, current, c.status, c.operator, c.reason)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (t *Tracker) setDeviceStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	devid, err := strconv.ParseInt(r.FormValue("devid"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid param: devid", http.StatusBadRequest)
+		return
+	}
+	c := deviceStatusChange{
+		status:   r.FormValue("status"),
+		operator: r.FormValue("operator"),
+		reason:   r.FormValue("reason"),
+		force:    r.FormValue("force") == "true",
+	}
+	if c.operator == "" {
+		c.operator = auditActor(r)
+	}
+	if c.operator == "" || c.reason == "" {
+		http.Error(w, "required parameters: operator, reason", http.StatusBadRequest)
+		return
+	}
+	err = setDeviceStatus(r.Context(), t.db, devid, c)
+	var lerr *LastReplicaError
+	switch {
+	case err == nil:
+		t.paths.Purge()
+		t.events.PublishStatus(StatusEvent{Event: eventDeviceStatus, ID: devid, To: c.status, Reason: c.reason})
+	case err == sql.ErrNoRows:
+		http.Error(w, "device not found", http.StatusNotFound)
+	case errors.Is(err, errInvalidTransition):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.As(err, &lerr):
+		http.Error(w, err.Error()+"; use force to override", http.StatusConflict)
+	default:
+		t.internalServerError("cannot set device status", err, r, w)
+	}
+}
+
+// SetDeviceStatus changes the status of a device on tracker.
+func (c *Client) SetDeviceStatus(devid int64, status, operator, reason string, force bool) error {
+	form := url.Values{}
+	form.Add("devid", strconv.FormatInt(devid, 10))
+	form.Add("status", status)
+	form.Add("operator", operator)
+	form.Add("reason", reason)
+	form.Add("force", strconv.FormatBool(force))
+	_, err := c.request(http.MethodPost, "set-device-status", form, nil)
+	return err
+}
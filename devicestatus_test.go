@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSetDeviceStatus(t *testing.T) {
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	insertHost(t, tr)
+	_, err = tr.db.Exec("insert into device(devid, status, hostid) values(2, 'alive', 1), (3, 'alive', 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.db.Exec("insert into file(fid, dkey) values(42, 'foo')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.db.Exec("insert into file_on(fid, devid) values(42, 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	change := deviceStatusChange{operator: "test", reason: "testing"}
+
+	change.status = deviceDead
+	err = setDeviceStatus(ctx, tr.db, 2, change)
+	var lerr *LastReplicaError
+	if !errors.As(err, &lerr) || lerr.Count != 1 {
+		t.Fatalf("device with last replica must not be marked dead: %v", err)
+	}
+
+	_, err = tr.db.Exec("insert into file_on(fid, devid) values(42, 3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setDeviceStatus(ctx, tr.db, 2, change)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	change.status = deviceAlive
+	err = setDeviceStatus(ctx, tr.db, 2, change)
+	if !errors.Is(err, errInvalidTransition) {
+		t.Fatalf("dead device must not become alive: %v", err)
+	}
+
+	change.status = deviceDead
+	err = setDeviceStatus(ctx, tr.db, 3, change)
+	if !errors.As(err, &lerr) {
+		t.Fatalf("replica on dead device must not be counted: %v", err)
+	}
+	change.force = true
+	err = setDeviceStatus(ctx, tr.db, 3, change)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	err = tr.db.QueryRow("select count(*) from device_status_history where new_status='dead' and operator='test'").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("unexpected history count: %d", count)
+	}
+}
@@ -1,41 +1,40 @@
 package main
 
 import (
-	"database/sql"
-	"fmt"
+	"context"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
 
 	"github.com/cenkalti/log"
+	"github.com/cenkalti/redialer/amqpredialer"
 )
 
 type Drainer struct {
-	Dest     []int64
-	config   *Config
-	devid    int64
-	db       *sql.DB
-	client   *Client
-	log      log.Logger
-	shutdown chan struct{}
-	stopped  chan struct{}
+	Dest                []int64
+	config              *Config
+	devid               int64
+	dir                 string
+	hostname            string
+	db                  *store
+	meta                metadataStore
+	client              *Client
+	amqp                *amqpredialer.AMQPRedialer
+	events              *eventPublisher
+	log                 log.Logger
+	shutdown            chan struct{}
+	stopped             chan struct{}
+	amqpRedialerStopped chan struct{}
 
 	stopOnError bool
 }
 
-func NewDrainer(c *Config) (*Drainer, error) {
-	fi, err := os.Stat(c.Server.DataDir)
+// NewDrainer returns a drainer of devid in data directories of server config.
+// If devid is zero, the server must have a single data directory.
+func NewDrainer(c *Config, devid int64) (*Drainer, error) {
+	devid, dir, err := c.Server.deviceDir(devid)
 	if err != nil {
 		return nil, err
 	}
-	if !fi.IsDir() {
-		return nil, fmt.Errorf("path must be a directory: %s", c.Server.DataDir)
-	}
-	devid, err := strconv.ParseInt(strings.TrimPrefix(filepath.Base(c.Server.DataDir), "dev"), 10, 32)
-	if err != nil {
-		return nil, fmt.Errorf("cannot determine device ID from dir: %s", c.Server.DataDir)
-	}
 	db, err := openDatabase(c.Database)
 	if err != nil {
 		return nil, err
@@ -46,44 +45,62 @@ func NewDrainer(c *Config) (*Drainer, error) {
 	}
 	clt.drainer = true
 	logger := log.NewLogger("drain")
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
 	d := &Drainer{
-		config:   c,
-		devid:    devid,
-		db:       db,
-		client:   clt,
-		log:      logger,
-		shutdown: make(chan struct{}),
-		stopped:  make(chan struct{}),
+		config:              c,
+		devid:               devid,
+		dir:                 dir,
+		hostname:            hostname,
+		db:                  db,
+		meta:                newMetadataStore(db),
+		client:              clt,
+		log:                 logger,
+		shutdown:            make(chan struct{}),
+		stopped:             make(chan struct{}),
+		amqpRedialerStopped: make(chan struct{}),
 	}
 	if d.config.Debug {
 		d.log.SetLevel(log.DEBUG)
 	}
+	if c.AMQP.EventExchange != "" {
+		d.amqp, err = amqpredialer.New(c.AMQP.URL)
+		if err != nil {
+			logCloseDB(d.log, db)
+			return nil, err
+		}
+	}
+	d.events = newEventPublisher(c.AMQP.EventExchange, d.amqp, d.log, d.shutdown)
 	return d, nil
 }
 
 func (d *Drainer) Run() error {
+	if d.amqp != nil {
+		go func() {
+			d.amqp.Run()
+			close(d.amqpRedialerStopped)
+		}()
+	} else {
+		close(d.amqpRedialerStopped)
+	}
+	// Drainer exits after Run returns. Make sure events are sent before that.
+	defer d.events.Wait()
 	d.log.Noticeln("Setting device status to 'drain' on device:", d.devid)
-	_, err := d.db.Exec("update device set status='drain' where devid=?", d.devid)
+	err := setDeviceStatus(context.Background(), d.db, d.devid, deviceStatusChange{
+		status:   deviceDrain,
+		operator: "drain@" + d.hostname,
+		reason:   "efes drain is started",
+	})
 	if err != nil {
 		return err
 	}
-	var fids []int64
-	rows, err := d.db.Query("select fid from file_on where devid=?", d.devid)
+	d.events.PublishStatus(StatusEvent{Event: eventDeviceStatus, ID: d.devid, To: deviceDrain, Reason: "efes drain is started"})
+	fids, err := d.meta.getFidsOnDevice(d.devid)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var fid int64
-		err = rows.Scan(&fid)
-		if err != nil {
-			return err
-		}
-		fids = append(fids, fid)
-	}
-	if err = rows.Err(); err != nil {
-		return err
-	}
 	for i, fid := range fids {
 		select {
 		case <-d.shutdown:
@@ -103,7 +120,7 @@ func (d *Drainer) Run() error {
 }
 
 func (d *Drainer) moveFile(fid int64) error {
-	fidpath := filepath.Join(d.config.Server.DataDir, vivify(fid))
+	fidpath := filepath.Join(d.dir, vivify(fid))
 	f, err := os.Open(fidpath)
 	if os.IsNotExist(err) {
 		d.log.Warningf("file (%s) does not exist on disk", fidpath)
@@ -117,19 +134,43 @@ func (d *Drainer) moveFile(fid int64) error {
 	if err != nil {
 		return err
 	}
-	ad, err := findAliveDevice(d.db, fi.Size(), d.Dest, "")
+	ad, err := findAliveDevice(d.meta, fi.Size(), d.Dest, "")
 	if err != nil {
 		return err
 	}
 	newPath := ad.PatchURL(fid)
-	_, err = d.client.sendFile(newPath, f, fi.Size())
+	_, _, err = d.client.sendFile(newPath, f, fi.Size())
 	if err != nil {
 		return err
 	}
-	_, err = d.db.Exec("update file_on set devid=? where devid=? and fid=?", ad.devid, d.devid, fid)
+	tx, err := d.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback() // nolint: errcheck
+	err = d.meta.moveReplica(tx, fid, d.devid, ad.devid)
+	if err != nil {
+		return err
+	}
+	key, err := getKeyOfFid(tx, fid)
+	if err != nil {
+		return err
+	}
+	err = writeAudit(tx, auditRecord{
+		operation: auditDrain,
+		key:       key,
+		fid:       fid,
+		devids:    []int64{d.devid, ad.devid},
+		actor:     d.hostname,
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	d.events.Publish(FileEvent{Event: eventFileMoved, Key: key, Fid: fid, Devids: []int64{ad.devid}, FromDevid: d.devid})
 	return os.Remove(fidpath)
 }
 
@@ -142,5 +183,13 @@ func (d *Drainer) Shutdown() error {
 		d.log.Error("Error while closing database connection")
 		return err
 	}
+	d.events.Wait()
+	if d.amqp != nil {
+		err = d.amqp.Close()
+		if err != nil {
+			return err
+		}
+	}
+	<-d.amqpRedialerStopped
 	return nil
 }
@@ -98,7 +98,7 @@ func TestDrain(t *testing.T) {
 	defer srv2.Shutdown()
 
 	// Run drain
-	dr, err := NewDrainer(&serverConfig)
+	dr, err := NewDrainer(&serverConfig, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
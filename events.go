@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/cenkalti/redialer/amqpredialer"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Routing keys of file lifecycle events.
+const (
+	eventFileCreated  = "file.created"
+	eventFileDeleted  = "file.deleted"
+	eventFileMoved    = "file.moved"
+	eventDeviceStatus = "device.status"
+	eventHostStatus   = "host.status"
+)
+
+// How long an event waits for an AMQP connection after it is sent, before it is dropped.
+const eventPublishTimeout = 30 * time.Second
+
+// FileEvent is the JSON body of messages published to events exchange.
+type FileEvent struct {
+	Event     string  `json:"event"`
+	Key       string  `json:"key,omitempty"`
+	Fid       int64   `json:"fid"`
+	Devids    []int64 `json:"devids,omitempty"`
+	FromDevid int64   `json:"from_devid,omitempty"`
+	Reason    string  `json:"reason,omitempty"`
+	Time      string  `json:"time"`
+}
+
+// StatusEvent is the JSON body of messages published when a device or host changes status.
+type StatusEvent struct {
+	Event  string `json:"event"`
+	ID     int64  `json:"id"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to"`
+	Reason string `json:"reason,omitempty"`
+	Time   string `json:"time"`
+}
+
+// Number of events waiting to be published. Events are dropped if the queue is full.
+const eventQueueSize = 1000
+
+// eventPublisher publishes file lifecycle and status events to a topic exchange.
+// Events are published in the order they are sent, by a single goroutine on a single channel.
+// Events are not persisted; they are dropped if there is no AMQP connection.
+type eventPublisher struct {
+	exchange string
+	amqp     *amqpredialer.AMQPRedialer
+	log      log.Logger
+	shutdown chan struct{}
+	queue    chan eventMessage
+	m        sync.Mutex
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+type eventMessage struct {
+	routingKey string
+	body       []byte
+	subject    string
+	// Event is dropped if there is no connection until deadline.
+	deadline time.Time
+}
+
+func newEventPublisher(exchange string, amqp *amqpredialer.AMQPRedialer, logger log.Logger, shutdown chan struct{}) *eventPublisher {
+	p := &eventPublisher{
+		exchange: exchange,
+		amqp:     amqp,
+		log:      logger,
+		shutdown: shutdown,
+		queue:    make(chan eventMessage, eventQueueSize),
+	}
+	if exchange != "" {
+		p.wg.Add(1)
+		go p.run()
+	}
+	return p
+}
+
+// Publish sends e in background.
+func (p *eventPublisher) Publish(e FileEvent) {
+	e.Time = time.Now().UTC().Format(time.RFC3339)
+	p.send(e.Event, e, fmt.Sprintf("fid=%d", e.Fid))
+}
+
+// PublishStatus sends e in background.
+func (p *eventPublisher) PublishStatus(e StatusEvent) {
+	e.Time = time.Now().UTC().Format(time.RFC3339)
+	p.send(e.Event, e, fmt.Sprintf("id=%d", e.ID))
+}
+
+func (p *eventPublisher) send(routingKey string, e interface{}, subject string) {
+	if p.exchange == "" {
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		p.log.Errorln("cannot marshal event:", err.Error())
+		return
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.closed {
+		p.log.Warningf("Not sending %s event for %s because publisher is stopped", routingKey, subject)
+		return
+	}
+	select {
+	case p.queue <- eventMessage{routingKey: routingKey, body: body, subject: subject, deadline: time.Now().Add(eventPublishTimeout)}:
+	default:
+		p.log.Warningf("Dropping %s event for %s because event queue is full", routingKey, subject)
+		amqpPublishFailures.WithLabelValues("event").Inc()
+	}
+}
+
+// Wait until queued events are published. Events sent after Wait are dropped.
+func (p *eventPublisher) Wait() {
+	p.m.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.m.Unlock()
+	p.wg.Wait()
+}
+
+// run publishes queued events until the queue is closed.
+// The channel is kept open between events and opened again after an error.
+func (p *eventPublisher) run() {
+	defer p.wg.Done()
+	var ch *amqp.Channel
+	defer func() {
+		if ch != nil {
+			p.closeChannel(ch)
+		}
+	}()
+	for msg := range p.queue {
+		if ch == nil {
+			ch = p.openChannel(msg)
+			if ch == nil {
+				continue
+			}
+		}
+		err := publishEvent(ch, p.exchange, msg.routingKey, msg.body)
+		if err != nil {
+			p.log.Errorf("cannot publish %s event: %s", msg.routingKey, err.Error())
+			amqpPublishFailures.WithLabelValues("event").Inc()
+			p.closeChannel(ch)
+			ch = nil
+		}
+	}
+}
+
+// openChannel returns a channel for publishing msg, or nil if msg is dropped.
+// The exchange is declared once here instead of before each publish.
+func (p *eventPublisher) openChannel(msg eventMessage) *amqp.Channel {
+	timeout := time.NewTimer(time.Until(msg.deadline))
+	defer timeout.Stop()
+	select {
+	case conn, ok := <-p.amqp.Conn():
+		if !ok {
+			p.log.Errorf("Cannot publish %s event. AMQP connection is closed.", msg.routingKey)
+			amqpPublishFailures.WithLabelValues("event").Inc()
+			return nil
+		}
+		ch, err := conn.Channel()
+		if err != nil {
+			p.log.Errorln("cannot open amqp channel:", err.Error())
+			amqpPublishFailures.WithLabelValues("event").Inc()
+			return nil
+		}
+		err = declareEventExchange(ch, p.exchange)
+		if err != nil {
+			p.log.Errorln("cannot declare event exchange:", err.Error())
+			amqpPublishFailures.WithLabelValues("event").Inc()
+			p.closeChannel(ch)
+			return nil
+		}
+		return ch
+	case <-timeout.C:
+		p.log.Warningf("Dropping %s event for %s because amqp connection is not available", msg.routingKey, msg.subject)
+		amqpPublishFailures.WithLabelValues("event").Inc()
+	case <-p.shutdown:
+		p.log.Warningf("Not sending %s event for %s because shutdown is requested while waiting for amqp connection", msg.routingKey, msg.subject)
+	}
+	return nil
+}
+
+func (p *eventPublisher) closeChannel(ch *amqp.Channel) {
+	err := ch.Close()
+	if err != nil && err != amqp.ErrClosed {
+		p.log.Errorln("cannot close amqp channel:", err.Error())
+	}
+}
+
+func declareEventExchange(ch *amqp.Channel, exchange string) error {
+	return ch.ExchangeDeclare(
+		exchange,
+		amqp.ExchangeTopic,
+		true,  // durable
+		false, // auto-deleted
+		false, // internal
+		false, // no-wait
+		nil,   // arguments
+	)
+}
+
+// publishEvent publishes an event to exchange. The exchange must be declared on ch before.
+func publishEvent(ch *amqp.Channel, exchange, routingKey string, body []byte) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	return ch.PublishWithContext(
+		ctx,
+		exchange,   // exchange
+		routingKey, // routing key
+		false,      // mandatory
+		false,      // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    time.Now(),
+			Body:         body,
+		})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/cenkalti/redialer/amqpredialer"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDeleteEvent(t *testing.T) {
+	conn, err := amqp.Dial(testConfig.AMQP.URL)
+	if err != nil {
+		t.Skipf("amqp is not reachable: %s", err)
+	}
+	defer conn.Close()
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	insertHost(t, tr)
+	_, err = tr.db.Exec("insert into device(devid, hostid) values(2, 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.db.Exec("insert into file(fid, dkey) values(42, 'foo')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.db.Exec("insert into file_on(fid, devid) values(42, 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = declareEventExchange(ch, testConfig.AMQP.EventExchange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ch.QueueBind(q.Name, "file.*", testConfig.AMQP.EventExchange, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := ch.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go tr.Run()
+	defer tr.Shutdown()
+	<-tr.Ready
+
+	req, err := http.NewRequest("POST", "/delete?key=foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	tr.server.Handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	select {
+	case msg := <-messages:
+		if msg.RoutingKey != eventFileDeleted {
+			t.Errorf("unexpected routing key: %s", msg.RoutingKey)
+		}
+		var e FileEvent
+		err = json.Unmarshal(msg.Body, &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Key != "foo" || e.Fid != 42 || len(e.Devids) != 1 || e.Devids[0] != 2 {
+			t.Errorf("unexpected event: %#v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("event is not received")
+	}
+}
+
+func TestEventPublisherWait(t *testing.T) {
+	r, err := amqpredialer.New("amqp://127.0.0.1:1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shutdown := make(chan struct{})
+	p := newEventPublisher("efes", r, log.DefaultLogger, shutdown)
+	close(shutdown)
+	// Queued events are dropped without a connection after shutdown is requested.
+	p.Publish(FileEvent{Event: eventFileDeleted, Fid: 1})
+	p.PublishStatus(StatusEvent{Event: eventDeviceStatus, ID: 1, To: deviceDown})
+	p.Wait()
+	// Events sent after Wait are dropped.
+	p.Publish(FileEvent{Event: eventFileDeleted, Fid: 2})
+	p.Wait()
+}
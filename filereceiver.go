@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -18,16 +17,16 @@ import (
 
 // FileReceiver implements http.Handler for receiving files from clients in chunks.
 type FileReceiver struct {
-	dir string
-	log log.Logger
-	db  *sql.DB
+	dir  string
+	log  log.Logger
+	meta metadataStore
 }
 
-func newFileReceiver(dir string, logger log.Logger, db *sql.DB) *FileReceiver {
+func newFileReceiver(dir string, logger log.Logger, meta metadataStore) *FileReceiver {
 	return &FileReceiver{
-		dir: dir,
-		log: logger,
-		db:  db,
+		dir:  dir,
+		log:  logger,
+		meta: meta,
 	}
 }
 
@@ -127,22 +126,14 @@ func (f *FileReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (f *FileReceiver) tempfileExists(fpath string) (bool, error) {
-	if f.db == nil {
+	if f.meta == nil {
 		return true, nil
 	}
 	fid, err := strconv.ParseInt(strings.SplitN(path.Base(fpath), ".", 2)[0], 10, 64)
 	if err != nil {
 		return false, err
 	}
-	row := f.db.QueryRow("select fid from tempfile where fid=?", fid)
-	err = row.Scan(&fid)
-	if err == sql.ErrNoRows {
-		return false, nil
-	}
-	if err != nil {
-		return false, err
-	}
-	return true, nil
+	return f.meta.tempfileExists(fid)
 }
 
 func createFile(path string) error {
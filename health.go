@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/redialer/amqpredialer"
+)
+
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+)
+
+// healthCheckTimeout is the maximum time spent for checking a single dependency.
+const healthCheckTimeout = 2 * time.Second
+
+type healthCheck struct {
+	Status    string   `json:"status"`
+	LatencyMS *float64 `json:"latency_ms,omitempty"`
+	LastSeen  string   `json:"last_seen,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+	Leader *leaderStatus          `json:"leader,omitempty"`
+}
+
+type leaderStatus struct {
+	Holder   string `json:"holder"`
+	IsLeader bool   `json:"is_leader"`
+}
+
+func newHealthReport() *healthReport {
+	return &healthReport{
+		Status: healthOK,
+		Checks: make(map[string]healthCheck),
+	}
+}
+
+func (h *healthReport) add(name string, c healthCheck) {
+	h.Checks[name] = c
+	if c.Status != healthOK {
+		h.Status = healthFail
+	}
+}
+
+// write sends the report as JSON. Status code is 503 if any of the checks has failed.
+func (h *healthReport) write(w http.ResponseWriter) {
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("cache-control", "no-cache")
+	if h.Status != healthOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.Encode(h) // nolint: errcheck
+}
+
+func failedCheck(err error) healthCheck {
+	return healthCheck{Status: healthFail, Error: err.Error()}
+}
+
+func checkDatabase(ctx context.Context, db *store) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	begin := time.Now()
+	err := db.PingContext(ctx)
+	if err != nil {
+		return failedCheck(err)
+	}
+	latency := float64(time.Since(begin)) / float64(time.Millisecond)
+	return healthCheck{Status: healthOK, LatencyMS: &latency}
+}
+
+func checkAMQP(r *amqpredialer.AMQPRedialer) healthCheck {
+	select {
+	case conn, ok := <-r.Conn():
+		if !ok || conn.IsClosed() {
+			return healthCheck{Status: healthFail, Error: "connection is closed"}
+		}
+		return healthCheck{Status: healthOK}
+	case <-time.After(healthCheckTimeout):
+		return healthCheck{Status: healthFail, Error: "not connected"}
+	}
+}
+
+func checkReady(ready chan struct{}) healthCheck {
+	select {
+	case <-ready:
+		return healthCheck{Status: healthOK}
+	default:
+		return healthCheck{Status: healthFail, Error: "not ready"}
+	}
+}
+
+// workerMonitor keeps track of background goroutines.
+// Workers call beat periodically; a worker is considered dead if it has not done it for maxAge.
+type workerMonitor struct {
+	m       sync.Mutex
+	workers map[string]*workerState
+}
+
+type workerState struct {
+	maxAge   time.Duration
+	lastBeat time.Time
+}
+
+func newWorkerMonitor() *workerMonitor {
+	return &workerMonitor{workers: make(map[string]*workerState)}
+}
+
+// register must be called before the worker is started.
+func (w *workerMonitor) register(name string, maxAge time.Duration) {
+	w.m.Lock()
+	w.workers[name] = &workerState{maxAge: maxAge}
+	w.m.Unlock()
+}
+
+func (w *workerMonitor) beat(name string) {
+	w.m.Lock()
+	if ws, ok := w.workers[name]; ok {
+		ws.lastBeat = time.Now()
+	}
+	w.m.Unlock()
+}
+
+// check adds the status of each worker to the report.
+func (w *workerMonitor) check(h *healthReport) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	names := make([]string, 0, len(w.workers))
+	for name := range w.workers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ws := w.workers[name]
+		c := healthCheck{Status: healthOK}
+		switch {
+		case ws.lastBeat.IsZero():
+			c.Status = healthFail
+			c.Error = "not started"
+		case time.Since(ws.lastBeat) > ws.maxAge:
+			c.Status = healthFail
+			c.Error = "not running"
+		}
+		if !ws.lastBeat.IsZero() {
+			c.LastSeen = ws.lastBeat.UTC().Format(time.RFC3339)
+		}
+		h.add(name, c)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWorkerMonitor(t *testing.T) {
+	w := newWorkerMonitor()
+	w.register("foo", time.Minute)
+	w.register("bar", time.Minute)
+	w.beat("foo")
+
+	h := newHealthReport()
+	w.check(h)
+	if h.Status != healthFail {
+		t.Fatalf("unexpected status: %s", h.Status)
+	}
+	if h.Checks["foo"].Status != healthOK {
+		t.Fatalf("foo is not ok: %+v", h.Checks["foo"])
+	}
+	if h.Checks["bar"].Error != "not started" {
+		t.Fatalf("unexpected error for bar: %+v", h.Checks["bar"])
+	}
+
+	w.workers["foo"].lastBeat = time.Now().Add(-2 * time.Minute)
+	w.beat("bar")
+	h = newHealthReport()
+	w.check(h)
+	if h.Checks["foo"].Error != "not running" {
+		t.Fatalf("unexpected error for foo: %+v", h.Checks["foo"])
+	}
+	if h.Checks["bar"].Status != healthOK {
+		t.Fatalf("bar is not ok: %+v", h.Checks["bar"])
+	}
+}
+
+func TestHealthReportStatusCode(t *testing.T) {
+	h := newHealthReport()
+	h.add("foo", healthCheck{Status: healthOK})
+	rec := httptest.NewRecorder()
+	h.write(rec)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", rec.Code)
+	}
+
+	h.add("bar", healthCheck{Status: healthFail, Error: "broken"})
+	rec = httptest.NewRecorder()
+	h.write(rec)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status code: %d", rec.Code)
+	}
+	var report healthReport
+	err := json.Unmarshal(rec.Body.Bytes(), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != healthFail || report.Checks["bar"].Error != "broken" {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// heartbeatMonitorOperator is recorded as the operator of status changes made by heartbeat monitor.
+// Only the devices and hosts marked down by the monitor are brought back automatically.
+const heartbeatMonitorOperator = "heartbeat-monitor"
+
+// heartbeatMonitor marks devices and hosts as down when servers stop updating disk stats
+// and restores their previous status when updates resume.
+func (t *Tracker) heartbeatMonitor() {
+	t.log.Notice("Starting heartbeat monitor...")
+	ticker := time.NewTicker(time.Duration(t.config.Tracker.HeartbeatCheckPeriod))
+	defer ticker.Stop()
+	t.workers.beat("heartbeat-monitor")
+	for {
+		select {
+		case <-ticker.C:
+			t.workers.beat("heartbeat-monitor")
+			if !t.leader.IsLeader() {
+				continue
+			}
+			err := t.checkHeartbeats()
+			if err != nil {
+				t.log.Errorln("cannot check heartbeats:", err.Error())
+				sentry.CaptureException(err)
+			}
+		case <-t.shutdown:
+			close(t.heartbeatMonitorStopped)
+			return
+		}
+	}
+}
+
+type statusTransition struct {
+	id   int64
+	from string
+	to   string
+}
+
+func (t *Tracker) checkHeartbeats() error {
+	timeout := int64(time.Duration(t.config.Tracker.HeartbeatTimeout) / time.Second)
+	ctx := context.Background()
+
+	// Devices that stopped sending heartbeats
+	stale, err := t.selectTransitions("select_stale_devices", "select devid, status, 'down' from device "+
+		"where status in ('alive', 'drain') "+
+		"and "+t.db.secondsSince("updated_at")+" >= ?", timeout)
+	if err != nil {
+		return err
+	}
+	// Devices marked down by monitor that started sending heartbeats again
+	recovered, err := t.selectTransitions("select_recovered_devices", "select d.devid, d.status, h.old_status from device d "+
+		"join device_status_history h on h.historyid=(select max(historyid) from device_status_history where devid=d.devid) "+
+		"where d.status='down' and h.new_status='down' and h.operator=? "+
+		"and "+t.db.secondsSince("d.updated_at")+" < ?", heartbeatMonitorOperator, timeout)
+	if err != nil {
+		return err
+	}
+	for _, tr := range append(stale, recovered...) {
+		err = setDeviceStatus(ctx, t.db, tr.id, deviceStatusChange{
+			status:   tr.to,
+			operator: heartbeatMonitorOperator,
+			reason:   heartbeatReason(tr.to, timeout),
+		})
+		if err != nil {
+			t.log.Errorf("cannot change status of device %d from %s to %s: %s", tr.id, tr.from, tr.to, err.Error())
+			continue
+		}
+		t.log.Warningf("Device %d status is changed from %s to %s by heartbeat monitor", tr.id, tr.from, tr.to)
+		statusTransitions.WithLabelValues("device", tr.from, tr.to).Inc()
+		t.paths.Purge()
+		t.events.PublishStatus(StatusEvent{Event: eventDeviceStatus, ID: tr.id, From: tr.from, To: tr.to, Reason: heartbeatReason(tr.to, timeout)})
+	}
+
+	// A host is down when none of its devices are sending heartbeats.
+	stale, err = t.selectTransitions("select_stale_hosts", "select h.hostid, h.status, 'down' from host h "+
+		"join device d on d.hostid=h.hostid "+
+		"where h.status='alive' and d.status<>'dead' "+
+		"group by h.hostid, h.status "+
+		"having min("+t.db.secondsSince("d.updated_at")+") >= ?", timeout)
+	if err != nil {
+		return err
+	}
+	recovered, err = t.selectTransitions("select_recovered_hosts", "select h.hostid, h.status, hh.old_status from host h "+
+		"join device d on d.hostid=h.hostid "+
+		"join host_status_history hh on hh.historyid=(select max(historyid) from host_status_history where hostid=h.hostid) "+
+		"where h.status='down' and hh.new_status='down' and hh.operator=? and d.status<>'dead' "+
+		"group by h.hostid, h.status, hh.old_status "+
+		"having min("+t.db.secondsSince("d.updated_at")+") < ?", heartbeatMonitorOperator, timeout)
+	if err != nil {
+		return err
+	}
+	for _, tr := range append(stale, recovered...) {
+		err = t.setHostStatus(ctx, tr, heartbeatReason(tr.to, timeout))
+		if err != nil {
+			t.log.Errorf("cannot change status of host %d from %s to %s: %s", tr.id, tr.from, tr.to, err.Error())
+			continue
+		}
+		t.log.Warningf("Host %d status is changed from %s to %s by heartbeat monitor", tr.id, tr.from, tr.to)
+		statusTransitions.WithLabelValues("host", tr.from, tr.to).Inc()
+		t.paths.Purge()
+		t.events.PublishStatus(StatusEvent{Event: eventHostStatus, ID: tr.id, From: tr.from, To: tr.to, Reason: heartbeatReason(tr.to, timeout)})
+	}
+	return nil
+}
+
+func heartbeatReason(status string, timeout int64) string {
+	if status == "down" {
+		return fmt.Sprintf("no heartbeat in %d seconds", timeout)
+	}
+	return "heartbeat is resumed"
+}
+
+// selectTransitions returns status changes selected by query. Duration of query is recorded as operation.
+func (t *Tracker) selectTransitions(operation, query string, args ...interface{}) ([]statusTransition, error) {
+	defer observeDB(operation, time.Now())
+	rows, err := t.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []statusTransition
+	for rows.Next() {
+		var tr statusTransition
+		err = rows.Scan(&tr.id, &tr.from, &tr.to)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, tr)
+	}
+	return ret, rows.Err()
+}
+
+// setHostStatus changes host status if it has not been changed by someone else in the meantime.
+func (t *Tracker) setHostStatus(ctx context.Context, tr statusTransition, reason string) error {
+	defer observeDB("set_host_status", time.Now())
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	var current string
+	err = tx.QueryRow("select status from host where hostid=?"+tx.forUpdate(), tr.id).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current != tr.from {
+		return fmt.Errorf("host status is changed to %s meanwhile", current)
+	}
+	_, err = tx.Exec("update host set status=? where hostid=?", tr.to, tr.id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into host_status_history(hostid, old_status, new_status, operator, reason) values(?, ?, ?, ?, ?)",
+		tr.id, tr.from, tr.to, heartbeatMonitorOperator, reason)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHeartbeatMonitor(t *testing.T) {
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	insertHost(t, tr)
+	_, err = tr.db.Exec("insert into device(devid, status, hostid, updated_at) values(2, 'drain', 1, " + tr.db.fromUnixtime("1510216046") + ")")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStatus := func(devStatus, hostStatus string) {
+		t.Helper()
+		var status string
+		err = tr.db.QueryRow("select status from device where devid=2").Scan(&status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != devStatus {
+			t.Fatalf("device status: %s, expected: %s", status, devStatus)
+		}
+		err = tr.db.QueryRow("select status from host where hostid=1").Scan(&status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != hostStatus {
+			t.Fatalf("host status: %s, expected: %s", status, hostStatus)
+		}
+	}
+
+	err = tr.checkHeartbeats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStatus("down", "down")
+
+	_, err = tr.db.Exec("update device set updated_at=current_timestamp where devid=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.checkHeartbeats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStatus("drain", "alive")
+}
@@ -1,21 +1,143 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// Number of files selected from database at once while streaming iter-files response.
+const iterFilesBatchSize = 1000
+
+// iterFilesErrorTrailer is set if streaming is interrupted by an error after the response has started.
+const iterFilesErrorTrailer = "Efes-Error"
+
+// iterFilesFilter limits the files returned by iter-files.
+type iterFilesFilter struct {
+	devid         int64
+	createdAfter  time.Time
+	createdBefore time.Time
+	prefix        string
+}
+
+func parseIterFilesFilter(r *http.Request) (f iterFilesFilter, err error) {
+	if s := r.FormValue("devid"); s != "" {
+		f.devid, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return f, errors.New("invalid param: devid")
+		}
+	}
+	if s := r.FormValue("created_after"); s != "" {
+		f.createdAfter, err = parseTimeParam(s)
+		if err != nil {
+			return f, errors.New("invalid param: created_after")
+		}
+	}
+	if s := r.FormValue("created_before"); s != "" {
+		f.createdBefore, err = parseTimeParam(s)
+		if err != nil {
+			return f, errors.New("invalid param: created_before")
+		}
+	}
+	f.prefix = r.FormValue("prefix")
+	return f, nil
+}
+
+// parseTimeParam accepts a time in RFC3339 format or a date in YYYY-MM-DD format.
+func parseTimeParam(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// where returns SQL conditions for the filter. Table "file" must be aliased as "f".
+func (f iterFilesFilter) where() (sql string, args []interface{}) {
+	if f.devid != 0 {
+		sql += "and exists(select 1 from file_on where fid=f.fid and devid=?) "
+		args = append(args, f.devid)
+	}
+	if !f.createdAfter.IsZero() {
+		sql += "and f.created_at >= ? "
+		args = append(args, f.createdAfter)
+	}
+	if !f.createdBefore.IsZero() {
+		sql += "and f.created_at < ? "
+		args = append(args, f.createdBefore)
+	}
+	if f.prefix != "" {
+		sql += "and f.dkey like ? escape '!' "
+		args = append(args, escapeLike(f.prefix)+"%")
+	}
+	return
+}
+
+// Default escape character of LIKE differs between databases, so it is given explicitly.
+var likeEscaper = strings.NewReplacer(`!`, `!!`, `%`, `!%`, `_`, `!_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// selectFiles returns at most limit files with fid greater than from, ordered by fid.
+func (t *Tracker) selectFiles(ctx context.Context, from int64, limit int, filter iterFilesFilter) ([]IterFile, error) {
+	where, args := filter.where()
+	args = append([]interface{}{from}, args...)
+	args = append(args, limit)
+	rows, err := t.db.QueryContext(ctx, "select f.fid, f.dkey, f.size, f.created_at, "+t.db.groupConcat("fo.devid")+" "+ // nolint: gosec
+		"from file f "+
+		"left join file_on fo on fo.fid=f.fid "+
+		"where f.fid > ? "+
+		where+
+		"group by f.fid "+
+		"order by f.fid "+
+		"limit ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := make([]IterFile, 0)
+	for rows.Next() {
+		var f IterFile
+		var size sql.NullInt64
+		var createdAt sql.NullTime
+		var devids sql.NullString
+		err = rows.Scan(&f.ID, &f.Key, &size, &createdAt, &devids)
+		if err != nil {
+			return nil, err
+		}
+		if size.Valid {
+			f.Size = &size.Int64
+		}
+		f.CreatedAt = createdAt.Time.Format(time.RFC3339)
+		f.Devids = parseDevids(devids.String)
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// iterFiles returns files ordered by fid.
+// If format is "ndjson", files are streamed one JSON object per line,
+// otherwise at most count files are returned in a single JSON document.
 func (t *Tracker) iterFiles(w http.ResponseWriter, r *http.Request) {
 	var err error
-	from := uint64(0)
-	count := uint64(1000)
+	var from int64
+	var count int64
 
 	fromStr := r.FormValue("from")
 	if fromStr != "" {
-		from, err = strconv.ParseUint(fromStr, 10, 64)
+		from, err = strconv.ParseInt(fromStr, 10, 64)
 		if err != nil {
 			http.Error(w, "invalid param: from", http.StatusBadRequest)
 			return
@@ -23,47 +145,182 @@ func (t *Tracker) iterFiles(w http.ResponseWriter, r *http.Request) {
 	}
 	countStr := r.FormValue("count")
 	if countStr != "" {
-		count, err = strconv.ParseUint(countStr, 10, 64)
-		if err != nil {
+		count, err = strconv.ParseInt(countStr, 10, 64)
+		if err != nil || count < 0 {
 			http.Error(w, "invalid param: count", http.StatusBadRequest)
 			return
 		}
 	}
-
-	type file struct {
-		ID        int64  `json:"id"`
-		Key       string `json:"key"`
-		CreatedAt string `json:"created_at"`
-	}
-	files := make([]file, 0)
-	rows, err := t.db.Query("select fid, dkey, created_at from file where fid > ? order by fid limit ?", from, count)
+	filter, err := parseIterFilesFilter(r)
 	if err != nil {
-		t.internalServerError("cannot get keys from database", err, r, w)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var f file
-		var createdAt sql.NullTime
-		err = rows.Scan(&f.ID, &f.Key, &createdAt)
+
+	switch r.FormValue("format") {
+	case "", "json":
+		if countStr == "" {
+			count = 1000
+		}
+		files, err := t.selectFiles(r.Context(), from, int(count), filter)
 		if err != nil {
-			t.internalServerError("cannot scan row", err, r, w)
+			t.internalServerError("cannot get keys from database", err, r, w)
 			return
 		}
-		f.CreatedAt = createdAt.Time.Format(time.RFC3339)
-		files = append(files, f)
+		response := struct {
+			Files []IterFile `json:"files"`
+		}{
+			Files: files,
+		}
+		w.Header().Set("content-type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.Encode(response) // nolint: errcheck
+	case "ndjson":
+		t.streamFiles(w, r, from, count, filter)
+	default:
+		http.Error(w, "invalid param: format", http.StatusBadRequest)
+	}
+}
+
+// streamFiles writes files in batches until all matching files are sent or count is reached.
+// Zero count means no limit.
+func (t *Tracker) streamFiles(w http.ResponseWriter, r *http.Request, from, count int64, filter iterFilesFilter) {
+	rc := http.NewResponseController(w)
+	encoder := json.NewEncoder(w)
+	var sent int64
+	for {
+		limit := int64(iterFilesBatchSize)
+		if count > 0 && count-sent < limit {
+			limit = count - sent
+		}
+		files, err := t.selectFiles(r.Context(), from, int(limit), filter)
+		if err != nil {
+			if sent == 0 {
+				t.internalServerError("cannot get keys from database", err, r, w)
+				return
+			}
+			// Status is already sent. Report the error in trailer.
+			t.log.Errorln("cannot get keys from database:", err.Error())
+			w.Header().Set(iterFilesErrorTrailer, "cannot get keys from database: "+err.Error())
+			return
+		}
+		if sent == 0 {
+			w.Header().Set("content-type", "application/x-ndjson")
+			w.Header().Set("trailer", iterFilesErrorTrailer)
+		}
+		// Server has a global write timeout that is shorter than streaming duration.
+		err = rc.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		if err != nil {
+			t.log.Warningln("cannot extend write deadline:", err.Error())
+		}
+		for _, f := range files {
+			err = encoder.Encode(f)
+			if err != nil {
+				return
+			}
+		}
+		sent += int64(len(files))
+		if len(files) < int(limit) || (count > 0 && sent >= count) {
+			return
+		}
+		err = rc.Flush()
+		if err != nil {
+			return
+		}
+		from = files[len(files)-1].ID
+	}
+}
+
+// InventoryFilter limits the files written by Inventory.
+type InventoryFilter struct {
+	Devid         int64
+	CreatedAfter  string
+	CreatedBefore string
+	Prefix        string
+}
+
+// Inventory writes all files matching the filter to w in "csv" or "ndjson" format.
+func (c *Client) Inventory(w io.Writer, format string, filter InventoryFilter) error {
+	if format != "csv" && format != "ndjson" {
+		return fmt.Errorf("invalid format: %s", format)
+	}
+	params := url.Values{}
+	params.Set("format", "ndjson")
+	if filter.Devid != 0 {
+		params.Set("devid", strconv.FormatInt(filter.Devid, 10))
+	}
+	if filter.CreatedAfter != "" {
+		params.Set("created_after", filter.CreatedAfter)
 	}
-	err = rows.Err()
+	if filter.CreatedBefore != "" {
+		params.Set("created_before", filter.CreatedBefore)
+	}
+	if filter.Prefix != "" {
+		params.Set("prefix", filter.Prefix)
+	}
+	u := *c.trackerURL
+	u.Path = path.Join(c.trackerURL.Path, "iter-files")
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil) // nolint: noctx
 	if err != nil {
-		t.internalServerError("cannot close rows", err, r, w)
-		return
+		return err
 	}
-	response := struct {
-		Files []file `json:"files"`
-	}{
-		Files: files,
+	c.setAuthorization(req)
+	// Response is streamed for a long time; do not apply the timeout of client.
+	httpClient := c.httpClient
+	httpClient.Timeout = 0
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
 	}
-	w.Header().Set("content-type", "application/json")
-	encoder := json.NewEncoder(w)
-	encoder.Encode(response) // nolint: errcheck
+	defer resp.Body.Close()
+	err = checkResponseError(resp)
+	if err != nil {
+		return err
+	}
+	if format == "ndjson" {
+		_, err = io.Copy(w, resp.Body)
+		if err != nil {
+			return err
+		}
+		return iterFilesError(resp)
+	}
+	cw := csv.NewWriter(w)
+	err = cw.Write([]string{"id", "key", "size", "created_at", "devids"})
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var f IterFile
+		err = decoder.Decode(&f)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var size string
+		if f.Size != nil {
+			size = strconv.FormatInt(*f.Size, 10)
+		}
+		err = cw.Write([]string{strconv.FormatInt(f.ID, 10), f.Key, size, f.CreatedAt, formatDevids(f.Devids)})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	err = cw.Error()
+	if err != nil {
+		return err
+	}
+	return iterFilesError(resp)
+}
+
+// iterFilesError returns the error sent in trailer. Body must be read until EOF before calling it.
+func iterFilesError(resp *http.Response) error {
+	if msg := resp.Trailer.Get(iterFilesErrorTrailer); msg != "" {
+		return errors.New(msg)
+	}
+	return nil
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIterFilesNDJSON(t *testing.T) {
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	insertHost(t, tr)
+	_, err = tr.db.Exec("insert into device(devid, hostid) values(2, 1), (3, 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.db.Exec("insert into file(fid, dkey, size, created_at) values" +
+		"(1, 'a/1', 10, '2020-01-01 00:00:00'), " +
+		"(2, 'a/2', null, '2020-02-01 00:00:00'), " +
+		"(3, 'a_3', 30, '2020-03-01 00:00:00'), " +
+		"(4, 'b/4', 40, '2020-04-01 00:00:00')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.db.Exec("insert into file_on(fid, devid) values(1, 2), (1, 3), (2, 3), (3, 2), (4, 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iter := func(query string) []IterFile {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/iter-files?format=ndjson&"+query, nil)
+		rr := httptest.NewRecorder()
+		tr.iterFiles(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: %d, body: %s", rr.Code, rr.Body.String())
+		}
+		var files []IterFile
+		scanner := bufio.NewScanner(rr.Body)
+		for scanner.Scan() {
+			var f IterFile
+			err = json.Unmarshal(scanner.Bytes(), &f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, f)
+		}
+		return files
+	}
+
+	files := iter("")
+	if len(files) != 4 {
+		t.Fatalf("unexpected number of files: %d", len(files))
+	}
+	if *files[0].Size != 10 || len(files[0].Devids) != 2 || files[1].Size != nil {
+		t.Fatalf("unexpected files: %+v", files)
+	}
+	// Underscore in prefix must not match any character.
+	files = iter("prefix=a_")
+	if len(files) != 1 || files[0].ID != 3 {
+		t.Fatalf("unexpected files for prefix: %+v", files)
+	}
+	files = iter("devid=3")
+	if len(files) != 2 || files[0].ID != 1 || files[1].ID != 2 {
+		t.Fatalf("unexpected files for devid: %+v", files)
+	}
+	files = iter("created_after=2020-02-01&created_before=2020-04-01")
+	if len(files) != 2 || files[0].ID != 2 || files[1].ID != 3 {
+		t.Fatalf("unexpected files for date range: %+v", files)
+	}
+	files = iter("from=1&count=2")
+	if len(files) != 2 || files[0].ID != 2 {
+		t.Fatalf("unexpected files for from and count: %+v", files)
+	}
+}
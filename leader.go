@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/getsentry/sentry-go"
+)
+
+const trackerLeaseName = "tracker"
+
+// leaderLease elects a single tracker to run singleton background jobs.
+// Trackers compete for a row in leader_lease table. The holder renews it periodically
+// and others take it over after it expires. Database time is used for expiration
+// so clocks of tracker hosts do not need to be in sync.
+type leaderLease struct {
+	db     *store
+	log    log.Logger
+	name   string
+	holder string
+	ttl    time.Duration
+
+	m        sync.RWMutex
+	leader   string
+	isLeader bool
+	// renewedAt is the time the last successful renewal started.
+	// The lease is valid in database at most ttl after it.
+	renewedAt time.Time
+}
+
+func newLeaderLease(db *store, logger log.Logger, name, holder string, ttl time.Duration) *leaderLease {
+	return &leaderLease{
+		db:     db,
+		log:    logger,
+		name:   name,
+		holder: holder,
+		ttl:    ttl,
+	}
+}
+
+// IsLeader returns true if the lease is held by this process.
+// It returns false once ttl passes since the last successful renewal, even if renewal has not failed yet.
+// Singleton jobs must check it before each run.
+func (l *leaderLease) IsLeader() bool {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	return l.isLeader && time.Since(l.renewedAt) < l.ttl
+}
+
+// Leader returns the holder of the lease seen in last renewal.
+func (l *leaderLease) Leader() string {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	return l.leader
+}
+
+func (l *leaderLease) setLeader(leader string, renewedAt time.Time) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	isLeader := leader == l.holder
+	if isLeader {
+		l.renewedAt = renewedAt
+	}
+	if isLeader && !l.isLeader {
+		l.log.Noticef("Became leader for %q lease", l.name)
+	} else if !isLeader && l.isLeader {
+		l.log.Warningf("Lost leadership for %q lease; new leader: %q", l.name, leader)
+	}
+	l.leader = leader
+	l.isLeader = isLeader
+}
+
+// acquire takes the lease if it is free or expired, or extends it if it is already held by this process.
+func (l *leaderLease) acquire(ctx context.Context) error {
+	start := time.Now()
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	ttl := l.ttl / time.Second
+	var holder string
+	var valid bool
+	err = tx.QueryRowContext(ctx, "select holder, expires_at > current_timestamp from leader_lease where name=?"+tx.forUpdate(), l.name).Scan(&holder, &valid)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.ExecContext(ctx, "insert into leader_lease(name, holder, expires_at) values(?, ?, "+tx.addSeconds("current_timestamp", "?")+")", l.name, l.holder, ttl)
+		holder = l.holder
+	case err != nil:
+		return err
+	case holder == l.holder || !valid:
+		_, err = tx.ExecContext(ctx, "update leader_lease set holder=?, expires_at="+tx.addSeconds("current_timestamp", "?")+" where name=?", l.holder, ttl, l.name)
+		holder = l.holder
+	}
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	l.setLeader(holder, start)
+	return nil
+}
+
+// release gives up the lease so that another tracker can take it over without waiting for expiration.
+func (l *leaderLease) release() error {
+	_, err := l.db.Exec("delete from leader_lease where name=? and holder=?", l.name, l.holder)
+	l.setLeader("", time.Time{})
+	return err
+}
+
+func (t *Tracker) leaderElection() {
+	t.log.Notice("Starting leader election...")
+	ticker := time.NewTicker(t.leader.ttl / 3)
+	defer ticker.Stop()
+	for {
+		t.workers.beat("leader-election")
+		// Renewal must finish before the lease expires, otherwise another tracker may take it over meanwhile.
+		ctx, cancel := context.WithTimeout(context.Background(), t.leader.ttl/3)
+		err := t.leader.acquire(ctx)
+		cancel()
+		if err != nil {
+			// Step down because the lease may expire before it can be renewed.
+			t.log.Errorln("cannot acquire leader lease:", err.Error())
+			sentry.CaptureException(err)
+			t.leader.setLeader("", time.Time{})
+		}
+		select {
+		case <-ticker.C:
+		case <-t.shutdown:
+			err = t.leader.release()
+			if err != nil {
+				t.log.Errorln("cannot release leader lease:", err.Error())
+			}
+			close(t.leaderElectionStopped)
+			return
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLeaderLease(t *testing.T) {
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	ctx := context.Background()
+	a := newLeaderLease(tr.db, tr.log, "test", "a", time.Minute)
+	b := newLeaderLease(tr.db, tr.log, "test", "b", time.Minute)
+
+	err = a.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatal("a must be the leader")
+	}
+	if b.Leader() != "a" {
+		t.Fatalf("unexpected leader: %q", b.Leader())
+	}
+
+	// Renewal keeps the lease.
+	err = a.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.IsLeader() {
+		t.Fatal("a must still be the leader")
+	}
+
+	// Expired lease is taken over.
+	_, err = tr.db.Exec("update leader_lease set expires_at=" + tr.db.addSeconds("current_timestamp", "-1") + " where name='test'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.IsLeader() {
+		t.Fatal("b must be the leader after lease expired")
+	}
+
+	// Released lease is taken over immediately.
+	err = b.release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.IsLeader() {
+		t.Fatal("a must be the leader after b released the lease")
+	}
+
+	// Leadership is not assumed after ttl passes without a successful renewal.
+	a.m.Lock()
+	a.renewedAt = time.Now().Add(-time.Minute)
+	a.m.Unlock()
+	if a.IsLeader() {
+		t.Fatal("a must not be the leader when the lease is not renewed in ttl")
+	}
+	if a.Leader() != "a" {
+		t.Fatalf("unexpected leader: %q", a.Leader())
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"os"
 
 	"github.com/cenkalti/log"
@@ -14,14 +13,14 @@ func logCloseFile(log log.Logger, f *os.File) {
 	}
 }
 
-func logRollbackTx(log log.Logger, tx *sql.Tx) {
+func logRollbackTx(log log.Logger, tx *storeTx) {
 	err := tx.Rollback()
 	if err != nil {
 		log.Errorf("Error while closing transaction: %s", err.Error())
 	}
 }
 
-func logCloseDB(log log.Logger, db *sql.DB) {
+func logCloseDB(log log.Logger, db *store) {
 	err := db.Close()
 	if err != nil {
 		log.Errorf("Error while closing DB connection: %s", err.Error())
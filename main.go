@@ -2,6 +2,8 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
@@ -212,9 +214,13 @@ func main() {
 					Name:  "dest, d",
 					Usage: "move files to given devices",
 				},
+				cli.Int64Flag{
+					Name:  "devid",
+					Usage: "drain this device in server datadirs, required if there are multiple datadirs",
+				},
 			},
 			Action: func(c *cli.Context) error {
-				d, err := NewDrainer(cfg)
+				d, err := NewDrainer(cfg, c.Int64("devid"))
 				if err != nil {
 					return err
 				}
@@ -232,6 +238,279 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "inventory",
+			Usage: "write the list of files to a file in CSV or NDJSON format",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "output file, default is stdout",
+				},
+				cli.StringFlag{
+					Name:  "format, f",
+					Usage: "csv or ndjson",
+					Value: "csv",
+				},
+				cli.Int64Flag{
+					Name:  "devid",
+					Usage: "only files on device",
+				},
+				cli.StringFlag{
+					Name:  "created-after",
+					Usage: "only files created at or after time (RFC3339 or YYYY-MM-DD)",
+				},
+				cli.StringFlag{
+					Name:  "created-before",
+					Usage: "only files created before time (RFC3339 or YYYY-MM-DD)",
+				},
+				cli.StringFlag{
+					Name:  "prefix",
+					Usage: "only keys starting with prefix",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				client, err := NewClient(cfg)
+				if err != nil {
+					return err
+				}
+				filter := InventoryFilter{
+					Devid:         c.Int64("devid"),
+					CreatedAfter:  c.String("created-after"),
+					CreatedBefore: c.String("created-before"),
+					Prefix:        c.String("prefix"),
+				}
+				output := c.String("output")
+				if output == "" || output == "-" {
+					return client.Inventory(os.Stdout, c.String("format"), filter)
+				}
+				f, err := os.Create(output)
+				if err != nil {
+					return err
+				}
+				err = client.Inventory(f, c.String("format"), filter)
+				if err != nil {
+					f.Close()         // nolint: errcheck
+					os.Remove(output) // nolint: errcheck
+					return err
+				}
+				return f.Close()
+			},
+		},
+		{
+			Name:        "admin",
+			Usage:       "manage zones, racks, subnets, hosts and devices",
+			Subcommands: adminCommands(cfg),
+		},
+		{
+			Name:  "webhook",
+			Usage: "manage webhook subscriptions",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "register a webhook and print its secret",
+					ArgsUsage: "url",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "prefix, p",
+							Usage: "only send events of keys starting with prefix",
+						},
+						cli.StringFlag{
+							Name:  "events, e",
+							Usage: "comma separated list of events (file.created, file.deleted), default is all",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 1 {
+							cli.ShowAppHelpAndExit(c, 1)
+						}
+						client, err := NewClient(cfg)
+						if err != nil {
+							return err
+						}
+						h, err := client.AddWebhook(c.Args().Get(0), c.String("prefix"), c.String("events"))
+						if err != nil {
+							return err
+						}
+						fmt.Printf("id: %d\nsecret: %s\n", h.ID, h.Secret)
+						return nil
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "list webhooks",
+					Action: func(c *cli.Context) error {
+						client, err := NewClient(cfg)
+						if err != nil {
+							return err
+						}
+						return client.PrintWebhooks()
+					},
+				},
+				{
+					Name:      "remove",
+					Usage:     "remove a webhook",
+					ArgsUsage: "id",
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 1 {
+							cli.ShowAppHelpAndExit(c, 1)
+						}
+						id, err := strconv.ParseInt(c.Args().Get(0), 10, 64)
+						if err != nil {
+							return err
+						}
+						client, err := NewClient(cfg)
+						if err != nil {
+							return err
+						}
+						return client.RemoveWebhook(id)
+					},
+				},
+				{
+					Name:  "dead",
+					Usage: "list deliveries that are given up",
+					Action: func(c *cli.Context) error {
+						client, err := NewClient(cfg)
+						if err != nil {
+							return err
+						}
+						return client.PrintWebhookDeadLetters()
+					},
+				},
+			},
+		},
+		{
+			Name:  "token",
+			Usage: "manage API tokens",
+			Subcommands: []cli.Command{
+				{
+					Name:  "create",
+					Usage: "create a new token and print it",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "name, n",
+							Usage: "name of the token",
+						},
+						cli.StringFlag{
+							Name:  "scope, s",
+							Usage: "comma separated list of scopes (read, write, delete, admin)",
+							Value: scopeRead,
+						},
+						cli.StringFlag{
+							Name:  "prefix, p",
+							Usage: "limit tracker operations of token to keys starting with prefix (not checked by storage servers)",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						return createToken(cfg.Database, c.String("name"), c.String("scope"), c.String("prefix"))
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "list tokens",
+					Action: func(c *cli.Context) error {
+						return listTokens(cfg.Database)
+					},
+				},
+				{
+					Name:      "revoke",
+					Usage:     "revoke a token",
+					ArgsUsage: "id",
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 1 {
+							cli.ShowAppHelpAndExit(c, 1)
+						}
+						id, err := strconv.ParseInt(c.Args().Get(0), 10, 64)
+						if err != nil {
+							return err
+						}
+						return revokeToken(cfg.Database, id)
+					},
+				},
+			},
+		},
+		{
+			Name:  "migrate",
+			Usage: "manage database schema",
+			Subcommands: []cli.Command{
+				{
+					Name:  "up",
+					Usage: "apply pending migrations",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "baseline",
+							Usage: "mark the first migration as applied on a database created before migrations",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						return runMigrateUp(cfg.Database, c.Bool("baseline"))
+					},
+				},
+				{
+					Name:  "status",
+					Usage: "list migrations and whether they are applied",
+					Action: func(c *cli.Context) error {
+						return migrateStatus(cfg.Database)
+					},
+				},
+			},
+		},
+		{
+			Name:  "meta",
+			Usage: "export and import metadata of zones, racks, subnets, hosts, devices and files",
+			Subcommands: []cli.Command{
+				{
+					Name:      "export",
+					Usage:     "write a compressed dump of metadata to file (stdout if not given)",
+					ArgsUsage: "[file]",
+					Action: func(c *cli.Context) error {
+						return exportMetaFile(cfg.Database, c.Args().Get(0))
+					},
+				},
+				{
+					Name:      "import",
+					Usage:     "load a dump into an empty database",
+					ArgsUsage: "file",
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 1 {
+							cli.ShowAppHelpAndExit(c, 1)
+						}
+						return importMetaFile(cfg.Database, c.Args().Get(0))
+					},
+				},
+			},
+		},
+		{
+			Name:  "tasks",
+			Usage: "manage delete tasks",
+			Subcommands: []cli.Command{
+				{
+					Name:  "dlq",
+					Usage: "inspect delete tasks that failed on all retries",
+					Subcommands: []cli.Command{
+						{
+							Name:  "list",
+							Usage: "list tasks in the dead letter queue",
+							Action: func(c *cli.Context) error {
+								return listDeadDeleteTasks(cfg)
+							},
+						},
+						{
+							Name:  "replay",
+							Usage: "send tasks in the dead letter queue back to the delete queues of their devices",
+							Flags: []cli.Flag{
+								cli.Int64Flag{
+									Name:  "devid",
+									Usage: "only replay tasks of this device",
+								},
+							},
+							Action: func(c *cli.Context) error {
+								return replayDeadDeleteTasks(cfg, c.Int64("devid"))
+							},
+						},
+					},
+				},
+			},
+		},
 		{
 			Name:   "ready",
 			Hidden: true,
@@ -275,6 +554,104 @@ func main() {
 	}
 }
 
+// adminCommands returns add, set and remove commands for each topology entity.
+func adminCommands(cfg *Config) []cli.Command {
+	commands := make([]cli.Command, 0, len(topologyEntities))
+	for _, e := range topologyEntities {
+		var flags []cli.Flag
+		for _, f := range e.fields {
+			flags = append(flags, cli.StringFlag{Name: f.param, Usage: f.usage})
+		}
+		action := func(action string) func(c *cli.Context) error {
+			return func(c *cli.Context) error {
+				if c.NArg() < 1 {
+					cli.ShowAppHelpAndExit(c, 1)
+				}
+				params := url.Values{}
+				params.Set("id", c.Args().Get(0))
+				for _, f := range e.fields {
+					if c.IsSet(f.param) {
+						params.Set(f.param, c.String(f.param))
+					}
+				}
+				client, err := NewClient(cfg)
+				if err != nil {
+					return err
+				}
+				return client.Topology(action, e.name, params)
+			}
+		}
+		subcommands := []cli.Command{
+			{
+				Name:      "add",
+				Usage:     "add a new " + e.name,
+				ArgsUsage: "id",
+				Flags:     flags,
+				Action:    action("add"),
+			},
+			{
+				Name:      "set",
+				Usage:     "update fields of " + e.name,
+				ArgsUsage: "id",
+				Flags:     flags,
+				Action:    action("set"),
+			},
+			{
+				Name:      "remove",
+				Usage:     "remove " + e.name,
+				ArgsUsage: "id",
+				Action:    action("remove"),
+			},
+		}
+		if e.name == "device" {
+			subcommands = append(subcommands, deviceStatusCommand(cfg))
+		}
+		commands = append(commands, cli.Command{
+			Name:        e.name,
+			Usage:       "manage " + e.name + "s",
+			Subcommands: subcommands,
+		})
+	}
+	return commands
+}
+
+func deviceStatusCommand(cfg *Config) cli.Command {
+	return cli.Command{
+		Name:      "status",
+		Usage:     "change device status (alive, drain, down, dead)",
+		ArgsUsage: "id status",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "reason, r",
+				Usage: "reason of the change",
+			},
+			cli.StringFlag{
+				Name:   "operator, o",
+				Usage:  "name of the operator",
+				EnvVar: "USER",
+			},
+			cli.BoolFlag{
+				Name:  "force, f",
+				Usage: "mark device as dead even if it has the only replica of some files",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.NArg() < 2 {
+				cli.ShowAppHelpAndExit(c, 1)
+			}
+			devid, err := strconv.ParseInt(c.Args().Get(0), 10, 64)
+			if err != nil {
+				return err
+			}
+			client, err := NewClient(cfg)
+			if err != nil {
+				return err
+			}
+			return client.SetDeviceStatus(devid, c.Args().Get(1), c.String("operator"), c.String("reason"), c.Bool("force"))
+		},
+	}
+}
+
 type process interface {
 	// Run does the main work for the process.
 	// Run must return nil when Shutdown is called.
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// Metadata dumps are gzip compressed streams of JSON lines.
+// The first line is a header, then each table is written as a table line followed by its rows.
+// The last line is a footer with row counts, so a truncated dump can be detected.
+const (
+	metaFormat  = "efes-meta"
+	metaVersion = 1
+)
+
+// Number of rows inserted with a single statement on import.
+const metaImportBatchSize = 500
+
+type metaColumn struct {
+	name string
+	// Time columns are dumped as unix timestamps so that dumps do not depend on time zone of database sessions.
+	time bool
+}
+
+type metaTable struct {
+	name    string
+	columns []metaColumn
+}
+
+// metaTables are dumped in this order, which is also the order of foreign keys.
+// Runtime columns of device, such as disk stats, are not dumped because servers update them.
+var metaTables = []metaTable{
+	{"zone", []metaColumn{{name: "zoneid"}, {name: "name"}}},
+	{"rack", []metaColumn{{name: "rackid"}, {name: "zoneid"}, {name: "name"}}},
+	{"subnet", []metaColumn{{name: "subnetid"}, {name: "rackid"}, {name: "subnet"}}},
+	{"host", []metaColumn{{name: "hostid"}, {name: "status"}, {name: "hostname"}, {name: "hostip"}, {name: "rackid"}}},
+	{"device", []metaColumn{{name: "devid"}, {name: "hostid"}, {name: "read_port"}, {name: "write_port"}, {name: "status"}}},
+	{"file", []metaColumn{{name: "fid"}, {name: "dkey"}, {name: "size"}, {name: "created_at", time: true}}},
+	{"file_on", []metaColumn{{name: "fid"}, {name: "devid"}}},
+}
+
+// metaConsistencyChecks are run after import. Each query returns the number of invalid rows.
+var metaConsistencyChecks = []struct {
+	description string
+	query       string
+}{
+	{"racks without zone", "select count(*) from rack r left join zone z on z.zoneid=r.zoneid where z.zoneid is null"},
+	{"subnets without rack", "select count(*) from subnet s left join rack r on r.rackid=s.rackid where r.rackid is null"},
+	{"hosts without rack", "select count(*) from host h left join rack r on r.rackid=h.rackid where r.rackid is null"},
+	{"devices without host", "select count(*) from device d left join host h on h.hostid=d.hostid where h.hostid is null"},
+	{"replicas without file", "select count(*) from file_on fo left join file f on f.fid=fo.fid where f.fid is null"},
+	{"replicas without device", "select count(*) from file_on fo left join device d on d.devid=fo.devid where d.devid is null"},
+}
+
+// metaLine is a line in metadata dump.
+type metaLine struct {
+	Type string `json:"type"`
+
+	// header
+	Format      string `json:"format,omitempty"`
+	Version     int    `json:"version,omitempty"`
+	EfesVersion string `json:"efes_version,omitempty"`
+	CreatedAt   string `json:"created_at,omitempty"`
+
+	// table
+	Table   string   `json:"table,omitempty"`
+	Columns []string `json:"columns,omitempty"`
+
+	// row
+	Values []*string `json:"values,omitempty"`
+
+	// footer
+	Counts map[string]int64 `json:"counts,omitempty"`
+}
+
+func (t metaTable) columnNames() []string {
+	names := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		names[i] = c.name
+	}
+	return names
+}
+
+// exportMeta writes a consistent snapshot of metadata tables to w.
+func exportMeta(db *store, w io.Writer) error {
+	// All tables are read from the same snapshot in a repeatable read transaction.
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	zw := gzip.NewWriter(w)
+	encoder := json.NewEncoder(zw)
+	err = encoder.Encode(metaLine{
+		Type:        "header",
+		Format:      metaFormat,
+		Version:     metaVersion,
+		EfesVersion: version,
+		CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int64)
+	for _, t := range metaTables {
+		counts[t.name], err = exportMetaTable(tx, encoder, t)
+		if err != nil {
+			return fmt.Errorf("cannot export %s table: %w", t.name, err)
+		}
+	}
+	err = encoder.Encode(metaLine{Type: "footer", Counts: counts})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func exportMetaTable(tx *storeTx, encoder *json.Encoder, t metaTable) (count int64, err error) {
+	err = encoder.Encode(metaLine{Type: "table", Table: t.name, Columns: t.columnNames()})
+	if err != nil {
+		return
+	}
+	exprs := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		exprs[i] = c.name
+		if c.time {
+			exprs[i] = tx.unixTimestamp(c.name)
+		}
+	}
+	rows, err := tx.Query("select " + strings.Join(exprs, ", ") + " from " + t.name + " order by " + t.columns[0].name) // nolint: gosec
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	values := make([]sql.NullString, len(t.columns))
+	dest := make([]interface{}, len(t.columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		err = rows.Scan(dest...)
+		if err != nil {
+			return
+		}
+		line := metaLine{Type: "row", Values: make([]*string, len(values))}
+		for i, v := range values {
+			if v.Valid {
+				s := v.String
+				line.Values[i] = &s
+			}
+		}
+		err = encoder.Encode(line)
+		if err != nil {
+			return
+		}
+		count++
+	}
+	err = rows.Err()
+	return
+}
+
+// metaImportResult is the summary of an import.
+type metaImportResult struct {
+	counts map[string]int64
+	// files without any replica are allowed but reported
+	filesWithoutReplica int64
+}
+
+// importMeta loads a dump written by exportMeta into empty metadata tables.
+// Nothing is written unless the whole dump is read and passes consistency checks.
+func importMeta(db *store, r io.Reader) (*metaImportResult, error) {
+	for _, t := range metaTables {
+		var exists bool
+		err := db.QueryRow("select exists(select 1 from " + t.name + ")").Scan(&exists) // nolint: gosec
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, fmt.Errorf("table %s is not empty", t.name)
+		}
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(zr)
+	var line metaLine
+	err = decoder.Decode(&line)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read header: %w", err)
+	}
+	if line.Type != "header" || line.Format != metaFormat {
+		return nil, errors.New("not an efes metadata dump")
+	}
+	if line.Version > metaVersion {
+		return nil, fmt.Errorf("dump version %d is newer than supported version %d", line.Version, metaVersion)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	res := &metaImportResult{counts: make(map[string]int64)}
+	var footer *metaLine
+	var table *metaTable
+	var batch [][]*string
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := insertMetaRows(tx, *table, batch)
+		batch = batch[:0]
+		return err
+	}
+	nextTable := 0
+	for footer == nil {
+		line = metaLine{}
+		err = decoder.Decode(&line)
+		if err == io.EOF {
+			return nil, errors.New("dump is truncated: footer is missing")
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch line.Type {
+		case "table":
+			err = flush()
+			if err != nil {
+				return nil, err
+			}
+			if nextTable >= len(metaTables) || line.Table != metaTables[nextTable].name {
+				return nil, fmt.Errorf("unexpected table: %s", line.Table)
+			}
+			table = &metaTables[nextTable]
+			nextTable++
+			if strings.Join(line.Columns, ",") != strings.Join(table.columnNames(), ",") {
+				return nil, fmt.Errorf("columns of %s table do not match: %v", table.name, line.Columns)
+			}
+		case "row":
+			if table == nil {
+				return nil, errors.New("row before table")
+			}
+			if len(line.Values) != len(table.columns) {
+				return nil, fmt.Errorf("invalid row in %s table: %d values", table.name, len(line.Values))
+			}
+			batch = append(batch, line.Values)
+			res.counts[table.name]++
+			if len(batch) >= metaImportBatchSize {
+				err = flush()
+				if err != nil {
+					return nil, err
+				}
+			}
+		case "footer":
+			err = flush()
+			if err != nil {
+				return nil, err
+			}
+			footer = &line
+		default:
+			return nil, fmt.Errorf("unknown line type: %s", line.Type)
+		}
+	}
+	for _, t := range metaTables {
+		if res.counts[t.name] != footer.Counts[t.name] {
+			return nil, fmt.Errorf("row count of %s table does not match: read %d, expected %d", t.name, res.counts[t.name], footer.Counts[t.name])
+		}
+	}
+	for _, c := range metaConsistencyChecks {
+		var count int64
+		err = tx.QueryRow(c.query).Scan(&count)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, fmt.Errorf("consistency check failed: %d %s", count, c.description)
+		}
+	}
+	err = tx.QueryRow("select count(*) from file f where not exists(select 1 from file_on where fid=f.fid)").Scan(&res.filesWithoutReplica)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	// Fids of new files are generated by tempfile table. They must not collide with imported files.
+	// This is done after commit because changing AUTO_INCREMENT commits the transaction on MySQL.
+	var maxFid sql.NullInt64
+	err = db.QueryRow("select max(fid) from file").Scan(&maxFid)
+	if err != nil {
+		return nil, fmt.Errorf("files are imported but fid sequence is not advanced: %w", err)
+	}
+	for _, stmt := range db.advanceSequence("tempfile", "fid", maxFid.Int64+1) {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			return nil, fmt.Errorf("files are imported but fid sequence is not advanced: %w", err)
+		}
+	}
+	return res, nil
+}
+
+func insertMetaRows(tx *storeTx, t metaTable, rows [][]*string) error {
+	placeholders := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		placeholders[i] = "?"
+		if c.time {
+			placeholders[i] = tx.fromUnixtime("?")
+		}
+	}
+	rowSQL := "(" + strings.Join(placeholders, ",") + ")"
+	rowsSQL := make([]string, len(rows))
+	args := make([]interface{}, 0, len(rows)*len(t.columns))
+	for i, row := range rows {
+		rowsSQL[i] = rowSQL
+		for _, v := range row {
+			if v == nil {
+				args = append(args, nil)
+			} else {
+				args = append(args, *v)
+			}
+		}
+	}
+	_, err := tx.Exec("insert into "+t.name+"("+strings.Join(t.columnNames(), ",")+") values "+strings.Join(rowsSQL, ","), args...) // nolint: gosec
+	if err != nil {
+		return fmt.Errorf("cannot insert into %s table: %w", t.name, err)
+	}
+	return nil
+}
+
+func exportMetaFile(cfg DatabaseConfig, output string) error {
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer logCloseDB(log.DefaultLogger, db)
+	if output == "" || output == "-" {
+		return exportMeta(db, os.Stdout)
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	err = exportMeta(db, f)
+	if err != nil {
+		f.Close()         // nolint: errcheck
+		os.Remove(output) // nolint: errcheck
+		return err
+	}
+	return f.Close()
+}
+
+func importMetaFile(cfg DatabaseConfig, input string) error {
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer logCloseDB(log.DefaultLogger, db)
+	f, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	res, err := importMeta(db, f)
+	if err != nil {
+		return err
+	}
+	for _, t := range metaTables {
+		fmt.Printf("%s: %d rows\n", t.name, res.counts[t.name])
+	}
+	if res.filesWithoutReplica > 0 {
+		fmt.Printf("warning: %d files have no replica\n", res.filesWithoutReplica)
+	}
+	return nil
+}
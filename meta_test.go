@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetaExportImport(t *testing.T) {
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	insertHost(t, tr)
+	_, err = tr.db.Exec("insert into device(devid, status, hostid) values(2, 'alive', 1), (3, 'drain', 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.db.Exec("insert into file(fid, dkey, size, created_at) values(42, 'foo', 3, " + tr.db.fromUnixtime("1510216046") + "), (43, 'bar', null, " + tr.db.fromUnixtime("1510216047") + ")")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.db.Exec("insert into file_on(fid, devid) values(42, 2), (42, 3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = exportMeta(tr.db, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.Bytes()
+
+	_, err = importMeta(tr.db, bytes.NewReader(dump))
+	if err == nil {
+		t.Fatal("import into non-empty database must fail")
+	}
+
+	cleanDB(t, tr.db)
+	// Fresh database starts generating fids from 1.
+	setTempfileAutoIncrement(t, tr.db, 1)
+	res, err := importMeta(tr.db, bytes.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.counts["device"] != 2 || res.counts["file"] != 2 || res.counts["file_on"] != 2 {
+		t.Fatalf("unexpected counts: %v", res.counts)
+	}
+	if res.filesWithoutReplica != 1 {
+		t.Fatalf("unexpected files without replica: %d", res.filesWithoutReplica)
+	}
+	var createdAt int64
+	err = tr.db.QueryRow("select " + tr.db.unixTimestamp("created_at") + " from file where fid=42").Scan(&createdAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if createdAt != 1510216046 {
+		t.Fatalf("unexpected created_at: %d", createdAt)
+	}
+	var status string
+	err = tr.db.QueryRow("select status from device where devid=3").Scan(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "drain" {
+		t.Fatalf("unexpected status: %s", status)
+	}
+
+	// New files get fids after imported ones.
+	_, err = tr.db.Exec("update device set bytes_total=1000, bytes_used=0, bytes_free=1000, write_port=1234 where devid=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/create-open", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	tr.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var created struct {
+		Fid int64 `json:"fid"`
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Fid <= 43 {
+		t.Fatalf("fid of new file collides with imported files: %d", created.Fid)
+	}
+}
+
+func TestMetaImportTruncated(t *testing.T) {
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	insertHost(t, tr)
+
+	var buf bytes.Buffer
+	err = exportMeta(tr.db, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Drop the footer and compress again so that only the missing footer is detected.
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plain bytes.Buffer
+	_, err = plain.ReadFrom(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(plain.Bytes(), []byte("\n"))
+	var truncated bytes.Buffer
+	zw := gzip.NewWriter(&truncated)
+	for _, line := range lines[:len(lines)-2] {
+		zw.Write(line) // nolint: errcheck
+	}
+	zw.Close() // nolint: errcheck
+
+	cleanDB(t, tr.db)
+	_, err = importMeta(tr.db, &truncated)
+	if err == nil {
+		t.Fatal("truncated dump must be rejected")
+	}
+	var count int
+	err = tr.db.QueryRow("select count(*) from host").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatal("nothing must be imported from truncated dump")
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metadataStore holds the metadata of files and devices.
+// Tracker, server, drainer and cleaners read and change files, tempfiles and devices only through it.
+// Methods that take a transaction are applied as part of it. Rows they read are locked until the end of transaction.
+//
+// Each database driver has its own implementation.
+// Queries that are the same for all drivers are shared in sqlMetadataStore.
+type metadataStore interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*storeTx, error)
+
+	// selectReplicas returns replicas of key on alive hosts and readable devices.
+	selectReplicas(ctx context.Context, key string) ([]replica, error)
+	// lockFidOfKey returns the fid of key. It returns sql.ErrNoRows if there is no such file.
+	lockFidOfKey(tx *storeTx, key string) (int64, error)
+	// lockKeyOfFid returns the key of fid. It returns sql.ErrNoRows if there is no such file.
+	lockKeyOfFid(tx *storeTx, fid int64) (string, error)
+	// getDevicesOfFid returns the devices that have a replica of fid.
+	getDevicesOfFid(tx *storeTx, fid int64) ([]int64, error)
+	// replaceFile records fid as the file of key with its replica on devid.
+	// Existing file with the same key is replaced.
+	replaceFile(tx *storeTx, fid int64, key string, size sql.NullInt64, devid int64) error
+	// deleteFile removes fid and its replicas. Devices that had a replica are returned.
+	deleteFile(tx *storeTx, fid int64) ([]int64, error)
+	// deleteReplicas removes replicas of fid on devids.
+	deleteReplicas(tx *storeTx, fid int64, devids []int64) error
+	// moveReplica changes the device of replica of fid.
+	moveReplica(tx *storeTx, fid, from, to int64) error
+	// getFidsOnDevice returns fids that have a replica on devid.
+	getFidsOnDevice(devid int64) ([]int64, error)
+	// fidExistsOnDevice reports whether fid has a replica or an open tempfile on devid.
+	fidExistsOnDevice(devid, fid int64) (bool, error)
+
+	// reserveTempfile inserts a tempfile of size bytes if devid still has room for it.
+	reserveTempfile(ctx context.Context, devid, size int64) (fid int64, ok bool, err error)
+	// closeTempfile removes the tempfile and returns its device. It returns sql.ErrNoRows if there is no such tempfile.
+	closeTempfile(tx *storeTx, fid int64) (int64, error)
+	// tempfileExists reports whether fid is an open tempfile.
+	tempfileExists(fid int64) (bool, error)
+	// expireTempfiles removes tempfiles created before age and returns them.
+	expireTempfiles(tx *storeTx, age time.Duration) ([]Tempfile, error)
+
+	// findAliveDevices returns writable devices that have room for size bytes, most free first.
+	// If devids is not empty, only those devices are returned and draining devices are included.
+	findAliveDevices(size int64, devids []int64) ([]aliveDevice, error)
+	getSubnets() ([]subnet, error)
+	// getReadAddress returns the address of read server of devid.
+	getReadAddress(tx *storeTx, devid int64) (hostname string, port int64, err error)
+	getDevices(ctx context.Context) ([]Device, error)
+	getHosts(ctx context.Context) ([]Host, error)
+	getRacks(ctx context.Context) ([]Rack, error)
+	getZones(ctx context.Context) ([]Zone, error)
+	updateDiskStats(devid int64, utilization, total, used, free sql.NullInt64) error
+	// startDiskClean marks the start of disk clean of devid if the last one is older than period.
+	// It returns false if it is not time to clean yet.
+	startDiskClean(devid int64, period time.Duration) (bool, error)
+	finishDiskClean(devid int64) error
+	// startDeviceClean is like startDiskClean for the clean of file records of devid.
+	startDeviceClean(devid int64, period time.Duration) (bool, error)
+	finishDeviceClean(devid int64) error
+}
+
+func newMetadataStore(db *store) metadataStore {
+	base := sqlMetadataStore{db}
+	switch db.driverName() {
+	case "sqlite":
+		return sqliteMetadataStore{base}
+	case "postgres":
+		return postgresMetadataStore{base}
+	default:
+		return mysqlMetadataStore{base}
+	}
+}
+
+// sqlMetadataStore implements the methods of metadataStore that have the same query for all drivers.
+// Parts of queries that differ between drivers are built by dialect of store.
+type sqlMetadataStore struct {
+	*store
+}
+
+func (s sqlMetadataStore) selectReplicas(ctx context.Context, key string) ([]replica, error) {
+	rows, err := s.QueryContext(ctx, "select h.hostname, h.hostip, h.rackid, r.zoneid, d.read_port, d.devid, f.fid, f.created_at, d.io_utilization "+
+		"from file f "+
+		"join file_on fo on f.fid=fo.fid "+
+		"join device d on d.devid=fo.devid "+
+		"join host h on h.hostid=d.hostid "+
+		"join rack r on r.rackid=h.rackid "+
+		"where h.status='alive' "+
+		"and d.status in ('alive', 'drain') "+
+		"and f.dkey=?", key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var replicas []replica
+	for rows.Next() {
+		var rp replica
+		err = rows.Scan(&rp.hostname, &rp.hostip, &rp.rackid, &rp.zoneid, &rp.httpPort, &rp.devid, &rp.fid, &rp.createdAt, &rp.ioUtilization)
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, rp)
+	}
+	return replicas, rows.Err()
+}
+
+func (s sqlMetadataStore) lockFidOfKey(tx *storeTx, key string) (int64, error) {
+	var fid int64
+	err := tx.QueryRow("select fid from file where dkey=?"+tx.forUpdate(), key).Scan(&fid)
+	return fid, err
+}
+
+func (s sqlMetadataStore) lockKeyOfFid(tx *storeTx, fid int64) (string, error) {
+	var key string
+	err := tx.QueryRow("select dkey from file where fid=?"+tx.forUpdate(), fid).Scan(&key)
+	return key, err
+}
+
+func (s sqlMetadataStore) getDevicesOfFid(tx *storeTx, fid int64) ([]int64, error) {
+	return queryInt64s(tx.Query("select devid from file_on where fid=?"+tx.forUpdate(), fid))
+}
+
+func (s sqlMetadataStore) deleteFile(tx *storeTx, fid int64) ([]int64, error) {
+	devids, err := s.getDevicesOfFid(tx, fid)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("delete from file_on where fid=?", fid)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("delete from file where fid=?", fid)
+	if err != nil {
+		return nil, err
+	}
+	return devids, nil
+}
+
+func (s sqlMetadataStore) deleteReplicas(tx *storeTx, fid int64, devids []int64) error {
+	_, err := tx.Exec("delete from file_on where fid=? and devid in ("+formatDevids(devids)+")", fid) // nolint: gosec
+	return err
+}
+
+func (s sqlMetadataStore) moveReplica(tx *storeTx, fid, from, to int64) error {
+	_, err := tx.Exec("update file_on set devid=? where devid=? and fid=?", to, from, fid)
+	return err
+}
+
+func (s sqlMetadataStore) getFidsOnDevice(devid int64) ([]int64, error) {
+	return queryInt64s(s.Query("select fid from file_on where devid=?", devid))
+}
+
+func (s sqlMetadataStore) fidExistsOnDevice(devid, fid int64) (bool, error) {
+	var exists bool
+	err := s.QueryRow("select exists(select 1 from file_on where fid=? and devid=?) "+
+		"or exists(select 1 from tempfile where fid=? and devid=?)", fid, devid, fid, devid).Scan(&exists)
+	return exists, err
+}
+
+// reserveTempfile locks the device row while free space is checked, so concurrent uploads cannot reserve the same bytes.
+func (s sqlMetadataStore) reserveTempfile(ctx context.Context, devid, size int64) (fid int64, ok bool, err error) {
+	tx, err := s.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	var free sql.NullInt64
+	err = tx.QueryRow("select bytes_free from device where devid=?"+tx.forUpdate(), devid).Scan(&free)
+	if err != nil {
+		return 0, false, err
+	}
+	var reserved int64
+	err = tx.QueryRow("select coalesce(sum(size), 0) from tempfile where devid=?", devid).Scan(&reserved)
+	if err != nil {
+		return 0, false, err
+	}
+	if free.Int64-reserved < size {
+		return 0, false, nil
+	}
+	fid, err = tx.Insert("insert into tempfile(devid, size) values(?, ?)", "fid", devid, size)
+	if err != nil {
+		return 0, false, err
+	}
+	return fid, true, tx.Commit()
+}
+
+func (s sqlMetadataStore) closeTempfile(tx *storeTx, fid int64) (int64, error) {
+	var devid int64
+	err := tx.QueryRow("select devid from tempfile where fid=?"+tx.forUpdate(), fid).Scan(&devid)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("delete from tempfile where fid=?", fid)
+	return devid, err
+}
+
+func (s sqlMetadataStore) tempfileExists(fid int64) (bool, error) {
+	var exists bool
+	err := s.QueryRow("select exists(select 1 from tempfile where fid=?)", fid).Scan(&exists)
+	return exists, err
+}
+
+func (s sqlMetadataStore) expireTempfiles(tx *storeTx, age time.Duration) ([]Tempfile, error) {
+	rows, err := tx.Query("select fid, devid from tempfile where created_at < "+tx.addSeconds("current_timestamp", "?")+tx.forUpdate(), -int64(age/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tempfiles []Tempfile
+	for rows.Next() {
+		var tf Tempfile
+		err = rows.Scan(&tf.fid, &tf.devid)
+		if err != nil {
+			return nil, err
+		}
+		tempfiles = append(tempfiles, tf)
+	}
+	err = rows.Err()
+	if err != nil || len(tempfiles) == 0 {
+		return nil, err
+	}
+	fids := make([]string, len(tempfiles))
+	for i, tf := range tempfiles {
+		fids[i] = strconv.FormatInt(tf.fid, 10)
+	}
+	_, err = tx.Exec("delete from tempfile where fid in (" + strings.Join(fids, ",") + ")") // nolint: gosec
+	return tempfiles, err
+}
+
+// findAliveDevices does not count bytes reserved by open tempfiles as free.
+// They are counted until the upload is closed although the written part is already used on disk,
+// so free space may be underestimated while uploads are in progress.
+func (s sqlMetadataStore) findAliveDevices(size int64, devids []int64) ([]aliveDevice, error) {
+	var devidsSQL string
+	if len(devids) > 0 {
+		devidsSQL = "and d.status in ('alive', 'drain') and d.devid in (" + formatDevids(devids) + ") "
+	} else {
+		devidsSQL = "and d.status='alive' "
+	}
+	rows, err := s.Query("select z.zoneid, r.rackid, h.hostid, h.hostip, h.hostname, d.devid, d.write_port "+ // nolint: gosec
+		"from device d "+
+		"join host h on d.hostid=h.hostid "+
+		"join rack r on h.rackid=r.rackid "+
+		"join zone z on r.zoneid=z.zoneid "+
+		"left join (select devid, sum(size) as reserved from tempfile group by devid) t on t.devid=d.devid "+
+		"where h.status='alive' "+
+		"and d.bytes_free - coalesce(t.reserved, 0) >= ? "+
+		devidsSQL+
+		"and "+s.secondsSince("d.updated_at")+" < 60 "+
+		"order by d.bytes_free - coalesce(t.reserved, 0) desc", size)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := make([]aliveDevice, 0)
+	for rows.Next() {
+		var d aliveDevice
+		err = rows.Scan(&d.zoneid, &d.rackid, &d.hostid, &d.hostip, &d.hostname, &d.devid, &d.httpPort)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func (s sqlMetadataStore) getSubnets() ([]subnet, error) {
+	rows, err := s.Query("select subnetid, r.rackid, z.zoneid, subnet from subnet s join rack r on s.rackid=r.rackid join zone z on z.zoneid=r.zoneid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []subnet
+	for rows.Next() {
+		var sn subnet
+		err = rows.Scan(&sn.subnetid, &sn.rackid, &sn.zoneid, &sn.subnet)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, sn)
+	}
+	return ret, rows.Err()
+}
+
+func (s sqlMetadataStore) getReadAddress(tx *storeTx, devid int64) (hostname string, port int64, err error) {
+	err = tx.QueryRow("select h.hostname, d.read_port "+
+		"from device d join host h on h.hostid=d.hostid "+
+		"where d.devid=?", devid).Scan(&hostname, &port)
+	return
+}
+
+func (s sqlMetadataStore) getDevices(ctx context.Context) ([]Device, error) {
+	rows, err := s.QueryContext(ctx, "select d.devid, d.hostid, h.hostname, h.status, h.rackid, r.name, r.zoneid, z.name, d.status, d.bytes_total, d.bytes_used, d.bytes_free, "+s.unixTimestamp("d.updated_at")+", d.io_utilization from device d join host h on h.hostid=d.hostid join rack r on r.rackid=h.rackid join zone z on z.zoneid=r.zoneid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := make([]Device, 0)
+	for rows.Next() {
+		var d Device
+		var bytesTotal, bytesUsed, bytesFree sql.NullInt64
+		var ioUtilization sql.NullInt64
+		err = rows.Scan(&d.Devid, &d.Hostid, &d.HostName, &d.HostStatus, &d.Rackid, &d.RackName, &d.Zoneid, &d.ZoneName, &d.Status, &bytesTotal, &bytesUsed, &bytesFree, &d.UpdatedAt, &ioUtilization)
+		if err != nil {
+			return nil, err
+		}
+		if bytesTotal.Valid {
+			d.BytesTotal = &bytesTotal.Int64
+		}
+		if bytesUsed.Valid {
+			d.BytesUsed = &bytesUsed.Int64
+		}
+		if bytesFree.Valid {
+			d.BytesFree = &bytesFree.Int64
+		}
+		if ioUtilization.Valid {
+			d.IoUtilization = &ioUtilization.Int64
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func (s sqlMetadataStore) getHosts(ctx context.Context) ([]Host, error) {
+	rows, err := s.QueryContext(ctx, "select hostid, status, hostname, hostip from host")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hosts := make([]Host, 0)
+	for rows.Next() {
+		var h Host
+		err = rows.Scan(&h.Hostid, &h.Status, &h.Hostname, &h.HostIP)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, rows.Err()
+}
+
+func (s sqlMetadataStore) getRacks(ctx context.Context) ([]Rack, error) {
+	rows, err := s.QueryContext(ctx, "select rackid, zoneid, name from rack")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	racks := make([]Rack, 0)
+	for rows.Next() {
+		var ra Rack
+		err = rows.Scan(&ra.Rackid, &ra.Zoneid, &ra.Name)
+		if err != nil {
+			return nil, err
+		}
+		racks = append(racks, ra)
+	}
+	return racks, rows.Err()
+}
+
+func (s sqlMetadataStore) getZones(ctx context.Context) ([]Zone, error) {
+	rows, err := s.QueryContext(ctx, "select zoneid, name from zone")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	zones := make([]Zone, 0)
+	for rows.Next() {
+		var z Zone
+		err = rows.Scan(&z.Zoneid, &z.Name)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, z)
+	}
+	return zones, rows.Err()
+}
+
+func (s sqlMetadataStore) updateDiskStats(devid int64, utilization, total, used, free sql.NullInt64) error {
+	_, err := s.Exec("update device set io_utilization=?, bytes_total=?, bytes_used=?, bytes_free=?, updated_at=current_timestamp where devid=?", utilization, total, used, free, devid)
+	return err
+}
+
+func (s sqlMetadataStore) startDiskClean(devid int64, period time.Duration) (bool, error) {
+	return s.startClean("last_disk_clean_time", devid, period)
+}
+
+func (s sqlMetadataStore) finishDiskClean(devid int64) error {
+	_, err := s.Exec("update device set last_disk_clean_time=current_timestamp where devid=?", devid)
+	return err
+}
+
+func (s sqlMetadataStore) startDeviceClean(devid int64, period time.Duration) (bool, error) {
+	return s.startClean("last_device_clean_time", devid, period)
+}
+
+func (s sqlMetadataStore) finishDeviceClean(devid int64) error {
+	_, err := s.Exec("update device set last_device_clean_time=current_timestamp where devid=?", devid)
+	return err
+}
+
+// startClean sets the time in column to now if it is older than period.
+// Only one of the processes serving the device gets true.
+func (s sqlMetadataStore) startClean(column string, devid int64, period time.Duration) (bool, error) {
+	res, err := s.Exec("update device "+ // nolint: gosec
+		"set "+column+"=current_timestamp "+
+		"where devid=? "+
+		"and "+s.addSeconds(column, "?")+" < current_timestamp",
+		devid, int64(period/time.Second))
+	if err != nil {
+		return false, err
+	}
+	ra, err := res.RowsAffected()
+	return ra > 0, err
+}
+
+// queryInt64s returns the values of the single column of rows.
+func queryInt64s(rows *sql.Rows, err error) ([]int64, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make([]int64, 0)
+	for rows.Next() {
+		var v int64
+		err = rows.Scan(&v)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestReplaceFile(t *testing.T) {
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	insertHost(t, tr)
+	_, err = tr.db.Exec("insert into device(devid, status, hostid) values(2, 'alive', 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := tr.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback() // nolint: errcheck
+	err = tr.meta.replaceFile(tx, 8, "foo", sql.NullInt64{}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.meta.lockFidOfKey(tx, "bar")
+	if err != sql.ErrNoRows {
+		t.Fatalf("unexpected error for missing key: %v", err)
+	}
+	fid, err := tr.meta.lockFidOfKey(tx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devids, err := tr.meta.deleteFile(tx, fid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(devids, []int64{2}) {
+		t.Fatalf("unexpected devids: %v", devids)
+	}
+	err = tr.meta.replaceFile(tx, 9, "foo", sql.NullInt64{Int64: 3, Valid: true}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	err = tr.db.QueryRow("select fid, size from file where dkey='foo'").Scan(&fid, &size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fid != 9 || size != 3 {
+		t.Fatalf("unexpected file: fid=%d size=%d", fid, size)
+	}
+	exists, err := tr.meta.fidExistsOnDevice(2, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("replica of new fid is not found")
+	}
+}
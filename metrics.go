@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	statusTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "efes",
+		Subsystem: "tracker",
+		Name:      "status_transitions_total",
+		Help:      "Number of host and device status changes made by heartbeat monitor.",
+	}, []string{"kind", "from", "to"})
+	pathCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "efes",
+		Subsystem: "tracker",
+		Name:      "path_cache_hits_total",
+		Help:      "Number of get-path lookups served from cache.",
+	})
+	pathCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "efes",
+		Subsystem: "tracker",
+		Name:      "path_cache_misses_total",
+		Help:      "Number of get-path lookups not found in cache or expired.",
+	})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "efes",
+		Subsystem: "tracker",
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of tracker HTTP requests. Count of the histogram is the number of requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "code"})
+	dbDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "efes",
+		Subsystem: "tracker",
+		Name:      "db_query_duration_seconds",
+		Help:      "Duration of database operations of tracker.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+	amqpPublishFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "efes",
+		Subsystem: "amqp",
+		Name:      "publish_failures_total",
+		Help:      "Number of messages that could not be published to AMQP.",
+	}, []string{"type"})
+	tempfilesCleaned = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "efes",
+		Subsystem: "tracker",
+		Name:      "tempfiles_cleaned_total",
+		Help:      "Number of expired tempfile records deleted by tempfile cleaner.",
+	})
+)
+
+// Server metrics are labelled by devid.
+var (
+	bytesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "efes",
+		Subsystem: "server",
+		Name:      "bytes_received_total",
+		Help:      "Number of bytes received by write server.",
+	}, []string{"devid"})
+	bytesServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "efes",
+		Subsystem: "server",
+		Name:      "bytes_served_total",
+		Help:      "Number of bytes sent by read server.",
+	}, []string{"devid"})
+	patchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "efes",
+		Subsystem: "server",
+		Name:      "patch_duration_seconds",
+		Help:      "Duration of PATCH requests on write server.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"devid"})
+	offsetConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "efes",
+		Subsystem: "server",
+		Name:      "offset_conflicts_total",
+		Help:      "Number of PATCH requests rejected because of offset mismatch.",
+	}, []string{"devid"})
+	deleteTasksProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "efes",
+		Subsystem: "server",
+		Name:      "delete_tasks_processed_total",
+		Help:      "Number of delete tasks completed successfully.",
+	}, []string{"devid"})
+	deleteTasksFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "efes",
+		Subsystem: "server",
+		Name:      "delete_tasks_failed_total",
+		Help:      "Number of delete tasks failed to delete the file.",
+	}, []string{"devid"})
+	deleteTasksRetried = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "efes",
+		Subsystem: "server",
+		Name:      "delete_tasks_retried_total",
+		Help:      "Number of failed delete tasks scheduled to be delivered again.",
+	}, []string{"devid"})
+	deleteTasksDead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "efes",
+		Subsystem: "server",
+		Name:      "delete_tasks_dead_total",
+		Help:      "Number of delete tasks moved to the dead letter queue after all retries failed.",
+	}, []string{"devid"})
+	cleanDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "efes",
+		Subsystem: "server",
+		Name:      "clean_duration_seconds",
+		Help:      "Duration of disk and device cleaner runs.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"devid", "cleaner"})
+	cleanRemoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "efes",
+		Subsystem: "server",
+		Name:      "clean_removed_total",
+		Help:      "Number of files removed from disk by disk cleaner or records removed from database by device cleaner.",
+	}, []string{"devid", "cleaner"})
+	cleanDryRunCandidates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "efes",
+		Subsystem: "server",
+		Name:      "clean_dry_run_candidates_total",
+		Help:      "Number of files or records that would be removed by cleaners if dry run was disabled.",
+	}, []string{"devid", "cleaner"})
+	diskIOUtilization = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "efes",
+		Subsystem: "server",
+		Name:      "disk_io_utilization",
+		Help:      "IO utilization of the disk of device in percent.",
+	}, []string{"devid"})
+)
+
+func init() {
+	prometheus.MustRegister(statusTransitions)
+	prometheus.MustRegister(pathCacheHits)
+	prometheus.MustRegister(pathCacheMisses)
+	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(dbDuration)
+	prometheus.MustRegister(amqpPublishFailures)
+	prometheus.MustRegister(tempfilesCleaned)
+	prometheus.MustRegister(bytesReceived)
+	prometheus.MustRegister(bytesServed)
+	prometheus.MustRegister(patchDuration)
+	prometheus.MustRegister(offsetConflicts)
+	prometheus.MustRegister(deleteTasksProcessed)
+	prometheus.MustRegister(deleteTasksFailed)
+	prometheus.MustRegister(deleteTasksRetried)
+	prometheus.MustRegister(deleteTasksDead)
+	prometheus.MustRegister(cleanDuration)
+	prometheus.MustRegister(cleanRemoved)
+	prometheus.MustRegister(cleanDryRunCandidates)
+	prometheus.MustRegister(diskIOUtilization)
+}
+
+// observeDB records the duration of a database operation started at begin.
+func observeDB(operation string, begin time.Time) {
+	dbDuration.WithLabelValues(operation).Observe(time.Since(begin).Seconds())
+}
+
+// statusRecorder saves the status code and counts the bytes written by handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps sendfile optimization of the underlying ResponseWriter for http.FileServer.
+func (r *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(r.ResponseWriter, src)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap is used by http.ResponseController.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrumentMux measures requests by the pattern they are routed to.
+// Patterns are used as label instead of paths to keep the cardinality bounded.
+func instrumentMux(m *http.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := m.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		begin := time.Now()
+		m.ServeHTTP(rec, r)
+		requestDuration.WithLabelValues(pattern, strconv.Itoa(rec.code)).Observe(time.Since(begin).Seconds())
+	}
+}
+
+// deviceCollector reports device stats from database at scrape time.
+type deviceCollector struct {
+	db            *store
+	log           log.Logger
+	bytesFree     *prometheus.Desc
+	bytesReserved *prometheus.Desc
+	heartbeatAge  *prometheus.Desc
+}
+
+func newDeviceCollector(db *store, logger log.Logger) *deviceCollector {
+	return &deviceCollector{
+		db:  db,
+		log: logger,
+		bytesFree: prometheus.NewDesc("efes_device_bytes_free",
+			"Free bytes on device as reported by server.", []string{"devid", "status"}, nil),
+		bytesReserved: prometheus.NewDesc("efes_device_bytes_reserved",
+			"Bytes reserved on device for uploads in progress.", []string{"devid", "status"}, nil),
+		heartbeatAge: prometheus.NewDesc("efes_device_heartbeat_age_seconds",
+			"Seconds since the server last updated device stats.", []string{"devid", "status"}, nil),
+	}
+}
+
+func (c *deviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.bytesFree
+	ch <- c.bytesReserved
+	ch <- c.heartbeatAge
+}
+
+func (c *deviceCollector) Collect(ch chan<- prometheus.Metric) {
+	rows, err := c.db.Query("select d.devid, d.status, d.bytes_free, coalesce(t.reserved, 0), " + c.db.secondsSince("d.updated_at") + " from device d " +
+		"left join (select devid, sum(size) as reserved from tempfile group by devid) t on t.devid=d.devid " +
+		"where d.status<>'dead'")
+	if err != nil {
+		c.log.Errorln("cannot select device stats for metrics:", err.Error())
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var devid int64
+		var status string
+		var bytesFree sql.NullInt64
+		var bytesReserved float64
+		var age int64
+		err = rows.Scan(&devid, &status, &bytesFree, &bytesReserved, &age)
+		if err != nil {
+			c.log.Errorln("cannot scan device stats for metrics:", err.Error())
+			return
+		}
+		id := strconv.FormatInt(devid, 10)
+		if bytesFree.Valid {
+			ch <- prometheus.MustNewConstMetric(c.bytesFree, prometheus.GaugeValue, float64(bytesFree.Int64), id, status)
+		}
+		ch <- prometheus.MustNewConstMetric(c.bytesReserved, prometheus.GaugeValue, bytesReserved, id, status)
+		ch <- prometheus.MustNewConstMetric(c.heartbeatAge, prometheus.GaugeValue, float64(age), id, status)
+	}
+	err = rows.Err()
+	if err != nil {
+		c.log.Errorln("cannot select device stats for metrics:", err.Error())
+	}
+}
+
+// instrumentWriteServer measures uploads to the device.
+func instrumentWriteServer(devid string, h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			h.ServeHTTP(w, r)
+			return
+		}
+		body := newReadCounter(r.Body)
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		begin := time.Now()
+		h.ServeHTTP(rec, r)
+		patchDuration.WithLabelValues(devid).Observe(time.Since(begin).Seconds())
+		bytesReceived.WithLabelValues(devid).Add(float64(body.Count()))
+		if rec.code == http.StatusConflict {
+			offsetConflicts.WithLabelValues(devid).Inc()
+		}
+	}
+}
+
+// instrumentReadServer counts bytes served from the device.
+func instrumentReadServer(devid string, h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		bytesServed.WithLabelValues(devid).Add(float64(rec.bytes))
+	}
+}
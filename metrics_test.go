@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestInstrumentMux(t *testing.T) {
+	m := http.NewServeMux()
+	m.HandleFunc("/test-instrument", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "teapot", http.StatusTeapot)
+	})
+	h := instrumentMux(m)
+	for _, path := range []string{"/test-instrument", "/test-instrument?a=1", "/no-such-endpoint"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	count := func(endpoint, code string) uint64 {
+		var metric dto.Metric
+		err := requestDuration.WithLabelValues(endpoint, code).(prometheus.Metric).Write(&metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return metric.GetHistogram().GetSampleCount()
+	}
+	if n := count("/test-instrument", "418"); n != 2 {
+		t.Fatalf("unexpected request count: %d", n)
+	}
+	if n := count("unmatched", "404"); n != 1 {
+		t.Fatalf("unexpected request count for unmatched path: %d", n)
+	}
+}
+
+func TestInstrumentServer(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "foo"), []byte("hello"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := instrumentReadServer("test", http.FileServer(http.Dir(dir)))
+	read.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/foo", nil))
+	if n := testutil.ToFloat64(bytesServed.WithLabelValues("test")); n != 5 {
+		t.Fatalf("unexpected bytes served: %v", n)
+	}
+
+	write := instrumentWriteServer("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusConflict)
+	}))
+	write.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPatch, "/foo", strings.NewReader("world!")))
+	if n := testutil.ToFloat64(bytesReceived.WithLabelValues("test")); n != 6 {
+		t.Fatalf("unexpected bytes received: %v", n)
+	}
+	if n := testutil.ToFloat64(offsetConflicts.WithLabelValues("test")); n != 1 {
+		t.Fatalf("unexpected offset conflicts: %v", n)
+	}
+}
+
+func TestObservedMetadataStore(t *testing.T) {
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.db.Close()
+	count := func() uint64 {
+		var metric dto.Metric
+		err := dbDuration.WithLabelValues("lock_fid_of_key").(prometheus.Metric).Write(&metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return metric.GetHistogram().GetSampleCount()
+	}
+	before := count()
+	tx, err := tr.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback() // nolint: errcheck
+	// Failed operations are recorded too.
+	_, err = tr.meta.lockFidOfKey(tx, "no-such-key")
+	if err == nil {
+		t.Fatal("missing key must be an error")
+	}
+	if n := count(); n != before+1 {
+		t.Fatalf("unexpected operation count: %d", n-before)
+	}
+}
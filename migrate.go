@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cenkalti/log"
+	"github.com/olekukonko/tablewriter"
+)
+
+// Migrations of each database driver are in a separate directory.
+// Files are named as "<version>_<name>.sql" and applied in order of version.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+func loadMigrations(driver string) ([]migration, error) {
+	dir := path.Join("migrations", driver)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]migration, 0, len(entries))
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		versionStr, name, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name: %s", e.Name())
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name: %s", e.Name())
+		}
+		b, err := migrationFiles.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(b)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// splitStatements splits a migration file into statements that end with a semicolon at end of line.
+// Lines starting with "--" are comments.
+func splitStatements(s string) []string {
+	var statements []string
+	var sb strings.Builder
+	for _, line := range strings.Split(s, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(sb.String()), ";"))
+			sb.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(sb.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+func hasTable(db *store, table string) (bool, error) {
+	var count int
+	err := db.QueryRow(db.tableExists(), table).Scan(&count)
+	return count > 0, err
+}
+
+// schemaVersion returns the version of the last applied migration. It is zero if none is applied.
+func schemaVersion(db *store) (int, error) {
+	ok, err := hasTable(db, "schema_migrations")
+	if err != nil || !ok {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err = db.QueryRow("select max(version) from schema_migrations").Scan(&version)
+	return int(version.Int64), err
+}
+
+// checkSchemaVersion returns an error if migrations known by this binary are not applied to the database.
+func checkSchemaVersion(db *store) error {
+	migrations, err := loadMigrations(db.driverName())
+	if err != nil {
+		return err
+	}
+	current, err := schemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("cannot get schema version: %w", err)
+	}
+	required := migrations[len(migrations)-1].version
+	if current < required {
+		return fmt.Errorf("database schema is at version %d but version %d is required, run \"efes migrate up\"", current, required)
+	}
+	return nil
+}
+
+// migrateUp applies migrations that are not applied yet and returns them.
+// A database created before migrations existed has tables but no migration history.
+// With baseline, the first migration is recorded as applied on such a database instead of returning an error.
+func migrateUp(db *store, baseline bool) ([]migration, error) {
+	migrations, err := loadMigrations(db.driverName())
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("create table if not exists schema_migrations (" +
+		"version integer NOT NULL PRIMARY KEY, " +
+		"name varchar(255) NOT NULL, " +
+		"applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)")
+	if err != nil {
+		return nil, err
+	}
+	current, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if current == 0 {
+		existing, err := hasTable(db, "file")
+		if err != nil {
+			return nil, err
+		}
+		if existing && !baseline {
+			return nil, errors.New("database has tables but no migration history, run with --baseline if its schema is at version 1")
+		}
+		if existing {
+			_, err = db.Exec("insert into schema_migrations(version, name) values(?, ?)", migrations[0].version, migrations[0].name)
+			if err != nil {
+				return nil, err
+			}
+			current = migrations[0].version
+		}
+	}
+	var applied []migration
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err = applyMigration(db, m)
+		if err != nil {
+			return applied, fmt.Errorf("cannot apply migration %d_%s: %w", m.version, m.name, err)
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// applyMigration runs the statements of m in a transaction.
+// Schema changes cannot be rolled back in MySQL, so a failed migration may be partially applied there.
+func applyMigration(db *store, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	for _, stmt := range splitStatements(m.sql) {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("insert into schema_migrations(version, name) values(?, ?)", m.version, m.name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func runMigrateUp(cfg DatabaseConfig, baseline bool) error {
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer logCloseDB(log.DefaultLogger, db)
+	applied, err := migrateUp(db, baseline)
+	for _, m := range applied {
+		fmt.Printf("applied %d_%s\n", m.version, m.name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Println("schema is up to date")
+	}
+	return nil
+}
+
+func migrateStatus(cfg DatabaseConfig) error {
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer logCloseDB(log.DefaultLogger, db)
+	migrations, err := loadMigrations(db.driverName())
+	if err != nil {
+		return err
+	}
+	appliedAt := make(map[int]string)
+	ok, err := hasTable(db, "schema_migrations")
+	if err != nil {
+		return err
+	}
+	if ok {
+		rows, err := db.Query("select version, applied_at from schema_migrations")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var version int
+			var t sql.NullTime
+			err = rows.Scan(&version, &t)
+			if err != nil {
+				return err
+			}
+			appliedAt[version] = t.Time.Format("2006-01-02 15:04:05")
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetBorder(false)
+	table.SetHeader([]string{"Version", "Name", "Applied at"})
+	for _, m := range migrations {
+		status, ok := appliedAt[m.version]
+		if !ok {
+			status = "pending"
+		}
+		table.Append([]string{strconv.Itoa(m.version), m.name, status})
+	}
+	table.Render()
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	statements := splitStatements("-- comment\nCREATE TABLE a (\n  id integer\n);\n\nINSERT INTO a VALUES (1);\nSELECT 1")
+	expected := []string{"CREATE TABLE a (\n  id integer\n)", "INSERT INTO a VALUES (1)", "SELECT 1"}
+	if !reflect.DeepEqual(statements, expected) {
+		t.Fatalf("unexpected statements: %q", statements)
+	}
+}
+
+func TestMigrateUp(t *testing.T) {
+	db, err := openDatabase(DatabaseConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "efes.db"), MaxOpenConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = checkSchemaVersion(db)
+	if err == nil {
+		t.Fatal("empty database must not pass schema check")
+	}
+	applied, err := migrateUp(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := loadMigrations("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("unexpected number of applied migrations: %d", len(applied))
+	}
+	err = checkSchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err = migrateUp(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Fatalf("migrations applied twice: %v", applied)
+	}
+}
+
+func TestMigrateUpBaseline(t *testing.T) {
+	cfg := *testConfig
+	cfg.Database = DatabaseConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "efes.db"), MaxOpenConns: 1}
+	db, err := openDatabase(cfg.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	migrations, err := loadMigrations("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Database created before migrations existed has the schema of first migration but no history.
+	for _, stmt := range splitStatements(migrations[0].sql) {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = migrateUp(db, false)
+	if err == nil {
+		t.Fatal("existing database must not be migrated without baseline")
+	}
+	applied, err := migrateUp(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations)-1 {
+		t.Fatalf("unexpected number of applied migrations: %d", len(applied))
+	}
+	err = checkSchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := NewTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.db.Close()
+	insertHost(t, tr)
+	_, err = tr.db.Exec("insert into device(devid, status, hostid) values(2, 'alive', 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.db.Exec("insert into tempfile(fid, devid) values(9, 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/create-close?fid=9&devid=2&key=foo&size=10", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	tr.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var size int64
+	err = tr.db.QueryRow("select size from file where fid=9").Scan(&size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 10 {
+		t.Fatalf("unexpected file size: %d", size)
+	}
+}
+
+func TestMigrationsOfDrivers(t *testing.T) {
+	// Each driver must have the same migrations.
+	var names []string
+	for i, driver := range []string{"mysql", "postgres", "sqlite"} {
+		migrations, err := loadMigrations(driver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var driverNames []string
+		for _, m := range migrations {
+			driverNames = append(driverNames, m.name)
+		}
+		if i > 0 && !reflect.DeepEqual(driverNames, names) {
+			t.Errorf("migrations of %s do not match: %v", driver, driverNames)
+		}
+		names = driverNames
+	}
+}
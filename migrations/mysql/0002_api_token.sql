@@ -0,0 +1,12 @@
+-- Tokens of clients when auth is enabled.
+CREATE TABLE `api_token` (
+  `tokenid` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `name` varchar(40) NOT NULL,
+  `token_hash` char(64) NOT NULL,
+  `scopes` varchar(255) NOT NULL,
+  `key_prefix` varchar(255) NOT NULL DEFAULT '',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `revoked_at` TIMESTAMP NULL DEFAULT NULL,
+  PRIMARY KEY (`tokenid`),
+  UNIQUE KEY `token_hash` (`token_hash`)
+);
@@ -0,0 +1,14 @@
+-- Log of metadata changes.
+CREATE TABLE `audit` (
+  `auditid` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `operation` varchar(20) NOT NULL,
+  `dkey` varchar(255) NOT NULL DEFAULT '',
+  `fid` bigint(20) unsigned NOT NULL,
+  `devids` varchar(255) NOT NULL DEFAULT '',
+  `client_ip` varchar(40) NOT NULL DEFAULT '',
+  `actor` varchar(80) NOT NULL DEFAULT '',
+  PRIMARY KEY (`auditid`),
+  KEY `ndx_dkey` (`dkey`),
+  KEY `ndx_fid` (`fid`)
+);
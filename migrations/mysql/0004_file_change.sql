@@ -0,0 +1,18 @@
+-- Feed of changed keys ordered by sequence number.
+CREATE TABLE `change_seq` (
+  `id` tinyint(3) unsigned NOT NULL,
+  `seq` bigint(20) unsigned NOT NULL,
+  PRIMARY KEY (`id`)
+);
+
+INSERT INTO `change_seq` VALUES (1, 0);
+
+CREATE TABLE `file_change` (
+  `seq` bigint(20) unsigned NOT NULL,
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `event` enum('create','overwrite','delete') NOT NULL,
+  `dkey` varchar(255) NOT NULL,
+  `fid` bigint(20) unsigned NOT NULL,
+  PRIMARY KEY (`seq`),
+  KEY `ndx_created_at` (`created_at`)
+);
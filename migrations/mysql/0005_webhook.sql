@@ -0,0 +1,21 @@
+-- Webhook subscriptions and deliveries that could not be sent.
+CREATE TABLE `webhook` (
+  `webhookid` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `url` varchar(2048) NOT NULL,
+  `secret` char(64) NOT NULL,
+  `key_prefix` varchar(255) NOT NULL DEFAULT '',
+  `events` varchar(255) NOT NULL DEFAULT '',
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`webhookid`)
+);
+
+CREATE TABLE `webhook_dead_letter` (
+  `deadletterid` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `webhookid` int(10) unsigned NOT NULL,
+  `event` varchar(40) NOT NULL,
+  `payload` text NOT NULL,
+  `attempts` int(10) unsigned NOT NULL,
+  `last_error` text NOT NULL,
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`deadletterid`)
+);
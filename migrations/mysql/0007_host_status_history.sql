@@ -0,0 +1,12 @@
+-- History of host status changes.
+CREATE TABLE `host_status_history` (
+  `historyid` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `hostid` mediumint(8) unsigned NOT NULL,
+  `old_status` enum('alive','dead','down') NOT NULL,
+  `new_status` enum('alive','dead','down') NOT NULL,
+  `operator` varchar(80) NOT NULL,
+  `reason` varchar(255) NOT NULL,
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`historyid`),
+  KEY `ndx_hostid` (`hostid`)
+);
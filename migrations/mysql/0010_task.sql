@@ -0,0 +1,9 @@
+-- Delete tasks of devices when tasks.queue is "database".
+CREATE TABLE `task` (
+  `taskid` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `devid` mediumint(8) unsigned NOT NULL,
+  `fid` bigint(20) unsigned NOT NULL,
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`taskid`),
+  KEY `ndx_devid_taskid` (`devid`, `taskid`)
+);
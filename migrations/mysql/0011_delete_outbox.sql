@@ -0,0 +1,10 @@
+-- Delete tasks written in the transaction that removes the file, until they are published to AMQP.
+CREATE TABLE `delete_outbox` (
+  `outboxid` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `devid` mediumint(8) unsigned NOT NULL,
+  `fid` bigint(20) unsigned NOT NULL,
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `sent_at` TIMESTAMP NULL DEFAULT NULL,
+  PRIMARY KEY (`outboxid`),
+  KEY `ndx_sent_at` (`sent_at`)
+);
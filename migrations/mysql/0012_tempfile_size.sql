@@ -0,0 +1,2 @@
+-- Bytes reserved on the device for an upload in progress.
+ALTER TABLE `tempfile` ADD COLUMN `size` bigint(20) unsigned NOT NULL DEFAULT 0;
@@ -0,0 +1,13 @@
+-- Webhook deliveries that are not sent yet. Failed deliveries are kept with the number of attempts and claimed again after not_before.
+CREATE TABLE `webhook_delivery` (
+  `deliveryid` bigint(20) unsigned NOT NULL AUTO_INCREMENT,
+  `webhookid` int(10) unsigned NOT NULL,
+  `event` varchar(40) NOT NULL,
+  `payload` text NOT NULL,
+  `attempts` int(10) unsigned NOT NULL DEFAULT 0,
+  `last_error` text NOT NULL,
+  `not_before` TIMESTAMP NULL DEFAULT NULL,
+  `claimed_at` TIMESTAMP NULL DEFAULT NULL,
+  `created_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`deliveryid`)
+);
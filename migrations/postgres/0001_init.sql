@@ -0,0 +1,58 @@
+CREATE TABLE zone (
+  zoneid integer NOT NULL PRIMARY KEY,
+  name varchar(40) NOT NULL
+);
+
+CREATE TABLE rack (
+  rackid integer NOT NULL PRIMARY KEY,
+  zoneid integer NOT NULL REFERENCES zone (zoneid),
+  name varchar(40) NOT NULL
+);
+
+CREATE TABLE subnet (
+  subnetid integer NOT NULL PRIMARY KEY,
+  rackid integer NOT NULL REFERENCES rack (rackid),
+  subnet varchar(18) NOT NULL
+);
+
+CREATE TABLE host (
+  hostid integer NOT NULL PRIMARY KEY,
+  status varchar(8) NOT NULL DEFAULT 'alive' CHECK (status IN ('alive','dead','down')),
+  hostname varchar(40) NOT NULL,
+  hostip varchar(40) NOT NULL,
+  rackid integer NOT NULL REFERENCES rack (rackid)
+);
+
+CREATE TABLE device (
+  devid integer NOT NULL PRIMARY KEY,
+  hostid integer NOT NULL REFERENCES host (hostid),
+  read_port integer NOT NULL DEFAULT 8500,
+  write_port integer NOT NULL DEFAULT 8501,
+  status varchar(8) NOT NULL DEFAULT 'alive' CHECK (status IN ('alive','dead','down','drain')),
+  bytes_total bigint DEFAULT NULL,
+  bytes_used bigint DEFAULT NULL,
+  bytes_free bigint DEFAULT NULL,
+  io_utilization smallint DEFAULT NULL,
+  updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  last_disk_clean_time timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  last_device_clean_time timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE file (
+  fid bigint NOT NULL PRIMARY KEY,
+  dkey varchar(255) NOT NULL UNIQUE,
+  created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE tempfile (
+  fid bigserial NOT NULL PRIMARY KEY,
+  created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  devid integer NOT NULL REFERENCES device (devid)
+);
+CREATE INDEX tempfile_created_at ON tempfile (created_at);
+
+CREATE TABLE file_on (
+  fid bigint NOT NULL REFERENCES file (fid),
+  devid integer NOT NULL REFERENCES device (devid),
+  PRIMARY KEY (fid, devid)
+);
@@ -0,0 +1,10 @@
+-- Tokens of clients when auth is enabled.
+CREATE TABLE api_token (
+  tokenid serial NOT NULL PRIMARY KEY,
+  name varchar(40) NOT NULL,
+  token_hash char(64) NOT NULL UNIQUE,
+  scopes varchar(255) NOT NULL,
+  key_prefix varchar(255) NOT NULL DEFAULT '',
+  created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  revoked_at timestamptz NULL DEFAULT NULL
+);
@@ -0,0 +1,13 @@
+-- Log of metadata changes.
+CREATE TABLE audit (
+  auditid bigserial NOT NULL PRIMARY KEY,
+  created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  operation varchar(20) NOT NULL,
+  dkey varchar(255) NOT NULL DEFAULT '',
+  fid bigint NOT NULL,
+  devids varchar(255) NOT NULL DEFAULT '',
+  client_ip varchar(40) NOT NULL DEFAULT '',
+  actor varchar(80) NOT NULL DEFAULT ''
+);
+CREATE INDEX audit_dkey ON audit (dkey);
+CREATE INDEX audit_fid ON audit (fid);
@@ -0,0 +1,16 @@
+-- Feed of changed keys ordered by sequence number.
+CREATE TABLE change_seq (
+  id smallint NOT NULL PRIMARY KEY,
+  seq bigint NOT NULL
+);
+
+INSERT INTO change_seq VALUES (1, 0);
+
+CREATE TABLE file_change (
+  seq bigint NOT NULL PRIMARY KEY,
+  created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  event varchar(10) NOT NULL CHECK (event IN ('create','overwrite','delete')),
+  dkey varchar(255) NOT NULL,
+  fid bigint NOT NULL
+);
+CREATE INDEX file_change_created_at ON file_change (created_at);
@@ -0,0 +1,11 @@
+-- History of device status changes.
+CREATE TABLE device_status_history (
+  historyid bigserial NOT NULL PRIMARY KEY,
+  devid integer NOT NULL,
+  old_status varchar(8) NOT NULL CHECK (old_status IN ('alive','dead','down','drain')),
+  new_status varchar(8) NOT NULL CHECK (new_status IN ('alive','dead','down','drain')),
+  operator varchar(80) NOT NULL,
+  reason varchar(255) NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX device_status_history_devid ON device_status_history (devid);
@@ -0,0 +1,11 @@
+-- History of host status changes.
+CREATE TABLE host_status_history (
+  historyid bigserial NOT NULL PRIMARY KEY,
+  hostid integer NOT NULL,
+  old_status varchar(8) NOT NULL CHECK (old_status IN ('alive','dead','down')),
+  new_status varchar(8) NOT NULL CHECK (new_status IN ('alive','dead','down')),
+  operator varchar(80) NOT NULL,
+  reason varchar(255) NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX host_status_history_hostid ON host_status_history (hostid);
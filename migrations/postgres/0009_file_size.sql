@@ -0,0 +1,2 @@
+-- Size of file in bytes. It is NULL for files created before this column is added.
+ALTER TABLE file ADD COLUMN size bigint DEFAULT NULL;
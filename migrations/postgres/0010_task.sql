@@ -0,0 +1,8 @@
+-- Delete tasks of devices when tasks.queue is "database".
+CREATE TABLE task (
+  taskid bigserial NOT NULL PRIMARY KEY,
+  devid integer NOT NULL,
+  fid bigint NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX task_devid_taskid ON task (devid, taskid);
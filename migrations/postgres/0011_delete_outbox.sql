@@ -0,0 +1,9 @@
+-- Delete tasks written in the transaction that removes the file, until they are published to AMQP.
+CREATE TABLE delete_outbox (
+  outboxid bigserial NOT NULL PRIMARY KEY,
+  devid integer NOT NULL,
+  fid bigint NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  sent_at timestamptz DEFAULT NULL
+);
+CREATE INDEX delete_outbox_sent_at ON delete_outbox (sent_at);
@@ -0,0 +1,2 @@
+-- Bytes reserved on the device for an upload in progress.
+ALTER TABLE tempfile ADD COLUMN size bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+-- Time a consumer claimed the task. Tasks whose claim is too old are claimed again.
+ALTER TABLE task ADD COLUMN claimed_at timestamptz DEFAULT NULL;
@@ -0,0 +1,2 @@
+-- Time a relay claimed the task for publishing. Tasks whose claim is too old are claimed again.
+ALTER TABLE delete_outbox ADD COLUMN claimed_at timestamptz DEFAULT NULL;
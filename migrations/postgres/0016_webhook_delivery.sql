@@ -0,0 +1,12 @@
+-- Webhook deliveries that are not sent yet. Failed deliveries are kept with the number of attempts and claimed again after not_before.
+CREATE TABLE webhook_delivery (
+  deliveryid bigserial NOT NULL PRIMARY KEY,
+  webhookid integer NOT NULL,
+  event varchar(40) NOT NULL,
+  payload text NOT NULL,
+  attempts integer NOT NULL DEFAULT 0,
+  last_error text NOT NULL,
+  not_before timestamptz DEFAULT NULL,
+  claimed_at timestamptz DEFAULT NULL,
+  created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
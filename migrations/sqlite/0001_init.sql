@@ -0,0 +1,58 @@
+CREATE TABLE zone (
+  zoneid integer NOT NULL PRIMARY KEY,
+  name varchar(40) NOT NULL
+);
+
+CREATE TABLE rack (
+  rackid integer NOT NULL PRIMARY KEY,
+  zoneid integer NOT NULL REFERENCES zone (zoneid),
+  name varchar(40) NOT NULL
+);
+
+CREATE TABLE subnet (
+  subnetid integer NOT NULL PRIMARY KEY,
+  rackid integer NOT NULL REFERENCES rack (rackid),
+  subnet varchar(18) NOT NULL
+);
+
+CREATE TABLE host (
+  hostid integer NOT NULL PRIMARY KEY,
+  status text NOT NULL DEFAULT 'alive' CHECK (status IN ('alive','dead','down')),
+  hostname varchar(40) NOT NULL,
+  hostip varchar(40) NOT NULL,
+  rackid integer NOT NULL REFERENCES rack (rackid)
+);
+
+CREATE TABLE device (
+  devid integer NOT NULL PRIMARY KEY,
+  hostid integer NOT NULL REFERENCES host (hostid),
+  read_port integer NOT NULL DEFAULT 8500,
+  write_port integer NOT NULL DEFAULT 8501,
+  status text NOT NULL DEFAULT 'alive' CHECK (status IN ('alive','dead','down','drain')),
+  bytes_total integer DEFAULT NULL,
+  bytes_used integer DEFAULT NULL,
+  bytes_free integer DEFAULT NULL,
+  io_utilization integer DEFAULT NULL,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  last_disk_clean_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  last_device_clean_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE file (
+  fid integer NOT NULL PRIMARY KEY,
+  dkey varchar(255) NOT NULL UNIQUE,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE tempfile (
+  fid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  devid integer NOT NULL REFERENCES device (devid)
+);
+CREATE INDEX tempfile_created_at ON tempfile (created_at);
+
+CREATE TABLE file_on (
+  fid integer NOT NULL REFERENCES file (fid),
+  devid integer NOT NULL REFERENCES device (devid),
+  PRIMARY KEY (fid, devid)
+);
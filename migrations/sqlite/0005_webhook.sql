@@ -0,0 +1,19 @@
+-- Webhook subscriptions and deliveries that could not be sent.
+CREATE TABLE webhook (
+  webhookid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+  url varchar(2048) NOT NULL,
+  secret char(64) NOT NULL,
+  key_prefix varchar(255) NOT NULL DEFAULT '',
+  events varchar(255) NOT NULL DEFAULT '',
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE webhook_dead_letter (
+  deadletterid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+  webhookid integer NOT NULL,
+  event varchar(40) NOT NULL,
+  payload text NOT NULL,
+  attempts integer NOT NULL,
+  last_error text NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
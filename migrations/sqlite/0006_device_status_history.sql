@@ -0,0 +1,11 @@
+-- History of device status changes.
+CREATE TABLE device_status_history (
+  historyid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+  devid integer NOT NULL,
+  old_status text NOT NULL CHECK (old_status IN ('alive','dead','down','drain')),
+  new_status text NOT NULL CHECK (new_status IN ('alive','dead','down','drain')),
+  operator varchar(80) NOT NULL,
+  reason varchar(255) NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX device_status_history_devid ON device_status_history (devid);
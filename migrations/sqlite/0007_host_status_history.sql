@@ -0,0 +1,11 @@
+-- History of host status changes.
+CREATE TABLE host_status_history (
+  historyid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+  hostid integer NOT NULL,
+  old_status text NOT NULL CHECK (old_status IN ('alive','dead','down')),
+  new_status text NOT NULL CHECK (new_status IN ('alive','dead','down')),
+  operator varchar(80) NOT NULL,
+  reason varchar(255) NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX host_status_history_hostid ON host_status_history (hostid);
@@ -0,0 +1,6 @@
+-- Lease of the tracker that runs periodic jobs.
+CREATE TABLE leader_lease (
+  name varchar(40) NOT NULL PRIMARY KEY,
+  holder varchar(255) NOT NULL,
+  expires_at TIMESTAMP NOT NULL
+);
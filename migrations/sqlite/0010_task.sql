@@ -0,0 +1,8 @@
+-- Delete tasks of devices when tasks.queue is "database".
+CREATE TABLE task (
+  taskid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+  devid integer NOT NULL,
+  fid integer NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX task_devid_taskid ON task (devid, taskid);
@@ -0,0 +1,9 @@
+-- Delete tasks written in the transaction that removes the file, until they are published to AMQP.
+CREATE TABLE delete_outbox (
+  outboxid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+  devid integer NOT NULL,
+  fid integer NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  sent_at TIMESTAMP DEFAULT NULL
+);
+CREATE INDEX delete_outbox_sent_at ON delete_outbox (sent_at);
@@ -0,0 +1,6 @@
+-- Failed tasks are kept with the number of attempts and claimed again after not_before.
+-- Tasks that fail on all retries are marked dead until they are replayed.
+ALTER TABLE task ADD COLUMN attempts integer NOT NULL DEFAULT 0;
+ALTER TABLE task ADD COLUMN not_before TIMESTAMP DEFAULT NULL;
+ALTER TABLE task ADD COLUMN dead_at TIMESTAMP DEFAULT NULL;
+ALTER TABLE task ADD COLUMN last_error varchar(255) NOT NULL DEFAULT '';
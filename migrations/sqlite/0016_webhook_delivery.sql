@@ -0,0 +1,12 @@
+-- Webhook deliveries that are not sent yet. Failed deliveries are kept with the number of attempts and claimed again after not_before.
+CREATE TABLE webhook_delivery (
+  deliveryid integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+  webhookid integer NOT NULL,
+  event varchar(40) NOT NULL,
+  payload text NOT NULL,
+  attempts integer NOT NULL DEFAULT 0,
+  last_error text NOT NULL,
+  not_before TIMESTAMP DEFAULT NULL,
+  claimed_at TIMESTAMP DEFAULT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+type mysqlDialect struct{}
+
+func openMysql(dsn string) (*store, error) {
+	// Parse existing DSN to add parameters
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add the parsing parameters
+	cfg.ParseTime = true
+
+	// Open connection with modified DSN
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	return &store{db: db, dialect: mysqlDialect{}}, nil
+}
+
+func (mysqlDialect) driverName() string {
+	return "mysql"
+}
+
+func (mysqlDialect) bind(query string, args []interface{}) (string, []interface{}) {
+	return query, args
+}
+
+func (mysqlDialect) forUpdate() string {
+	return " for update"
+}
+
+func (mysqlDialect) forUpdateSkipLocked() string {
+	return " for update skip locked"
+}
+
+func (mysqlDialect) secondsSince(expr string) string {
+	return "timestampdiff(second, " + expr + ", current_timestamp)"
+}
+
+func (mysqlDialect) addSeconds(expr, seconds string) string {
+	return "(" + expr + " + interval " + seconds + " second)"
+}
+
+func (mysqlDialect) unixTimestamp(expr string) string {
+	return "unix_timestamp(" + expr + ")"
+}
+
+func (mysqlDialect) fromUnixtime(expr string) string {
+	return "from_unixtime(" + expr + ")"
+}
+
+func (mysqlDialect) groupConcat(expr string) string {
+	return "group_concat(" + expr + " order by " + expr + ")"
+}
+
+func (mysqlDialect) returning(column string) string {
+	return ""
+}
+
+func (mysqlDialect) tableExists() string {
+	return "select count(*) from information_schema.tables where table_schema=database() and table_name=?"
+}
+
+// AUTO_INCREMENT is never set below the largest value in table, but it may be lowered on an empty table.
+func (mysqlDialect) advanceSequence(table, column string, next int64) []string {
+	return []string{"alter table " + table + " auto_increment = " + strconv.FormatInt(next, 10)}
+}
+
+func (mysqlDialect) conflict(err error) (string, bool) {
+	var merr *mysql.MySQLError
+	// duplicate entry or foreign key constraint failure
+	if errors.As(err, &merr) && (merr.Number == 1062 || merr.Number == 1451 || merr.Number == 1452) {
+		return merr.Message, true
+	}
+	return "", false
+}
+
+type mysqlMetadataStore struct {
+	sqlMetadataStore
+}
+
+// replaceFile removes the existing file with the same key, if any, and inserts the new one.
+// A new fid may come with the same key concurrently after the old fid is removed by the caller.
+// REPLACE prevents "duplicate entry" errors in that case, at the cost of leaving "file_on" records of replaced fid.
+// It is a very rare case and device cleaner eventually removes such records.
+func (s mysqlMetadataStore) replaceFile(tx *storeTx, fid int64, key string, size sql.NullInt64, devid int64) error {
+	_, err := tx.Exec("replace into file(fid, dkey, size, created_at) values(?, ?, ?, current_timestamp)", fid, key, size)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into file_on(fid, devid) values(?, ?)", fid, devid)
+	return err
+}
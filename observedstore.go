@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// observedMetadataStore records the duration of each operation of tracker on metadata store,
+// including the ones that fail.
+type observedMetadataStore struct {
+	metadataStore
+}
+
+func (s observedMetadataStore) BeginTx(ctx context.Context, opts *sql.TxOptions) (*storeTx, error) {
+	defer observeDB("begin_tx", time.Now())
+	return s.metadataStore.BeginTx(ctx, opts)
+}
+
+func (s observedMetadataStore) selectReplicas(ctx context.Context, key string) ([]replica, error) {
+	defer observeDB("select_replicas", time.Now())
+	return s.metadataStore.selectReplicas(ctx, key)
+}
+
+func (s observedMetadataStore) lockFidOfKey(tx *storeTx, key string) (int64, error) {
+	defer observeDB("lock_fid_of_key", time.Now())
+	return s.metadataStore.lockFidOfKey(tx, key)
+}
+
+func (s observedMetadataStore) lockKeyOfFid(tx *storeTx, fid int64) (string, error) {
+	defer observeDB("lock_key_of_fid", time.Now())
+	return s.metadataStore.lockKeyOfFid(tx, fid)
+}
+
+func (s observedMetadataStore) getDevicesOfFid(tx *storeTx, fid int64) ([]int64, error) {
+	defer observeDB("get_devices_of_fid", time.Now())
+	return s.metadataStore.getDevicesOfFid(tx, fid)
+}
+
+func (s observedMetadataStore) replaceFile(tx *storeTx, fid int64, key string, size sql.NullInt64, devid int64) error {
+	defer observeDB("replace_file", time.Now())
+	return s.metadataStore.replaceFile(tx, fid, key, size, devid)
+}
+
+func (s observedMetadataStore) deleteFile(tx *storeTx, fid int64) ([]int64, error) {
+	defer observeDB("delete_file", time.Now())
+	return s.metadataStore.deleteFile(tx, fid)
+}
+
+func (s observedMetadataStore) deleteReplicas(tx *storeTx, fid int64, devids []int64) error {
+	defer observeDB("delete_replicas", time.Now())
+	return s.metadataStore.deleteReplicas(tx, fid, devids)
+}
+
+func (s observedMetadataStore) moveReplica(tx *storeTx, fid, from, to int64) error {
+	defer observeDB("move_replica", time.Now())
+	return s.metadataStore.moveReplica(tx, fid, from, to)
+}
+
+func (s observedMetadataStore) getFidsOnDevice(devid int64) ([]int64, error) {
+	defer observeDB("get_fids_on_device", time.Now())
+	return s.metadataStore.getFidsOnDevice(devid)
+}
+
+func (s observedMetadataStore) fidExistsOnDevice(devid, fid int64) (bool, error) {
+	defer observeDB("fid_exists_on_device", time.Now())
+	return s.metadataStore.fidExistsOnDevice(devid, fid)
+}
+
+func (s observedMetadataStore) reserveTempfile(ctx context.Context, devid, size int64) (int64, bool, error) {
+	defer observeDB("reserve_tempfile", time.Now())
+	return s.metadataStore.reserveTempfile(ctx, devid, size)
+}
+
+func (s observedMetadataStore) closeTempfile(tx *storeTx, fid int64) (int64, error) {
+	defer observeDB("close_tempfile", time.Now())
+	return s.metadataStore.closeTempfile(tx, fid)
+}
+
+func (s observedMetadataStore) tempfileExists(fid int64) (bool, error) {
+	defer observeDB("tempfile_exists", time.Now())
+	return s.metadataStore.tempfileExists(fid)
+}
+
+func (s observedMetadataStore) expireTempfiles(tx *storeTx, age time.Duration) ([]Tempfile, error) {
+	defer observeDB("expire_tempfiles", time.Now())
+	return s.metadataStore.expireTempfiles(tx, age)
+}
+
+func (s observedMetadataStore) findAliveDevices(size int64, devids []int64) ([]aliveDevice, error) {
+	defer observeDB("find_alive_devices", time.Now())
+	return s.metadataStore.findAliveDevices(size, devids)
+}
+
+func (s observedMetadataStore) getSubnets() ([]subnet, error) {
+	defer observeDB("get_subnets", time.Now())
+	return s.metadataStore.getSubnets()
+}
+
+func (s observedMetadataStore) getReadAddress(tx *storeTx, devid int64) (string, int64, error) {
+	defer observeDB("get_read_address", time.Now())
+	return s.metadataStore.getReadAddress(tx, devid)
+}
+
+func (s observedMetadataStore) getDevices(ctx context.Context) ([]Device, error) {
+	defer observeDB("get_devices", time.Now())
+	return s.metadataStore.getDevices(ctx)
+}
+
+func (s observedMetadataStore) getHosts(ctx context.Context) ([]Host, error) {
+	defer observeDB("get_hosts", time.Now())
+	return s.metadataStore.getHosts(ctx)
+}
+
+func (s observedMetadataStore) getRacks(ctx context.Context) ([]Rack, error) {
+	defer observeDB("get_racks", time.Now())
+	return s.metadataStore.getRacks(ctx)
+}
+
+func (s observedMetadataStore) getZones(ctx context.Context) ([]Zone, error) {
+	defer observeDB("get_zones", time.Now())
+	return s.metadataStore.getZones(ctx)
+}
+
+func (s observedMetadataStore) updateDiskStats(devid int64, utilization, total, used, free sql.NullInt64) error {
+	defer observeDB("update_disk_stats", time.Now())
+	return s.metadataStore.updateDiskStats(devid, utilization, total, used, free)
+}
+
+func (s observedMetadataStore) startDiskClean(devid int64, period time.Duration) (bool, error) {
+	defer observeDB("start_disk_clean", time.Now())
+	return s.metadataStore.startDiskClean(devid, period)
+}
+
+func (s observedMetadataStore) finishDiskClean(devid int64) error {
+	defer observeDB("finish_disk_clean", time.Now())
+	return s.metadataStore.finishDiskClean(devid)
+}
+
+func (s observedMetadataStore) startDeviceClean(devid int64, period time.Duration) (bool, error) {
+	defer observeDB("start_device_clean", time.Now())
+	return s.metadataStore.startDeviceClean(devid, period)
+}
+
+func (s observedMetadataStore) finishDeviceClean(devid int64) error {
+	defer observeDB("finish_device_clean", time.Now())
+	return s.metadataStore.finishDeviceClean(devid)
+}
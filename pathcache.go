@@ -0,0 +1,294 @@
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// replica is a readable copy of a file.
+type replica struct {
+	hostname      string
+	hostip        string
+	rackid        int64
+	zoneid        int64
+	httpPort      int64
+	devid         int64
+	fid           int64
+	createdAt     sql.NullTime
+	ioUtilization sql.NullInt64
+}
+
+// pathCache is an LRU cache of replicas of keys.
+// Entries expire after ttl so that changes made outside of tracker are picked up eventually.
+// Changes made by other trackers are removed on events, which are not guaranteed to be delivered,
+// so ttl is also the upper bound of serving a stale entry if an event is lost.
+type pathCache struct {
+	size int
+	ttl  time.Duration
+
+	m     sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	// gen is incremented on each Remove and Purge.
+	// Add is skipped if gen changed after the caller read replicas from database,
+	// because the removal may be for a change that the read has not seen.
+	gen uint64
+}
+
+type pathCacheEntry struct {
+	key       string
+	replicas  []replica
+	expiresAt time.Time
+}
+
+// newPathCache returns nil if size is zero. Methods of a nil cache are no-op.
+func newPathCache(size int, ttl time.Duration) *pathCache {
+	if size <= 0 {
+		return nil
+	}
+	return &pathCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *pathCache) Get(key string) ([]replica, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		pathCacheMisses.Inc()
+		return nil, false
+	}
+	e := el.Value.(*pathCacheEntry)
+	if time.Now().After(e.expiresAt) {
+		c.removeElement(el)
+		pathCacheMisses.Inc()
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	pathCacheHits.Inc()
+	return e.replicas, true
+}
+
+// Generation must be taken before reading replicas from database and passed to Add.
+func (c *pathCache) Generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.gen
+}
+
+// Add replicas of key read after gen is taken. It is no-op if an entry is removed or cache is purged since then.
+func (c *pathCache) Add(key string, replicas []replica, gen uint64) {
+	if c == nil {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if gen != c.gen {
+		return
+	}
+	expiresAt := time.Now().Add(c.ttl)
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*pathCacheEntry)
+		e.replicas = replicas
+		e.expiresAt = expiresAt
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&pathCacheEntry{key: key, replicas: replicas, expiresAt: expiresAt})
+	if c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Remove the entry of key if exists.
+func (c *pathCache) Remove(key string) {
+	if c == nil {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.gen++
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// Purge removes all entries. It is called when a device or host changes status
+// because entries holding its replicas cannot be found without a scan.
+func (c *pathCache) Purge() {
+	if c == nil {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.gen++
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+func (c *pathCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.ll.Len()
+}
+
+func (c *pathCache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*pathCacheEntry).key)
+}
+
+// subnetCache holds subnets used for ordering replicas, so that reads served from path cache do not query database.
+// It is purged on topology changes made through this tracker and expires after ttl for changes made elsewhere.
+type subnetCache struct {
+	ttl time.Duration
+
+	m         sync.Mutex
+	subnets   []subnet
+	expiresAt time.Time
+	// gen is incremented on each Purge. Subnets loaded before a purge are not stored.
+	gen uint64
+}
+
+func newSubnetCache(ttl time.Duration) *subnetCache {
+	return &subnetCache{ttl: ttl}
+}
+
+// Get returns cached subnets, or subnets returned by load if cache is expired.
+func (c *subnetCache) Get(load func() ([]subnet, error)) ([]subnet, error) {
+	c.m.Lock()
+	if time.Now().Before(c.expiresAt) {
+		subnets := c.subnets
+		c.m.Unlock()
+		return subnets, nil
+	}
+	gen := c.gen
+	c.m.Unlock()
+	subnets, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if gen == c.gen {
+		c.subnets = subnets
+		c.expiresAt = time.Now().Add(c.ttl)
+	}
+	return subnets, nil
+}
+
+func (c *subnetCache) Purge() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.gen++
+	c.subnets = nil
+	c.expiresAt = time.Time{}
+}
+
+// pathCacheInvalidator listens events published by other trackers and drainers and
+// removes changed keys from cache.
+func (t *Tracker) pathCacheInvalidator() {
+	defer close(t.pathCacheInvalidatorStopped)
+	if t.paths == nil || t.config.AMQP.EventExchange == "" {
+		return
+	}
+	t.log.Notice("Starting path cache invalidator...")
+	for {
+		select {
+		case <-t.shutdown:
+			return
+		case conn, ok := <-t.amqp.Conn():
+			if !ok {
+				t.log.Error("Cannot consume events. AMQP connection is not open.")
+				time.Sleep(time.Second)
+				continue
+			}
+			// Events may have been missed while disconnected.
+			t.paths.Purge()
+			err := t.consumeCacheEvents(conn)
+			if err != nil {
+				t.log.Errorln("error while consuming events for path cache:", err.Error())
+			}
+		}
+	}
+}
+
+func (t *Tracker) consumeCacheEvents(conn *amqp.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	err = declareEventExchange(ch, t.config.AMQP.EventExchange)
+	if err != nil {
+		return err
+	}
+	q, err := ch.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return err
+	}
+	for _, routingKey := range []string{"file.*", "device.*", "host.*"} {
+		err = ch.QueueBind(q.Name, routingKey, t.config.AMQP.EventExchange, false, nil)
+		if err != nil {
+			return err
+		}
+	}
+	messages, err := ch.Consume(
+		q.Name, // queue
+		"",     // consumer
+		true,   // auto-ack
+		true,   // exclusive
+		false,  // no-local
+		false,  // no-wait
+		nil,    // args
+	)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-t.shutdown:
+			return nil
+		case msg, ok := <-messages:
+			if !ok {
+				return amqp.ErrClosed
+			}
+			if !strings.HasPrefix(msg.RoutingKey, "file.") {
+				t.paths.Purge()
+				continue
+			}
+			var e FileEvent
+			err = json.Unmarshal(msg.Body, &e)
+			if err != nil {
+				t.log.Errorln("cannot unmarshal event:", err.Error())
+				continue
+			}
+			t.paths.Remove(e.Key)
+		}
+	}
+}
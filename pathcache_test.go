@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPathCache(t *testing.T) {
+	c := newPathCache(2, time.Minute)
+	c.Add("foo", []replica{{devid: 1}}, c.Generation())
+	c.Add("bar", []replica{{devid: 2}}, c.Generation())
+	if _, ok := c.Get("foo"); !ok {
+		t.Fatal("foo is not in cache")
+	}
+	// bar is the least recently used entry now.
+	c.Add("baz", []replica{{devid: 3}}, c.Generation())
+	if _, ok := c.Get("bar"); ok {
+		t.Fatal("bar must be evicted")
+	}
+	replicas, ok := c.Get("foo")
+	if !ok || replicas[0].devid != 1 {
+		t.Fatalf("unexpected entry for foo: %v", replicas)
+	}
+
+	c.Remove("foo")
+	if _, ok = c.Get("foo"); ok {
+		t.Fatal("foo must be removed")
+	}
+	// Entry read before a remove is not added.
+	gen := c.Generation()
+	c.Remove("foo")
+	c.Add("foo", []replica{{devid: 1}}, gen)
+	if _, ok = c.Get("foo"); ok {
+		t.Fatal("stale entry must not be added")
+	}
+	c.Purge()
+	if c.Len() != 0 {
+		t.Fatalf("cache is not empty after purge: %d", c.Len())
+	}
+
+	c = newPathCache(2, -time.Second)
+	c.Add("foo", []replica{{devid: 1}}, c.Generation())
+	if _, ok = c.Get("foo"); ok {
+		t.Fatal("expired entry must not be returned")
+	}
+	if c.Len() != 0 {
+		t.Fatal("expired entry must be removed")
+	}
+
+	// Disabled cache is a nil pointer.
+	c = newPathCache(0, time.Minute)
+	c.Add("foo", []replica{{devid: 1}}, c.Generation())
+	if _, ok = c.Get("foo"); ok {
+		t.Fatal("disabled cache must not return entries")
+	}
+}
+
+// racingMetadataStore calls onSelect after replicas are read from database, before they are added to cache.
+type racingMetadataStore struct {
+	metadataStore
+	onSelect func()
+}
+
+func (s racingMetadataStore) selectReplicas(ctx context.Context, key string) ([]replica, error) {
+	replicas, err := s.metadataStore.selectReplicas(ctx, key)
+	s.onSelect()
+	return replicas, err
+}
+
+func TestPathCacheRemoveDuringLookup(t *testing.T) {
+	cfg := *testConfig
+	cfg.Tracker.PathCacheSize = 10
+	tr, err := NewTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.db.Close()
+	cleanDB(t, tr.db)
+	insertHost(t, tr)
+	_, err = tr.db.Exec("insert into device(devid, status, hostid) values(1, 'alive', 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertToDB(t, tr.db, 1, 1, "foo")
+
+	// File is deleted and removed from cache while replicas read before the delete are on the way to cache.
+	tr.meta = racingMetadataStore{metadataStore: tr.meta, onSelect: func() { tr.paths.Remove("foo") }}
+	replicas, err := tr.getReplicas(context.Background(), "foo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replicas) != 1 {
+		t.Fatalf("unexpected replicas: %v", replicas)
+	}
+	if _, ok := tr.paths.Get("foo"); ok {
+		t.Fatal("replicas read before remove must not be cached")
+	}
+
+	// Replicas are cached when nothing is removed during the lookup.
+	tr.meta = tr.meta.(racingMetadataStore).metadataStore
+	_, err = tr.getReplicas(context.Background(), "foo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tr.paths.Get("foo"); !ok {
+		t.Fatal("replicas must be cached")
+	}
+}
+
+func TestSubnetCache(t *testing.T) {
+	c := newSubnetCache(time.Minute)
+	var loads int
+	load := func() ([]subnet, error) {
+		loads++
+		return []subnet{{subnetid: int64(loads)}}, nil
+	}
+	for i := 0; i < 2; i++ {
+		subnets, err := c.Get(load)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(subnets) != 1 || subnets[0].subnetid != 1 {
+			t.Fatalf("unexpected subnets: %v", subnets)
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("subnets are loaded %d times", loads)
+	}
+
+	// Subnets loaded before a purge are returned but not cached.
+	c.Purge()
+	_, err := c.Get(func() ([]subnet, error) {
+		c.Purge()
+		return load()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnets, err := c.Get(load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loads != 3 || subnets[0].subnetid != 3 {
+		t.Fatalf("subnets loaded before purge must not be cached: %v", subnets)
+	}
+}
+
+func TestSortReplicas(t *testing.T) {
+	subnets := []subnet{
+		{rackid: 1, zoneid: 1, subnet: "10.0.1.0/24"},
+		{rackid: 2, zoneid: 1, subnet: "10.0.2.0/24"},
+		{rackid: 3, zoneid: 2, subnet: "10.0.3.0/24"},
+	}
+	util := func(v int64) sql.NullInt64 { return sql.NullInt64{Int64: v, Valid: true} }
+	replicas := []replica{
+		{devid: 1, hostip: "10.0.3.1", rackid: 3, zoneid: 2, ioUtilization: util(0)},
+		{devid: 2, hostip: "10.0.2.1", rackid: 2, zoneid: 1},
+		{devid: 3, hostip: "10.0.2.2", rackid: 2, zoneid: 1, ioUtilization: util(50)},
+		{devid: 4, hostip: "10.0.2.3", rackid: 2, zoneid: 1, ioUtilization: util(10)},
+		{devid: 5, hostip: "10.0.1.2", rackid: 1, zoneid: 1, ioUtilization: util(90)},
+		{devid: 6, hostip: "10.0.1.1", rackid: 1, zoneid: 1, ioUtilization: util(99)},
+	}
+	sorted := sortReplicas(replicas, "10.0.1.1", subnets)
+	var devids []int64
+	for _, rp := range sorted {
+		devids = append(devids, rp.devid)
+	}
+	expected := []int64{6, 5, 4, 3, 2, 1}
+	if !reflect.DeepEqual(devids, expected) {
+		t.Fatalf("unexpected order: %v, expected: %v", devids, expected)
+	}
+	if replicas[0].devid != 1 {
+		t.Fatal("input must not be modified")
+	}
+
+	// Unknown client is ordered by utilization only.
+	sorted = sortReplicas(replicas, "192.168.1.1", subnets)
+	if sorted[0].devid != 1 || sorted[len(sorted)-1].devid != 2 {
+		t.Fatalf("unexpected order for unknown client: %v", sorted)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib" // for database/sql driver
+)
+
+type postgresDialect struct{}
+
+func openPostgres(dsn string) (*store, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &store{db: db, dialect: postgresDialect{}}, nil
+}
+
+func (postgresDialect) driverName() string {
+	return "postgres"
+}
+
+// bind replaces "?" placeholders with numbered placeholders of PostgreSQL.
+// Question marks in string literals are left as they are.
+func (postgresDialect) bind(query string, args []interface{}) (string, []interface{}) {
+	if !strings.Contains(query, "?") {
+		return query, args
+	}
+	var sb strings.Builder
+	sb.Grow(len(query) + len(args))
+	n := 0
+	inString := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			inString = !inString
+		case c == '?' && !inString:
+			n++
+			sb.WriteByte('$')
+			sb.WriteString(strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String(), args
+}
+
+func (postgresDialect) forUpdate() string {
+	return " for update"
+}
+
+func (postgresDialect) forUpdateSkipLocked() string {
+	return " for update skip locked"
+}
+
+func (postgresDialect) secondsSince(expr string) string {
+	return "cast(floor(extract(epoch from current_timestamp - " + expr + ")) as bigint)"
+}
+
+func (postgresDialect) addSeconds(expr, seconds string) string {
+	return "(" + expr + " + cast(" + seconds + " as bigint) * interval '1 second')"
+}
+
+func (postgresDialect) unixTimestamp(expr string) string {
+	return "cast(floor(extract(epoch from " + expr + ")) as bigint)"
+}
+
+func (postgresDialect) fromUnixtime(expr string) string {
+	return "to_timestamp(" + expr + ")"
+}
+
+func (postgresDialect) groupConcat(expr string) string {
+	return "string_agg(cast(" + expr + " as text), ',' order by " + expr + ")"
+}
+
+func (postgresDialect) returning(column string) string {
+	return " returning " + column
+}
+
+func (postgresDialect) tableExists() string {
+	return "select count(*) from information_schema.tables where table_schema=current_schema() and table_name=?"
+}
+
+func (postgresDialect) advanceSequence(table, column string, next int64) []string {
+	seq := "pg_get_serial_sequence('" + table + "', '" + column + "')"
+	return []string{"select setval(" + seq + ", greatest(" + strconv.FormatInt(next, 10) + ", nextval(" + seq + ")), false)"}
+}
+
+func (postgresDialect) conflict(err error) (string, bool) {
+	var perr *pgconn.PgError
+	// unique_violation or foreign_key_violation
+	if errors.As(err, &perr) && (perr.Code == "23505" || perr.Code == "23503") {
+		return perr.Message, true
+	}
+	return "", false
+}
+
+type postgresMetadataStore struct {
+	sqlMetadataStore
+}
+
+// replaceFile updates the existing row of key in place because PostgreSQL has no REPLACE statement.
+// See mysqlMetadataStore for why the existing file may still be there.
+func (s postgresMetadataStore) replaceFile(tx *storeTx, fid int64, key string, size sql.NullInt64, devid int64) error {
+	_, err := tx.Exec("insert into file(fid, dkey, size, created_at) values(?, ?, ?, current_timestamp) "+
+		"on conflict (dkey) do update set fid=excluded.fid, size=excluded.size, created_at=excluded.created_at", fid, key, size)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into file_on(fid, devid) values(?, ?)", fid, devid)
+	return err
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestPostgresBind(t *testing.T) {
+	cases := []struct {
+		query, expected string
+	}{
+		{"select 1", "select 1"},
+		{"select fid from file where dkey=? and fid > ?", "select fid from file where dkey=$1 and fid > $2"},
+		{"select '?', 'it''s ?' from file where fid=?", "select '?', 'it''s ?' from file where fid=$1"},
+	}
+	for _, c := range cases {
+		query, _ := postgresDialect{}.bind(c.query, nil)
+		if query != c.expected {
+			t.Errorf("unexpected query for %q: %q", c.query, query)
+		}
+	}
+}
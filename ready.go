@@ -25,11 +25,17 @@ func readyMysql(cfg DatabaseConfig, timeout time.Duration, exec string) error {
 				continue
 			}
 			if exec != "" {
+				// Statement may fail until tracker applies migrations.
 				_, err = db.Exec(exec)
-				return err
+				if err != nil {
+					continue
+				}
 			}
 			return nil
 		case <-timeoutC:
+			if err != nil {
+				return fmt.Errorf("mysql did not become ready in %s: %w", timeout, err)
+			}
 			return fmt.Errorf("mysql did not become ready in %s", timeout)
 		}
 	}
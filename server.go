@@ -15,46 +15,53 @@ import (
 
 	"github.com/cenkalti/log"
 	"github.com/cenkalti/redialer/amqpredialer"
-	"github.com/getsentry/sentry-go"
 	sentryhttp "github.com/getsentry/sentry-go/http"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/shirou/gopsutil/v4/disk"
 )
 
 // Server runs on storage servers.
+// A single Server serves all devices of a host and routes requests by the "/dev<devid>" prefix of path.
 type Server struct {
-	config               *Config
-	db                   *sql.DB
+	config              *Config
+	db                  *store
+	meta                metadataStore
+	log                 log.Logger
+	readServer          http.Server
+	writeServer         http.Server
+	metricsServer       http.Server
+	amqp                *amqpredialer.AMQPRedialer
+	deletes             deleteQueue
+	workers             *workerMonitor
+	devices             []*serverDevice
+	hostname            string
+	shutdown            chan struct{}
+	Ready               chan struct{}
+	amqpRedialerStopped chan struct{}
+}
+
+// serverDevice runs the background jobs of a device served by Server.
+type serverDevice struct {
+	*Server
+	devid                int64
+	dir                  string
 	log                  log.Logger
-	readServer           http.Server
-	writeServer          http.Server
-	metricsServer        http.Server
-	amqp                 *amqpredialer.AMQPRedialer
 	onceDiskStatsUpdated sync.Once
-	devid                int64
-	hostname             string
-	shutdown             chan struct{}
-	Ready                chan struct{}
 	diskStatsUpdated     chan struct{}
 	diskStatsStopped     chan struct{}
 	diskCleanStopped     chan struct{}
 	deviceCleanStopped   chan struct{}
-	amqpRedialerStopped  chan struct{}
 }
 
 // NewServer returns a new Server instance.
 func NewServer(c *Config) (*Server, error) {
-	fi, err := os.Stat(c.Server.DataDir)
+	dirs, err := c.Server.dataDirs()
 	if err != nil {
 		return nil, err
 	}
-	if !fi.IsDir() {
-		return nil, fmt.Errorf("path must be a directory: %s", c.Server.DataDir)
-	}
-	devid, err := strconv.ParseInt(strings.TrimPrefix(filepath.Base(c.Server.DataDir), "dev"), 10, 32)
+	proxies, err := parseTrustedProxies(c.Auth.TrustedProxies)
 	if err != nil {
-		return nil, fmt.Errorf("cannot determine device ID from dir: %s", c.Server.DataDir)
+		return nil, err
 	}
 	db, err := openDatabase(c.Database)
 	if err != nil {
@@ -67,44 +74,153 @@ func NewServer(c *Config) (*Server, error) {
 	}
 	s := &Server{
 		config:              c,
-		devid:               devid,
 		db:                  db,
+		meta:                newMetadataStore(db),
 		log:                 logger,
 		hostname:            hostname,
 		shutdown:            make(chan struct{}),
 		Ready:               make(chan struct{}),
-		diskStatsUpdated:    make(chan struct{}),
-		diskStatsStopped:    make(chan struct{}),
-		diskCleanStopped:    make(chan struct{}),
-		deviceCleanStopped:  make(chan struct{}),
 		amqpRedialerStopped: make(chan struct{}),
+		workers:             newWorkerMonitor(),
+	}
+	if s.config.Debug {
+		s.log.SetLevel(log.DEBUG)
+	}
+	dirOfDevice := make(map[int64]string)
+	for _, dir := range dirs {
+		d, err := newServerDevice(s, dir)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := dirOfDevice[d.devid]; ok {
+			return nil, fmt.Errorf("device %d is in both %s and %s", d.devid, other, dir)
+		}
+		dirOfDevice[d.devid] = dir
+		s.devices = append(s.devices, d)
 	}
 	sentryHandler := sentryhttp.New(sentryhttp.Options{
 		Repanic:         false,
 		WaitForDelivery: true,
 	})
+	auth := &authenticator{
+		enabled: c.Auth.Enabled,
+		db:      s.db,
+		log:     s.log,
+	}
+	writeMux := http.NewServeMux()
+	readMux := http.NewServeMux()
+	for _, d := range s.devices {
+		devicePrefix := "/dev" + d.devidLabel()
+		writeMux.Handle(devicePrefix+"/", http.StripPrefix(devicePrefix, auth.require(scopeWrite, instrumentWriteServer(d.devidLabel(), newFileReceiver(d.dir, d.log, s.meta)))))
+		readMux.Handle(devicePrefix+"/", http.StripPrefix(devicePrefix, instrumentReadServer(d.devidLabel(), http.FileServer(http.Dir(d.dir)))))
+	}
+
 	// write server
-	devicePrefix := "/" + filepath.Base(s.config.Server.DataDir)
-	s.writeServer.Handler = http.StripPrefix(devicePrefix, newFileReceiver(s.config.Server.DataDir, s.log, s.db))
-	s.writeServer.Handler = http.HandlerFunc(sentryHandler.HandleFunc(addVersion(s.writeServer.Handler)))
+	s.writeServer.Handler = http.HandlerFunc(sentryHandler.HandleFunc(addVersion(writeMux)))
 
 	// read server
-	s.readServer.Handler = http.StripPrefix(devicePrefix, http.FileServer(http.Dir(s.config.Server.DataDir)))
+	s.readServer.Handler = readMux
+	if c.Auth.ReadURLSecret != "" {
+		s.readServer.Handler = requireSignedURL(c.Auth.ReadURLSecret, proxies, s.log, s.readServer.Handler)
+	}
 
 	// metrics server
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
 	s.metricsServer.Handler = mux
-	if s.config.Debug {
-		s.log.SetLevel(log.DEBUG)
+	if c.Tasks.usesAMQP() {
+		s.amqp, err = amqpredialer.New(c.AMQP.URL)
+		if err != nil {
+			return nil, err
+		}
 	}
-	s.amqp, err = amqpredialer.New(c.AMQP.URL)
+	s.deletes, err = newDeleteQueue(c.Tasks, s.db, s.amqp, s.workers, s.log, s.shutdown)
 	if err != nil {
 		return nil, err
 	}
+	for _, d := range s.devices {
+		s.workers.register(d.worker("disk-stats"), time.Minute)
+		s.workers.register(d.worker("disk-cleaner"), 3*time.Minute)
+		s.workers.register(d.worker("device-cleaner"), 3*time.Minute)
+		s.workers.register(d.worker("delete-consumer"), 3*time.Minute)
+	}
 	return s, nil
 }
 
+// devidOfDir returns the device ID of dir. dir must be a directory named "dev<devid>".
+func devidOfDir(dir string) (int64, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return 0, err
+	}
+	if !fi.IsDir() {
+		return 0, fmt.Errorf("path must be a directory: %s", dir)
+	}
+	devid, err := strconv.ParseInt(strings.TrimPrefix(filepath.Base(dir), "dev"), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("cannot determine device ID from dir: %s", dir)
+	}
+	return devid, nil
+}
+
+// newServerDevice returns the device in dir. Name of dir must be "dev<devid>".
+func newServerDevice(s *Server, dir string) (*serverDevice, error) {
+	devid, err := devidOfDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	logger := log.NewLogger("server/dev" + strconv.FormatInt(devid, 10))
+	if s.config.Debug {
+		logger.SetLevel(log.DEBUG)
+	}
+	return &serverDevice{
+		Server:             s,
+		devid:              devid,
+		dir:                dir,
+		log:                logger,
+		diskStatsUpdated:   make(chan struct{}),
+		diskStatsStopped:   make(chan struct{}),
+		diskCleanStopped:   make(chan struct{}),
+		deviceCleanStopped: make(chan struct{}),
+	}, nil
+}
+
+// devidLabel is the value of devid label in metrics.
+func (d *serverDevice) devidLabel() string {
+	return strconv.FormatInt(d.devid, 10)
+}
+
+// worker returns the name of a background worker of device in health report.
+// Names have "/devN" suffix only if the server has multiple devices,
+// so that checks of servers with a single device keep working.
+func (d *serverDevice) worker(name string) string {
+	if len(d.devices) == 1 {
+		return name
+	}
+	return name + "/dev" + strconv.FormatInt(d.devid, 10)
+}
+
+// healthz reports whether background workers are running.
+// Last seen time of "disk-stats" worker of a device is the time of last successful disk stats update of device.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	h := newHealthReport()
+	s.workers.check(h)
+	h.write(w)
+}
+
+// readyz reports whether server can serve requests.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	h := newHealthReport()
+	h.add("ready", checkReady(s.Ready))
+	h.add("database", checkDatabase(r.Context(), s.db))
+	if s.amqp != nil {
+		h.add("amqp", checkAMQP(s.amqp))
+	}
+	h.write(w)
+}
+
 // Run this server in a blocking manner. Running server can be stopped with Shutdown().
 func (s *Server) Run() error {
 	writeListener, err := net.Listen("tcp", s.config.Server.ListenAddressForWrite)
@@ -120,10 +236,12 @@ func (s *Server) Run() error {
 		return err
 	}
 	s.log.Notice("Starting background tasks...")
-	go s.cleanDisk()
-	go s.cleanDevice()
-	go s.updateDiskStats()
-	go s.consumeDeleteQueue()
+	for _, d := range s.devices {
+		go d.cleanDisk()
+		go d.cleanDevice()
+		go d.updateDiskStats()
+		go d.consumeDeleteQueue()
+	}
 	errCh := make(chan error, 3)
 	go func() {
 		s.log.Noticef("Starting write server on %v", writeListener.Addr())
@@ -150,10 +268,14 @@ func (s *Server) Run() error {
 		errCh <- err2
 	}()
 
-	go func() {
-		s.amqp.Run()
+	if s.amqp != nil {
+		go func() {
+			s.amqp.Run()
+			close(s.amqpRedialerStopped)
+		}()
+	} else {
 		close(s.amqpRedialerStopped)
-	}()
+	}
 
 	go s.notifyReady()
 
@@ -165,13 +287,16 @@ func (s *Server) Run() error {
 	return nil
 }
 
+// notifyReady closes Ready after stats of all devices are updated.
 func (s *Server) notifyReady() {
-	select {
-	case <-s.shutdown:
-		return
-	case <-s.diskStatsUpdated:
-		close(s.Ready)
+	for _, d := range s.devices {
+		select {
+		case <-s.shutdown:
+			return
+		case <-d.diskStatsUpdated:
+		}
 	}
+	close(s.Ready)
 }
 
 // Shutdown the server.
@@ -199,52 +324,60 @@ func (s *Server) Shutdown() error {
 		return err
 	}
 
-	<-s.diskStatsStopped
-	<-s.diskCleanStopped
+	for _, d := range s.devices {
+		<-d.diskStatsStopped
+		<-d.diskCleanStopped
+	}
 
 	err = s.db.Close()
 	if err != nil {
 		s.log.Error("Error while closing database connection")
 		return err
 	}
-	err = s.amqp.Close()
-	if err != nil {
-		return err
+	if s.amqp != nil {
+		err = s.amqp.Close()
+		if err != nil {
+			return err
+		}
 	}
 	<-s.amqpRedialerStopped
 	return nil
 }
 
-func (s *Server) updateDiskStats() {
-	s.log.Notice("Starting disk stats updater...")
+func (d *serverDevice) updateDiskStats() {
+	d.log.Notice("Starting disk stats updater...")
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
-	iostat, err := newIOStat(s.config.Server.DataDir, 10*time.Second)
+	iostat, err := newIOStat(d.dir, 10*time.Second)
 	if err != nil {
-		s.log.Warningln("Cannot get stats for dir:", s.config.Server.DataDir, "err:", err.Error())
+		d.log.Warningln("Cannot get stats for dir:", d.dir, "err:", err.Error())
 	}
 	for {
 		select {
 		case <-ticker.C:
-			total, used, free := s.getDiskUsage()
-			utilization := s.getDiskUtilization(iostat)
-			_, err = s.db.Exec("update device set io_utilization=?, bytes_total=?, bytes_used=?, bytes_free=?, updated_at=current_timestamp where devid=?", utilization, total, used, free, s.devid)
-			s.onceDiskStatsUpdated.Do(func() { close(s.diskStatsUpdated) })
+			total, used, free := d.getDiskUsage()
+			utilization := d.getDiskUtilization(iostat)
+			err = d.meta.updateDiskStats(d.devid, utilization, total, used, free)
+			d.onceDiskStatsUpdated.Do(func() { close(d.diskStatsUpdated) })
 			if err != nil {
-				s.log.Errorln("Cannot update device stats:", err.Error())
+				d.log.Errorln("Cannot update device stats:", err.Error())
 				continue
 			}
-		case <-s.shutdown:
-			close(s.diskStatsStopped)
+			d.workers.beat(d.worker("disk-stats"))
+			if utilization.Valid {
+				diskIOUtilization.WithLabelValues(d.devidLabel()).Set(float64(utilization.Int64))
+			}
+		case <-d.shutdown:
+			close(d.diskStatsStopped)
 			return
 		}
 	}
 }
 
-func (s *Server) getDiskUsage() (total, used, free sql.NullInt64) {
-	usage, err := disk.Usage(s.config.Server.DataDir)
+func (d *serverDevice) getDiskUsage() (total, used, free sql.NullInt64) {
+	usage, err := disk.Usage(d.dir)
 	if err != nil {
-		s.log.Errorln("Cannot get disk usage:", err.Error())
+		d.log.Errorln("Cannot get disk usage:", err.Error())
 		return
 	}
 	total.Valid = true
@@ -256,7 +389,7 @@ func (s *Server) getDiskUsage() (total, used, free sql.NullInt64) {
 	return
 }
 
-func (s *Server) getDiskUtilization(iostat *IOStat) (utilization sql.NullInt64) {
+func (d *serverDevice) getDiskUtilization(iostat *IOStat) (utilization sql.NullInt64) {
 	if iostat == nil {
 		return
 	}
@@ -264,7 +397,7 @@ func (s *Server) getDiskUtilization(iostat *IOStat) (utilization sql.NullInt64)
 	if err == errUtilizationNotAvailable {
 		return
 	} else if err != nil {
-		s.log.Errorln("Cannot get disk IO utilization:", err.Error())
+		d.log.Errorln("Cannot get disk IO utilization:", err.Error())
 		return
 	}
 	utilization.Valid = true
@@ -272,112 +405,34 @@ func (s *Server) getDiskUtilization(iostat *IOStat) (utilization sql.NullInt64)
 	return
 }
 
-func declareDeleteQueue(ch *amqp.Channel, devid int64) (amqp.Queue, error) {
-	return ch.QueueDeclare(
-		deleteQueueName(devid),
-		true,  // durable
-		false, // delete when unused
-		false, // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
-}
-
-func deleteQueueName(devid int64) string {
-	return "delete.dev" + strconv.FormatInt(devid, 10)
-}
-
-func (s *Server) consumeDeleteQueue() {
-	s.log.Info("Starting delete queue consumer...")
-	for {
-		select {
-		case <-s.shutdown:
-			return
-		case conn, ok := <-s.amqp.Conn():
-			if !ok {
-				s.log.Error("Cannot consume delete queue. AMQP connection is not open.")
-				time.Sleep(time.Second)
-				continue
-			}
-			err := s.processDeleteTasks(conn)
-			if err != nil {
-				s.log.Error("Error while processing delete task", err)
-				sentry.CaptureException(err)
-			}
-		}
-	}
+func (d *serverDevice) consumeDeleteQueue() {
+	d.log.Info("Starting delete queue consumer...")
+	d.deletes.consume(d.devid, d.worker("delete-consumer"), d.processDeleteTask)
 }
 
-func (s *Server) processDeleteTasks(conn *amqp.Connection) error {
-	ch, err := conn.Channel()
+func (d *serverDevice) processDeleteTask(fid int64) error {
+	err := d.deleteFidOnDisk(fid)
 	if err != nil {
+		d.log.Errorf("Failed to delete fid %d, %s", fid, err)
+		deleteTasksFailed.WithLabelValues(d.devidLabel()).Inc()
 		return err
 	}
-
-	q, err := declareDeleteQueue(ch, s.devid)
-	if err != nil {
-		return err
-	}
-
-	pid := os.Getpid()
-	consumerTag := "efes-delete-worker:" + strconv.Itoa(pid) + "@" + s.hostname + "/" + strconv.FormatInt(s.devid, 10)
-	messages, err := ch.Consume(
-		q.Name,      // queue
-		consumerTag, // consumer
-		false,       // auto-ack
-		false,       // exclusive
-		false,       // no-local
-		false,       // no-wait
-		nil,         // args
-	)
-	if err != nil {
-		return err
-	}
-	for {
-		select {
-		case <-s.shutdown:
-			return nil
-		case msg, ok := <-messages:
-			if !ok {
-				return amqp.ErrClosed
-			}
-			msgBody := string(msg.Body)
-			fileID, err := strconv.ParseInt(msgBody, 10, 64)
-			if err != nil {
-				s.log.Error("Error while parsing int", err)
-				continue
-			}
-			err = s.deleteFidOnDisk(fileID)
-			if err != nil {
-				s.log.Errorf("Failed to delete fid %d, %s", fileID, err)
-				err2 := msg.Nack(false, false)
-				if err2 != nil {
-					s.log.Errorf("NACK error: %s", err2)
-					return err2
-				}
-				continue
-			}
-			err = msg.Ack(false)
-			if err != nil {
-				s.log.Errorf("ACK error: %s", err)
-				return err
-			}
-		}
-	}
+	deleteTasksProcessed.WithLabelValues(d.devidLabel()).Inc()
+	return nil
 }
 
-func (s *Server) deleteFidOnDisk(fileID int64) error {
-	s.log.Info("Deleting fid on disk ", fileID)
-	path := filepath.Join(s.config.Server.DataDir, vivify(fileID))
+func (d *serverDevice) deleteFidOnDisk(fileID int64) error {
+	d.log.Info("Deleting fid on disk ", fileID)
+	path := filepath.Join(d.dir, vivify(fileID))
 	err := os.Remove(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			s.log.Infof("Fid path does not exist %s. ", path)
+			d.log.Infof("Fid path does not exist %s. ", path)
 			return nil
 		}
 		return err
 	}
-	s.log.Infof("Fid %d deleted. ", fileID)
+	d.log.Infof("Fid %d deleted. ", fileID)
 	return nil
 }
 
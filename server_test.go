@@ -1,14 +1,15 @@
 package main
 
 import (
-	"database/sql"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
 )
 
-func setupServer(t *testing.T, ttl time.Duration) (s *Server, closeFunc func()) {
+func setupServer(t *testing.T, ttl time.Duration) (s *serverDevice, closeFunc func()) {
 	t.Helper()
 
 	tempDir, err := os.MkdirTemp("", "efes-test-")
@@ -25,10 +26,11 @@ func setupServer(t *testing.T, ttl time.Duration) (s *Server, closeFunc func())
 	c2.Server.DataDir = devPath
 	c2.Server.CleanDiskFileTTL = Duration(ttl)
 
-	s, err = NewServer(&c2)
+	srv, err := NewServer(&c2)
 	if err != nil {
 		t.Fatal(err)
 	}
+	s = srv.devices[0]
 
 	cleanDB(t, s.db)
 
@@ -56,7 +58,7 @@ func TestFidExistsOnDatabase(t *testing.T) {
 	defer rm()
 	insertToDB(t, s.db, 1, s.devid, "foo")
 
-	res, err := s.fidExistsOnDatabase(1)
+	res, err := s.meta.fidExistsOnDevice(s.devid, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -72,7 +74,7 @@ func TestShouldDeleteFileExistsOnDbNewOnDisk(t *testing.T) {
 	insertToDB(t, s.db, 2, s.devid, "foo")
 	fidPath := writeToDisk(t, s, 2, "fid", time.Now().Add(-200*time.Second))
 
-	err := filepath.Walk(s.config.Server.DataDir, s.visitFile)
+	err := filepath.Walk(s.dir, s.visitFile)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -83,7 +85,7 @@ func TestShouldDeleteFileExistsOnDbNewOnDisk(t *testing.T) {
 	}
 }
 
-func insertToDB(t *testing.T, db *sql.DB, fid, devid int64, key string) {
+func insertToDB(t *testing.T, db *store, fid, devid int64, key string) {
 	t.Helper()
 	_, err := db.Exec("insert into file(fid, dkey) values(?, ?)", fid, key)
 	if err != nil {
@@ -95,7 +97,7 @@ func insertToDB(t *testing.T, db *sql.DB, fid, devid int64, key string) {
 	}
 }
 
-func existOnDB(t *testing.T, db *sql.DB, fid, devid int64) bool {
+func existOnDB(t *testing.T, db *store, fid, devid int64) bool {
 	var exists bool
 	err := db.QueryRow("select exists(select 1 from file_on where devid=? and fid=?)", devid, fid).Scan(&exists)
 	if err != nil {
@@ -104,9 +106,9 @@ func existOnDB(t *testing.T, db *sql.DB, fid, devid int64) bool {
 	return exists
 }
 
-func writeToDisk(t *testing.T, s *Server, fid int64, ext string, modTime time.Time) string {
+func writeToDisk(t *testing.T, s *serverDevice, fid int64, ext string, modTime time.Time) string {
 	t.Helper()
-	fidPath := filepath.Join(s.config.Server.DataDir, vivifyExt(fid, ext))
+	fidPath := filepath.Join(s.dir, vivifyExt(fid, ext))
 	dirPath, _ := filepath.Split(fidPath)
 	err := os.MkdirAll(dirPath, 0700)
 	if err != nil {
@@ -134,7 +136,7 @@ func TestShouldDeleteFileExistsOnDbOldOnDisk(t *testing.T) {
 	insertToDB(t, s.db, 1, s.devid, "foo")
 	fidPath := writeToDisk(t, s, 1, "fid", time.Now().Add(-400*time.Second))
 
-	err := filepath.Walk(s.config.Server.DataDir, s.visitFile)
+	err := filepath.Walk(s.dir, s.visitFile)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -151,7 +153,7 @@ func TestShouldDeleteFileNotExistsOnDbNewOnDisk(t *testing.T) {
 
 	fidPath := writeToDisk(t, s, 1, "fid", time.Now().Add(-200*time.Second))
 
-	err := filepath.Walk(s.config.Server.DataDir, s.visitFile)
+	err := filepath.Walk(s.dir, s.visitFile)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -168,7 +170,7 @@ func TestShouldDeleteFileNotExistsOnDbOldOnDisk(t *testing.T) {
 
 	fidPath := writeToDisk(t, s, 1, "fid", time.Now().Add(-400*time.Second))
 
-	err := filepath.Walk(s.config.Server.DataDir, s.visitFile)
+	err := filepath.Walk(s.dir, s.visitFile)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -183,13 +185,13 @@ func TestShouldDeleteDir(t *testing.T) {
 	s, rm := setupServer(t, 300*time.Second)
 	defer rm()
 
-	dirPath := filepath.Join(s.config.Server.DataDir, "1234")
+	dirPath := filepath.Join(s.dir, "1234")
 	err := os.Mkdir(dirPath, 0700)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = filepath.Walk(s.config.Server.DataDir, s.visitFile)
+	err = filepath.Walk(s.dir, s.visitFile)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -206,7 +208,7 @@ func TestShouldDeleteJunkOld(t *testing.T) {
 
 	fidPath := writeToDisk(t, s, 1, "notfid", time.Now().Add(-400*time.Second))
 
-	err := filepath.Walk(s.config.Server.DataDir, s.visitFile)
+	err := filepath.Walk(s.dir, s.visitFile)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -223,7 +225,7 @@ func TestShouldDeleteJunkNew(t *testing.T) {
 
 	fidPath := writeToDisk(t, s, 1, "notfid", time.Now().Add(-200*time.Second))
 
-	err := filepath.Walk(s.config.Server.DataDir, s.visitFile)
+	err := filepath.Walk(s.dir, s.visitFile)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -249,7 +251,7 @@ func TestCleanDiskDryRunEnabled(t *testing.T) {
 	}
 
 	// start cleaning
-	err = filepath.Walk(s.config.Server.DataDir, s.visitFile)
+	err = filepath.Walk(s.dir, s.visitFile)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -265,7 +267,7 @@ func TestDeleteFidOnDisk(t *testing.T) {
 	defer rm()
 
 	var fid int64 = 123
-	path := filepath.Join(s.config.Server.DataDir, vivify(fid))
+	path := filepath.Join(s.dir, vivify(fid))
 	dirPath, _ := filepath.Split(path)
 	err := os.MkdirAll(dirPath, 0700)
 	if err != nil {
@@ -356,3 +358,86 @@ func TestCleanDeviceShouldDeleteButDryRunEnabled(t *testing.T) {
 		t.Error("File must not be deleted from DB because of dry-run!")
 	}
 }
+
+func TestServerMultipleDevices(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "efes-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	for _, name := range []string{"dev2", "dev3"} {
+		err = os.Mkdir(filepath.Join(tempDir, name), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := *testConfig
+	// Overlapping entries do not add the same device twice.
+	c.Server.DataDirs = []string{filepath.Join(tempDir, "dev2"), filepath.Join(tempDir, "dev*")}
+	s, err := NewServer(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.devices) != 2 || s.devices[0].devid != 2 || s.devices[1].devid != 3 {
+		t.Fatalf("unexpected devices: %v", s.devices)
+	}
+	fidPath := writeToDisk(t, s.devices[1], 1, "fid", time.Now())
+	err = os.WriteFile(fidPath, []byte("foo"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		rr := httptest.NewRecorder()
+		s.readServer.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := get("/dev3/" + vivify(1))
+	if rr.Code != http.StatusOK || rr.Body.String() != "foo" {
+		t.Fatalf("unexpected response from dev3: %d %q", rr.Code, rr.Body.String())
+	}
+	for _, path := range []string{"/dev2/" + vivify(1), "/dev4/" + vivify(1)} {
+		if rr = get(path); rr.Code != http.StatusNotFound {
+			t.Fatalf("unexpected status for %s: %d", path, rr.Code)
+		}
+	}
+
+	if name := s.devices[1].worker("disk-stats"); name != "disk-stats/dev3" {
+		t.Fatalf("unexpected worker name: %s", name)
+	}
+
+	// Drainer needs the device if there are multiple devices.
+	_, _, err = c.Server.deviceDir(0)
+	if err == nil {
+		t.Fatal("device must be required with multiple datadirs")
+	}
+	devid, dir, err := c.Server.deviceDir(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if devid != 3 || dir != filepath.Join(tempDir, "dev3") {
+		t.Fatalf("unexpected device dir: %d %s", devid, dir)
+	}
+	_, _, err = c.Server.deviceDir(4)
+	if err == nil {
+		t.Fatal("device not in datadirs must be an error")
+	}
+
+	// Single device keeps worker names without device suffix.
+	c.Server.DataDirs = []string{filepath.Join(tempDir, "dev2")}
+	s, err = NewServer(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := s.devices[0].worker("disk-stats"); name != "disk-stats" {
+		t.Fatalf("unexpected worker name: %s", name)
+	}
+
+	c.Server.DataDirs = []string{filepath.Join(tempDir, "disk*")}
+	_, err = NewServer(&c)
+	if err == nil {
+		t.Fatal("pattern without matches must be an error")
+	}
+}
@@ -48,6 +48,11 @@ func (f *Sha1File) Seek(offset int64, whence int) (int64, error) {
 	return newPosition, nil
 }
 
+// Size returns the number of bytes included in the digest.
+func (f *Sha1File) Size() int64 {
+	return f.calculated
+}
+
 func (f *Sha1File) Sum(b []byte) []byte {
 	return f.digest.Sum(b)
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+var (
+	errMissingSignature = errors.New("missing signature")
+	errInvalidSignature = errors.New("invalid signature")
+	errURLExpired       = errors.New("url is expired")
+	errIPMismatch       = errors.New("client ip does not match")
+)
+
+// readURLSignature returns HMAC-SHA256 of the URL path, expiry time and optional client IP.
+func readURLSignature(secret, path string, expires int64, ip string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(path))                           // nolint: errcheck
+	mac.Write([]byte("\n"))                           // nolint: errcheck
+	mac.Write([]byte(strconv.FormatInt(expires, 10))) // nolint: errcheck
+	mac.Write([]byte("\n"))                           // nolint: errcheck
+	mac.Write([]byte(ip))                             // nolint: errcheck
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signReadURL returns query parameters that must be appended to the read URL.
+// If ip is not empty, the URL can only be used from that IP.
+func signReadURL(secret, path string, expires time.Time, ip string) url.Values {
+	e := expires.Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(e, 10))
+	if ip != "" {
+		q.Set("ip", ip)
+	}
+	q.Set("signature", readURLSignature(secret, path, e, ip))
+	return q
+}
+
+func verifyReadURL(secret string, proxies trustedProxies, r *http.Request, now time.Time) error {
+	q := r.URL.Query()
+	signature := q.Get("signature")
+	if signature == "" {
+		return errMissingSignature
+	}
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return errInvalidSignature
+	}
+	ip := q.Get("ip")
+	expected := readURLSignature(secret, r.URL.Path, expires, ip)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errInvalidSignature
+	}
+	if now.Unix() > expires {
+		return errURLExpired
+	}
+	if ip != "" && ip != proxies.clientHost(r) {
+		return errIPMismatch
+	}
+	return nil
+}
+
+// requireSignedURL wraps h so that only requests with a valid signature are served.
+func requireSignedURL(secret string, proxies trustedProxies, logger log.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := verifyReadURL(secret, proxies, r, time.Now())
+		if err != nil {
+			logger.Debugln("rejected read request:", r.URL.Path, err.Error())
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// getClientHost returns the IP address of the client without port.
+func getClientHost(req *http.Request) string {
+	ip := getClientIP(req)
+	host, _, err := net.SplitHostPort(ip)
+	if err != nil {
+		return ip
+	}
+	return host
+}
+
+// trustedProxies are the networks of proxies whose X-Forwarded-For header is trusted.
+type trustedProxies []*net.IPNet
+
+func parseTrustedProxies(addrs []string) (trustedProxies, error) {
+	proxies := make(trustedProxies, 0, len(addrs))
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address: %s", addr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy address: %s", addr)
+		}
+		proxies = append(proxies, ipnet)
+	}
+	return proxies, nil
+}
+
+func (p trustedProxies) contains(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range p {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientHost returns the IP address of the client without port.
+// It is the address of connection unless the connection is from a trusted proxy.
+// Then X-Forwarded-For is read from right to left and the first address that is not a trusted proxy is returned.
+func (p trustedProxies) clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !p.contains(host) {
+		return host
+	}
+	forwarded := strings.Split(r.Header.Get("x-forwarded-for"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		host = addr
+		if !p.contains(addr) {
+			break
+		}
+	}
+	return host
+}
+
+// readURL returns the URL for reading fid from the device.
+// The URL is signed if a secret is configured for read URLs.
+func (t *Tracker) readURL(r *http.Request, hostname string, port, devid, fid int64) string {
+	path := "/dev" + strconv.FormatInt(devid, 10) + "/" + vivify(fid)
+	u := url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(hostname, strconv.FormatInt(port, 10)),
+		Path:   path,
+	}
+	secret := t.config.Auth.ReadURLSecret
+	if secret != "" {
+		var ip string
+		if t.config.Auth.ReadURLBindIP {
+			ip = t.proxies.clientHost(r)
+		}
+		expires := time.Now().Add(time.Duration(t.config.Auth.ReadURLTTL))
+		u.RawQuery = signReadURL(secret, path, expires, ip).Encode()
+	}
+	return u.String()
+}
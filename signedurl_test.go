@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestVerifyReadURL(t *testing.T) {
+	const secret = "s3cret"
+	const path = "/dev2/0/000/000/0000000042.fid"
+	now := time.Unix(1510216046, 0)
+
+	newRequest := func(rawQuery, remoteAddr string) *http.Request {
+		req, err := http.NewRequest("GET", "http://foo:8500"+path+"?"+rawQuery, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = remoteAddr
+		return req
+	}
+
+	q := signReadURL(secret, path, now.Add(time.Minute), "")
+	err := verifyReadURL(secret, nil, newRequest(q.Encode(), "1.2.3.4:1234"), now)
+	if err != nil {
+		t.Errorf("valid signature is rejected: %s", err)
+	}
+	err = verifyReadURL(secret, nil, newRequest(q.Encode(), "1.2.3.4:1234"), now.Add(2*time.Minute))
+	if err != errURLExpired {
+		t.Errorf("expired url is not rejected: %v", err)
+	}
+	err = verifyReadURL("other", nil, newRequest(q.Encode(), "1.2.3.4:1234"), now)
+	if err != errInvalidSignature {
+		t.Errorf("invalid signature is not rejected: %v", err)
+	}
+	err = verifyReadURL(secret, nil, newRequest("", "1.2.3.4:1234"), now)
+	if err != errMissingSignature {
+		t.Errorf("missing signature is not rejected: %v", err)
+	}
+
+	q = signReadURL(secret, path, now.Add(time.Minute), "1.2.3.4")
+	err = verifyReadURL(secret, nil, newRequest(q.Encode(), "1.2.3.4:1234"), now)
+	if err != nil {
+		t.Errorf("valid signature is rejected: %s", err)
+	}
+	err = verifyReadURL(secret, nil, newRequest(q.Encode(), "5.6.7.8:1234"), now)
+	if err != errIPMismatch {
+		t.Errorf("different ip is not rejected: %v", err)
+	}
+	// Forwarded address is used only if the request comes from a trusted proxy.
+	req := newRequest(q.Encode(), "5.6.7.8:1234")
+	req.Header.Set("x-forwarded-for", "1.2.3.4")
+	err = verifyReadURL(secret, nil, req, now)
+	if err != errIPMismatch {
+		t.Errorf("forwarded ip from untrusted client is not rejected: %v", err)
+	}
+	proxies, err := parseTrustedProxies([]string{"5.6.7.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyReadURL(secret, proxies, req, now)
+	if err != nil {
+		t.Errorf("forwarded ip from trusted proxy is rejected: %s", err)
+	}
+	q.Set("ip", "5.6.7.8")
+	err = verifyReadURL(secret, nil, newRequest(q.Encode(), "5.6.7.8:1234"), now)
+	if err != errInvalidSignature {
+		t.Errorf("modified ip is not rejected: %v", err)
+	}
+}
+
+func TestTrustedProxiesClientHost(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		remoteAddr string
+		xff        string
+		expected   string
+	}{
+		{"1.2.3.4:1234", "", "1.2.3.4"},
+		{"1.2.3.4:1234", "5.6.7.8", "1.2.3.4"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "5.6.7.8", "5.6.7.8"},
+		{"10.0.0.1:1234", "9.9.9.9, 5.6.7.8, 192.168.1.1", "5.6.7.8"},
+		{"10.0.0.1:1234", "192.168.1.1", "192.168.1.1"},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest("GET", "http://foo:8500/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = c.remoteAddr
+		if c.xff != "" {
+			req.Header.Set("x-forwarded-for", c.xff)
+		}
+		if host := proxies.clientHost(req); host != c.expected {
+			t.Errorf("unexpected client of %s with x-forwarded-for %q: %s", c.remoteAddr, c.xff, host)
+		}
+	}
+	_, err = parseTrustedProxies([]string{"foo"})
+	if err == nil {
+		t.Error("invalid address is not rejected")
+	}
+}
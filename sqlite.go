@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Transactions take the write lock when they begin, so rows read in a transaction cannot be changed by others.
+// Writers wait for each other instead of failing with SQLITE_BUSY.
+const sqliteParams = "_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+
+// SQLite has no time type. Times are stored as text in UTC, in the same format as CURRENT_TIMESTAMP,
+// so that they can be compared with each other.
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+type sqliteDialect struct{}
+
+// openSqlite opens the database file at path. It is created if it does not exist.
+func openSqlite(path string) (*store, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("sqlite", path+sep+sqliteParams)
+	if err != nil {
+		return nil, err
+	}
+	return &store{db: db, dialect: sqliteDialect{}}, nil
+}
+
+func (sqliteDialect) driverName() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) bind(query string, args []interface{}) (string, []interface{}) {
+	converted := args
+	for i, arg := range args {
+		if t, ok := arg.(time.Time); ok {
+			if &converted[0] == &args[0] {
+				// Do not modify the slice of caller.
+				converted = append([]interface{}(nil), args...)
+			}
+			converted[i] = t.UTC().Format(sqliteTimeFormat)
+		}
+	}
+	return query, converted
+}
+
+// Rows cannot be locked in SQLite but every write transaction holds the database lock until it ends.
+func (sqliteDialect) forUpdate() string {
+	return ""
+}
+
+func (sqliteDialect) forUpdateSkipLocked() string {
+	return ""
+}
+
+func (sqliteDialect) secondsSince(expr string) string {
+	return "(unixepoch() - unixepoch(" + expr + "))"
+}
+
+func (sqliteDialect) addSeconds(expr, seconds string) string {
+	return "datetime(" + expr + ", " + seconds + " || ' seconds')"
+}
+
+func (sqliteDialect) unixTimestamp(expr string) string {
+	return "unixepoch(" + expr + ")"
+}
+
+func (sqliteDialect) fromUnixtime(expr string) string {
+	return "datetime(" + expr + ", 'unixepoch')"
+}
+
+func (sqliteDialect) groupConcat(expr string) string {
+	return "group_concat(" + expr + ", ',' order by " + expr + ")"
+}
+
+func (sqliteDialect) returning(column string) string {
+	return ""
+}
+
+func (sqliteDialect) tableExists() string {
+	return "select count(*) from sqlite_master where type='table' and name=?"
+}
+
+// Row of table is added to sqlite_sequence on first insert, so it may not exist yet.
+func (sqliteDialect) advanceSequence(table, column string, next int64) []string {
+	return []string{
+		"insert into sqlite_sequence(name, seq) select '" + table + "', 0 where not exists(select 1 from sqlite_sequence where name='" + table + "')",
+		"update sqlite_sequence set seq=max(seq, " + strconv.FormatInt(next-1, 10) + ") where name='" + table + "'",
+	}
+}
+
+func (sqliteDialect) conflict(err error) (string, bool) {
+	var serr *sqlite.Error
+	if errors.As(err, &serr) && serr.Code()&0xff == sqlite3.SQLITE_CONSTRAINT {
+		return serr.Error(), true
+	}
+	return "", false
+}
+
+type sqliteMetadataStore struct {
+	sqlMetadataStore
+}
+
+// replaceFile uses REPLACE for the same reason as mysqlMetadataStore.
+// In SQLite, it removes the existing row before inserting, so the new row is not an update of the old one.
+func (s sqliteMetadataStore) replaceFile(tx *storeTx, fid int64, key string, size sql.NullInt64, devid int64) error {
+	_, err := tx.Exec("replace into file(fid, dkey, size, created_at) values(?, ?, ?, current_timestamp)", fid, key, size)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("insert into file_on(fid, devid) values(?, ?)", fid, devid)
+	return err
+}
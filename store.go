@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// store is the metadata database of efes.
+// Queries are written in SQL that is common to all supported databases.
+// Parts that differ between databases are built by methods of dialect.
+type store struct {
+	db *sql.DB
+	dialect
+}
+
+// storeTx is a transaction on store.
+type storeTx struct {
+	tx *sql.Tx
+	dialect
+}
+
+// dialect builds SQL that is specific to a database.
+type dialect interface {
+	// driverName is the name of the database/sql driver.
+	driverName() string
+	// bind converts a query and its arguments to the form accepted by driver.
+	bind(query string, args []interface{}) (string, []interface{})
+	// forUpdate is appended to select statements to lock selected rows until end of transaction.
+	forUpdate() string
+	// forUpdateSkipLocked is like forUpdate but rows locked by other transactions are left out instead of waited for.
+	forUpdateSkipLocked() string
+	// secondsSince returns an expression for seconds passed since the time in expr.
+	secondsSince(expr string) string
+	// addSeconds returns an expression for the time in expr moved by seconds.
+	addSeconds(expr, seconds string) string
+	// unixTimestamp returns an expression converting the time in expr to a unix timestamp.
+	unixTimestamp(expr string) string
+	// fromUnixtime returns an expression converting the unix timestamp in expr to a time.
+	fromUnixtime(expr string) string
+	// groupConcat returns an aggregate expression joining values of expr with commas in ascending order.
+	groupConcat(expr string) string
+	// returning is appended to insert statements to return the generated value of column.
+	// If it is empty, the value is taken from the result of statement instead.
+	returning(column string) string
+	// tableExists returns a query that counts tables with the name given as its argument.
+	tableExists() string
+	// advanceSequence returns statements that make the next generated value of column in table at least next.
+	advanceSequence(table, column string, next int64) []string
+	// conflict returns the message of err if it is a unique or foreign key constraint violation.
+	conflict(err error) (string, bool)
+}
+
+func openDatabase(config DatabaseConfig) (*store, error) {
+	var s *store
+	var err error
+	switch config.Driver {
+	case "", "mysql":
+		s, err = openMysql(config.DSN)
+	case "sqlite":
+		s, err = openSqlite(config.DSN)
+	case "postgres":
+		s, err = openPostgres(config.DSN)
+	default:
+		return nil, fmt.Errorf("unknown database driver: %s", config.Driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.db.SetConnMaxLifetime(time.Duration(config.ConnMaxLifetime))
+	s.db.SetMaxIdleConns(config.MaxIdleConns)
+	s.db.SetMaxOpenConns(config.MaxOpenConns)
+	return s, nil
+}
+
+func (s *store) Close() error {
+	return s.db.Close()
+}
+
+func (s *store) Ping() error {
+	return s.db.Ping()
+}
+
+func (s *store) PingContext(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *store) Begin() (*storeTx, error) {
+	return s.BeginTx(context.Background(), nil)
+}
+
+func (s *store) BeginTx(ctx context.Context, opts *sql.TxOptions) (*storeTx, error) {
+	tx, err := s.db.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &storeTx{tx: tx, dialect: s.dialect}, nil
+}
+
+func (s *store) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.ExecContext(context.Background(), query, args...)
+}
+
+func (s *store) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	query, args = s.bind(query, args)
+	return s.db.ExecContext(ctx, query, args...)
+}
+
+func (s *store) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.QueryContext(context.Background(), query, args...)
+}
+
+func (s *store) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	query, args = s.bind(query, args)
+	return s.db.QueryContext(ctx, query, args...)
+}
+
+func (s *store) QueryRow(query string, args ...interface{}) *sql.Row {
+	return s.QueryRowContext(context.Background(), query, args...)
+}
+
+func (s *store) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	query, args = s.bind(query, args)
+	return s.db.QueryRowContext(ctx, query, args...)
+}
+
+// InsertContext runs an insert statement and returns the value generated for column.
+func (s *store) InsertContext(ctx context.Context, query, column string, args ...interface{}) (int64, error) {
+	if returning := s.returning(column); returning != "" {
+		var id int64
+		err := s.QueryRowContext(ctx, query+returning, args...).Scan(&id)
+		return id, err
+	}
+	res, err := s.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (tx *storeTx) Commit() error {
+	return tx.tx.Commit()
+}
+
+func (tx *storeTx) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+func (tx *storeTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.ExecContext(context.Background(), query, args...)
+}
+
+func (tx *storeTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	query, args = tx.bind(query, args)
+	return tx.tx.ExecContext(ctx, query, args...)
+}
+
+func (tx *storeTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	query, args = tx.bind(query, args)
+	return tx.tx.Query(query, args...)
+}
+
+func (tx *storeTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.QueryRowContext(context.Background(), query, args...)
+}
+
+func (tx *storeTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	query, args = tx.bind(query, args)
+	return tx.tx.QueryRowContext(ctx, query, args...)
+}
+
+// Insert runs an insert statement and returns the value generated for column.
+func (tx *storeTx) Insert(query, column string, args ...interface{}) (int64, error) {
+	if returning := tx.returning(column); returning != "" {
+		var id int64
+		err := tx.QueryRow(query+returning, args...).Scan(&id)
+		return id, err
+	}
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/cenkalti/redialer/amqpredialer"
+	"github.com/getsentry/sentry-go"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Number of tasks claimed from the task table in a transaction.
+const taskBatchSize = 100
+
+// Claimed tasks that are not done in this duration are claimed again,
+// so tasks of a consumer that stops in the middle of a batch are not lost.
+const taskClaimTimeout = 5 * time.Minute
+
+// Tasks that failed on all retries are kept in this queue until they are replayed with "efes tasks dlq replay".
+const deadDeleteQueueName = "delete.dead"
+
+// Headers of delete task messages.
+const (
+	retriesHeader = "efes-retries"
+	devidHeader   = "efes-devid"
+	errorHeader   = "efes-error"
+)
+
+// Sent tasks are kept in delete_outbox for this duration.
+const outboxRetention = 24 * time.Hour
+
+// deleteQueue carries tasks for deleting files on devices to the servers of devices.
+type deleteQueue interface {
+	// enqueue adds a task for deleting fid to each device in tx.
+	// Tasks are delivered only if tx is committed.
+	enqueue(tx *storeTx, devids []int64, fid int64) error
+	// relay delivers tasks added by enqueue to the queue of consumers until shutdown is requested.
+	// It returns immediately if tasks are available to consumers as soon as they are committed.
+	relay()
+	// consume calls process for each task sent to devid until shutdown is requested.
+	// It beats worker while it is running.
+	// A task that process returns an error for may be delivered again, depending on the queue.
+	consume(devid int64, worker string, process func(fid int64) error)
+}
+
+// newDeleteQueue returns the queue selected in config.
+// The AMQP connection is only used if queue is "amqp".
+// Consumers beat the worker given to consume and relay beats "delete-relay" worker while they are running.
+func newDeleteQueue(c TasksConfig, db *store, r *amqpredialer.AMQPRedialer, workers *workerMonitor, logger log.Logger, shutdown chan struct{}) (deleteQueue, error) {
+	switch c.Queue {
+	case "", "amqp":
+		return &amqpDeleteQueue{
+			db:           db,
+			amqp:         r,
+			pollInterval: time.Duration(c.PollInterval),
+			maxRetries:   c.MaxRetries,
+			retryDelay:   time.Duration(c.RetryDelay),
+			workers:      workers,
+			log:          logger,
+			shutdown:     shutdown,
+		}, nil
+	case "database":
+		return &databaseDeleteQueue{
+			db:           db,
+			pollInterval: time.Duration(c.PollInterval),
+			maxRetries:   c.MaxRetries,
+			retryDelay:   time.Duration(c.RetryDelay),
+			workers:      workers,
+			log:          logger,
+			shutdown:     shutdown,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown task queue: %s", c.Queue)
+	}
+}
+
+// amqpDeleteQueue sends tasks to "delete.devN" queues on the AMQP broker.
+// Tasks are first written to the delete_outbox table in the transaction that removes the file.
+// Relay publishes them with publisher confirms and marks them sent, so a task is not lost
+// if the process stops or the broker is unreachable after the transaction is committed.
+// Failed tasks wait in "delete.devN.retry" until their message expires and the broker dead-letters them back to "delete.devN".
+// Tasks that still fail after maxRetries are moved to "delete.dead".
+type amqpDeleteQueue struct {
+	db           *store
+	amqp         *amqpredialer.AMQPRedialer
+	pollInterval time.Duration
+	maxRetries   int
+	retryDelay   time.Duration
+	workers      *workerMonitor
+	log          log.Logger
+	shutdown     chan struct{}
+}
+
+func (q *amqpDeleteQueue) enqueue(tx *storeTx, devids []int64, fid int64) error {
+	for _, devid := range devids {
+		_, err := tx.Exec("insert into delete_outbox(devid, fid) values(?, ?)", devid, fid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *amqpDeleteQueue) relay() {
+	q.log.Notice("Starting delete task relay...")
+	ticker := time.NewTicker(q.pollInterval)
+	defer ticker.Stop()
+	purgeTicker := time.NewTicker(time.Hour)
+	defer purgeTicker.Stop()
+	for {
+		select {
+		case <-q.shutdown:
+			return
+		case <-purgeTicker.C:
+			_, err := q.db.Exec("delete from delete_outbox where sent_at < "+q.db.addSeconds("current_timestamp", "?"), -int64(outboxRetention/time.Second))
+			if err != nil {
+				q.log.Errorln("cannot purge sent delete tasks:", err.Error())
+			}
+		case <-ticker.C:
+			err := q.relayOutbox()
+			if err != nil {
+				q.log.Errorln("cannot relay delete tasks:", err.Error())
+				amqpPublishFailures.WithLabelValues("delete_task").Inc()
+				continue
+			}
+			q.workers.beat("delete-relay")
+		}
+	}
+}
+
+// outboxTask is a row of delete_outbox claimed by relay.
+type outboxTask struct {
+	outboxid int64
+	devid    int64
+	fid      int64
+}
+
+// relayOutbox publishes batches of unsent tasks in outbox until there are none left.
+// A channel is opened only if there are tasks to publish and it is used for the following batches.
+// Tasks are claimed and marked sent in short transactions, so rows are not locked while waiting for the broker.
+// If a task is marked sent after it is published again by another relay, the file is deleted twice.
+// That is harmless because deleting a file twice is not different than deleting it once.
+func (q *amqpDeleteQueue) relayOutbox() error {
+	var ch *amqp.Channel
+	defer func() {
+		if ch != nil {
+			ch.Close()
+		}
+	}()
+	for {
+		tasks, err := q.claimOutbox()
+		if err != nil || len(tasks) == 0 {
+			return err
+		}
+		if ch == nil {
+			ch, err = q.openConfirmChannel()
+			if err != nil || ch == nil {
+				q.releaseOutbox(tasks)
+				return err
+			}
+		}
+		sent, err := q.publishOutbox(ch, tasks)
+		if sent > 0 {
+			_, err2 := q.db.Exec("update delete_outbox set sent_at=current_timestamp where outboxid in (" + outboxids(tasks[:sent]) + ")") // nolint: gosec
+			if err2 != nil {
+				return err2
+			}
+		}
+		if err != nil {
+			q.releaseOutbox(tasks[sent:])
+			return err
+		}
+		if len(tasks) < taskBatchSize {
+			return nil
+		}
+		select {
+		case <-q.shutdown:
+			return nil
+		default:
+		}
+	}
+}
+
+// openConfirmChannel opens a channel in confirm mode on the AMQP connection.
+// It returns a nil channel if shutdown is requested while waiting for the connection.
+func (q *amqpDeleteQueue) openConfirmChannel() (*amqp.Channel, error) {
+	select {
+	case conn, ok := <-q.amqp.Conn():
+		if !ok {
+			return nil, amqp.ErrClosed
+		}
+		ch, err := conn.Channel()
+		if err != nil {
+			return nil, err
+		}
+		err = ch.Confirm(false)
+		if err != nil {
+			ch.Close()
+			return nil, err
+		}
+		return ch, nil
+	case <-q.shutdown:
+		return nil, nil
+	}
+}
+
+// publishOutbox publishes tasks in order and returns the number of tasks confirmed by the broker.
+// Queues of devices are declared first because the broker confirms and drops messages
+// sent to a queue that does not exist, for example of a new device whose server has never run.
+func (q *amqpDeleteQueue) publishOutbox(ch *amqp.Channel, tasks []outboxTask) (int, error) {
+	declared := make(map[int64]bool)
+	for i, task := range tasks {
+		if !declared[task.devid] {
+			_, err := declareDeleteQueue(ch, task.devid)
+			if err != nil {
+				return i, err
+			}
+			declared[task.devid] = true
+		}
+		err := publishConfirmed(ch, deleteQueueName(task.devid), amqp.Publishing{
+			ContentType: "text/plain",
+			Body:        []byte(strconv.FormatInt(task.fid, 10)),
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(tasks), nil
+}
+
+// claimOutbox marks unsent tasks in outbox that are not claimed, or whose claim has timed out, as claimed and returns them.
+func (q *amqpDeleteQueue) claimOutbox() ([]outboxTask, error) {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	rows, err := tx.Query("select outboxid, devid, fid from delete_outbox "+
+		"where sent_at is null and (claimed_at is null or claimed_at < "+tx.addSeconds("current_timestamp", "?")+") "+
+		"order by outboxid limit ?"+tx.forUpdateSkipLocked(), -int64(taskClaimTimeout/time.Second), taskBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	var tasks []outboxTask
+	for rows.Next() {
+		var task outboxTask
+		err = rows.Scan(&task.outboxid, &task.devid, &task.fid)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(tasks) == 0 {
+		return nil, err
+	}
+	_, err = tx.Exec("update delete_outbox set claimed_at=current_timestamp where outboxid in (" + outboxids(tasks) + ")") // nolint: gosec
+	if err != nil {
+		return nil, err
+	}
+	return tasks, tx.Commit()
+}
+
+// releaseOutbox clears the claim of tasks that are not published so that they are claimed again in the next poll.
+// If it fails, tasks are claimed again after taskClaimTimeout.
+func (q *amqpDeleteQueue) releaseOutbox(tasks []outboxTask) {
+	if len(tasks) == 0 {
+		return
+	}
+	_, err := q.db.Exec("update delete_outbox set claimed_at=null where outboxid in (" + outboxids(tasks) + ")") // nolint: gosec
+	if err != nil {
+		q.log.Errorln("cannot release claimed delete tasks:", err.Error())
+	}
+}
+
+func outboxids(tasks []outboxTask) string {
+	ids := make([]string, len(tasks))
+	for i, task := range tasks {
+		ids[i] = strconv.FormatInt(task.outboxid, 10)
+	}
+	return strings.Join(ids, ",")
+}
+
+func (q *amqpDeleteQueue) consume(devid int64, worker string, process func(fid int64) error) {
+	for {
+		select {
+		case <-q.shutdown:
+			return
+		case conn, ok := <-q.amqp.Conn():
+			if !ok {
+				q.log.Error("Cannot consume delete queue. AMQP connection is not open.")
+				time.Sleep(time.Second)
+				continue
+			}
+			err := q.consumeConn(conn, devid, worker, process)
+			if err != nil {
+				q.log.Error("Error while processing delete task", err)
+				sentry.CaptureException(err)
+			}
+		}
+	}
+}
+
+func (q *amqpDeleteQueue) consumeConn(conn *amqp.Connection, devid int64, worker string, process func(fid int64) error) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	dq, err := declareDeleteQueue(ch, devid)
+	if err != nil {
+		return err
+	}
+	_, err = declareDeleteRetryQueue(ch, devid)
+	if err != nil {
+		return err
+	}
+	_, err = declareDeadDeleteQueue(ch)
+	if err != nil {
+		return err
+	}
+	// Failed tasks are acked after the broker confirms that they are stored in another queue.
+	err = ch.Confirm(false)
+	if err != nil {
+		return err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	q.workers.beat(worker)
+	consumerTag := "efes-delete-worker:" + strconv.Itoa(os.Getpid()) + "@" + hostname + "/" + strconv.FormatInt(devid, 10)
+	messages, err := ch.Consume(
+		dq.Name,     // queue
+		consumerTag, // consumer
+		false,       // auto-ack
+		false,       // exclusive
+		false,       // no-local
+		false,       // no-wait
+		nil,         // args
+	)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-q.shutdown:
+			return nil
+		case <-ticker.C:
+			q.workers.beat(worker)
+		case msg, ok := <-messages:
+			if !ok {
+				return amqp.ErrClosed
+			}
+			msgBody := string(msg.Body)
+			fileID, err := strconv.ParseInt(msgBody, 10, 64)
+			if err != nil {
+				q.log.Error("Error while parsing int", err)
+				continue
+			}
+			err = process(fileID)
+			if err != nil {
+				err = q.retry(ch, msg, devid, err)
+				if err != nil {
+					q.log.Errorf("Cannot retry delete task: %s", err)
+					return err
+				}
+				continue
+			}
+			err = msg.Ack(false)
+			if err != nil {
+				q.log.Errorf("ACK error: %s", err)
+				return err
+			}
+		}
+	}
+}
+
+// retry moves a failed task to the retry queue of device, or to the dead letter queue if it has been retried maxRetries times.
+func (q *amqpDeleteQueue) retry(ch *amqp.Channel, msg amqp.Delivery, devid int64, taskErr error) error {
+	retries := deleteTaskRetries(msg)
+	devidLabel := strconv.FormatInt(devid, 10)
+	p := amqp.Publishing{
+		ContentType: "text/plain",
+		Body:        msg.Body,
+		Headers:     amqp.Table{retriesHeader: int64(retries + 1)},
+		Expiration:  strconv.FormatInt(q.retryDelay.Milliseconds(), 10),
+	}
+	routingKey := deleteRetryQueueName(devid)
+	if retries >= q.maxRetries {
+		p = amqp.Publishing{
+			ContentType: "text/plain",
+			Body:        msg.Body,
+			Headers:     amqp.Table{retriesHeader: int64(retries), devidHeader: devid, errorHeader: taskErr.Error()},
+			Timestamp:   time.Now(),
+		}
+		routingKey = deadDeleteQueueName
+	}
+	err := publishConfirmed(ch, routingKey, p)
+	if err != nil {
+		return err
+	}
+	if routingKey == deadDeleteQueueName {
+		q.log.Warningf("Delete task for fid=%s on device %d is moved to %s after %d retries", msg.Body, devid, deadDeleteQueueName, retries)
+		deleteTasksDead.WithLabelValues(devidLabel).Inc()
+	} else {
+		deleteTasksRetried.WithLabelValues(devidLabel).Inc()
+	}
+	return msg.Ack(false)
+}
+
+// deleteTaskRetries returns the number of times the task in msg has been retried.
+func deleteTaskRetries(msg amqp.Delivery) int {
+	switch v := msg.Headers[retriesHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+// publishConfirmed publishes to a queue on a channel in confirm mode and waits until the broker confirms it.
+func publishConfirmed(ch *amqp.Channel, queue string, p amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, "", queue, false, false, p)
+	if err != nil {
+		return err
+	}
+	ok, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("message to %s is not confirmed by the broker", queue)
+	}
+	return nil
+}
+
+func declareDeleteQueue(ch *amqp.Channel, devid int64) (amqp.Queue, error) {
+	return ch.QueueDeclare(
+		deleteQueueName(devid),
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+}
+
+func deleteQueueName(devid int64) string {
+	return "delete.dev" + strconv.FormatInt(devid, 10)
+}
+
+// declareDeleteRetryQueue declares the queue that holds failed tasks of device until their message expires.
+// Expired messages are sent back to the delete queue of device.
+func declareDeleteRetryQueue(ch *amqp.Channel, devid int64) (amqp.Queue, error) {
+	return ch.QueueDeclare(
+		deleteRetryQueueName(devid),
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": deleteQueueName(devid),
+		},
+	)
+}
+
+func deleteRetryQueueName(devid int64) string {
+	return deleteQueueName(devid) + ".retry"
+}
+
+func declareDeadDeleteQueue(ch *amqp.Channel) (amqp.Queue, error) {
+	return ch.QueueDeclare(
+		deadDeleteQueueName,
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+}
+
+// databaseDeleteQueue keeps tasks in the task table.
+// Consumers poll the table and mark the rows they claim with the claim time.
+// Files are deleted after the claim is committed, so rows are not locked while the disk is busy.
+// Tasks of a consumer that dies in the middle are claimed again after taskClaimTimeout.
+// Failed tasks are claimed again after retryDelay. Tasks that still fail after maxRetries are marked dead
+// and stay in the table until they are replayed with "efes tasks dlq replay".
+type databaseDeleteQueue struct {
+	db           *store
+	pollInterval time.Duration
+	maxRetries   int
+	retryDelay   time.Duration
+	workers      *workerMonitor
+	log          log.Logger
+	shutdown     chan struct{}
+}
+
+func (q *databaseDeleteQueue) enqueue(tx *storeTx, devids []int64, fid int64) error {
+	for _, devid := range devids {
+		_, err := tx.Exec("insert into task(devid, fid) values(?, ?)", devid, fid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tasks are in the table that consumers poll, there is nothing to relay.
+func (q *databaseDeleteQueue) relay() {}
+
+func (q *databaseDeleteQueue) consume(devid int64, worker string, process func(fid int64) error) {
+	ticker := time.NewTicker(q.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.shutdown:
+			return
+		case <-ticker.C:
+			// Keep claiming while batches are full so that a backlog is not limited by poll interval.
+			for {
+				n, err := q.processBatch(devid, process)
+				if err != nil {
+					q.log.Errorln("Error while processing delete tasks:", err.Error())
+					sentry.CaptureException(err)
+					break
+				}
+				q.workers.beat(worker)
+				if n < taskBatchSize {
+					break
+				}
+				select {
+				case <-q.shutdown:
+					return
+				default:
+				}
+			}
+		}
+	}
+}
+
+// Length of last_error column of task table.
+const taskErrorLength = 255
+
+// claimedTask is a row of task table claimed by a consumer.
+type claimedTask struct {
+	taskid   int64
+	fid      int64
+	attempts int
+}
+
+// processBatch claims tasks of devid, processes them and removes the ones that succeed.
+// It returns the number of claimed tasks.
+func (q *databaseDeleteQueue) processBatch(devid int64, process func(fid int64) error) (int, error) {
+	tasks, err := q.claimBatch(devid)
+	if err != nil || len(tasks) == 0 {
+		return 0, err
+	}
+	var done []string
+	for _, task := range tasks {
+		err = process(task.fid)
+		if err != nil {
+			err = q.retry(task, devid, err)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		done = append(done, strconv.FormatInt(task.taskid, 10))
+	}
+	if len(done) > 0 {
+		_, err = q.db.Exec("delete from task where taskid in (" + strings.Join(done, ",") + ")") // nolint: gosec
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(tasks), nil
+}
+
+// retry releases the claim of a failed task so that it is claimed again after retryDelay,
+// or marks it dead if it has been retried maxRetries times.
+func (q *databaseDeleteQueue) retry(task claimedTask, devid int64, taskErr error) error {
+	devidLabel := strconv.FormatInt(devid, 10)
+	lastError := taskErr.Error()
+	if len(lastError) > taskErrorLength {
+		lastError = lastError[:taskErrorLength]
+	}
+	if task.attempts >= q.maxRetries {
+		_, err := q.db.Exec("update task set attempts=attempts+1, claimed_at=null, dead_at=current_timestamp, last_error=? where taskid=?", lastError, task.taskid)
+		if err != nil {
+			return err
+		}
+		q.log.Warningf("Delete task for fid=%d on device %d is marked dead after %d retries", task.fid, devid, task.attempts)
+		deleteTasksDead.WithLabelValues(devidLabel).Inc()
+		return nil
+	}
+	_, err := q.db.Exec("update task set attempts=attempts+1, claimed_at=null, not_before="+q.db.addSeconds("current_timestamp", "?")+", last_error=? where taskid=?",
+		int64(q.retryDelay/time.Second), lastError, task.taskid)
+	if err != nil {
+		return err
+	}
+	deleteTasksRetried.WithLabelValues(devidLabel).Inc()
+	return nil
+}
+
+// claimBatch marks tasks of devid that are due and not claimed, or whose claim has timed out, as claimed and returns them.
+// Dead tasks are never claimed.
+func (q *databaseDeleteQueue) claimBatch(devid int64) ([]claimedTask, error) {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	rows, err := tx.Query("select taskid, fid, attempts from task "+
+		"where devid=? and dead_at is null and (not_before is null or not_before <= current_timestamp) "+
+		"and (claimed_at is null or claimed_at < "+tx.addSeconds("current_timestamp", "?")+") "+
+		"order by taskid limit ?"+tx.forUpdateSkipLocked(), devid, -int64(taskClaimTimeout/time.Second), taskBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	var tasks []claimedTask
+	var taskids []string
+	for rows.Next() {
+		var task claimedTask
+		err = rows.Scan(&task.taskid, &task.fid, &task.attempts)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tasks = append(tasks, task)
+		taskids = append(taskids, strconv.FormatInt(task.taskid, 10))
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(tasks) == 0 {
+		return nil, err
+	}
+	_, err = tx.Exec("update task set claimed_at=current_timestamp where taskid in (" + strings.Join(taskids, ",") + ")") // nolint: gosec
+	if err != nil {
+		return nil, err
+	}
+	return tasks, tx.Commit()
+}
+
+// deadTasks returns tasks that are marked dead.
+func (q *databaseDeleteQueue) deadTasks() ([]deadDeleteTask, error) {
+	rows, err := q.db.Query("select devid, fid, attempts, dead_at, last_error from task where dead_at is not null order by taskid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tasks []deadDeleteTask
+	for rows.Next() {
+		var task deadDeleteTask
+		var attempts int
+		err = rows.Scan(&task.devid, &task.fid, &attempts, &task.failedAt, &task.err)
+		if err != nil {
+			return nil, err
+		}
+		// First attempt is not a retry.
+		task.retries = attempts - 1
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// replayDeadTasks makes dead tasks claimable again with attempts reset and returns the number of replayed tasks.
+// If devid is not zero, only tasks of that device are replayed.
+func (q *databaseDeleteQueue) replayDeadTasks(devid int64) (int64, error) {
+	query := "update task set dead_at=null, attempts=0, not_before=null, claimed_at=null, last_error='' where dead_at is not null"
+	var args []interface{}
+	if devid != 0 {
+		query += " and devid=?"
+		args = append(args, devid)
+	}
+	res, err := q.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/redialer/amqpredialer"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDatabaseDeleteQueue(t *testing.T) {
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	q, err := newDeleteQueue(TasksConfig{Queue: "database", PollInterval: Duration(time.Second), MaxRetries: 1, RetryDelay: Duration(time.Hour)}, tr.db, nil, tr.workers, tr.log, tr.shutdown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dq := q.(*databaseDeleteQueue)
+	tx, err := tr.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.enqueue(tx, []int64{1, 2}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.enqueue(tx, []int64{1}, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var processed []int64
+	n, err := dq.processBatch(1, func(fid int64) error {
+		processed = append(processed, fid)
+		if fid == 11 {
+			return errors.New("cannot delete")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("unexpected number of tasks: %d", n)
+	}
+	if !reflect.DeepEqual(processed, []int64{10, 11}) {
+		t.Fatalf("unexpected fids: %v", processed)
+	}
+
+	// Failed task is kept and tasks of other devices are left in the queue.
+	var count int
+	err = tr.db.QueryRow("select count(*) from task where devid=1").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("only failed task of device 1 must be kept, found %d", count)
+	}
+	err = tr.db.QueryRow("select count(*) from task where devid=2").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("task of device 2 must be kept, found %d", count)
+	}
+
+	failing := func(fid int64) error { return errors.New("cannot delete") }
+	// Failed task is not claimed again before retry delay.
+	n, err = dq.processBatch(1, failing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("failed task is claimed before retry delay")
+	}
+	_, err = tr.db.Exec("update task set not_before=null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = dq.processBatch(1, failing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("failed task is not claimed again after retry delay")
+	}
+
+	// Task is dead after max retries and it is not claimed until it is replayed.
+	_, err = tr.db.Exec("update task set not_before=null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = dq.processBatch(1, failing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("dead task is claimed")
+	}
+	dead, err := dq.deadTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].devid != 1 || dead[0].fid != 11 || dead[0].retries != 1 || dead[0].err != "cannot delete" {
+		t.Fatalf("unexpected dead tasks: %+v", dead)
+	}
+	replayed, err := dq.replayDeadTasks(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 0 {
+		t.Fatalf("dead task of other device is replayed")
+	}
+	replayed, err = dq.replayDeadTasks(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 1 {
+		t.Fatalf("unexpected number of replayed tasks: %d", replayed)
+	}
+	n, err = dq.processBatch(1, func(fid int64) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("replayed task is not claimed")
+	}
+	err = tr.db.QueryRow("select count(*) from task where devid=1").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("tasks of device 1 must be removed, found %d", count)
+	}
+}
+
+func TestDatabaseDeleteQueueClaim(t *testing.T) {
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	q := &databaseDeleteQueue{db: tr.db, log: tr.log}
+	_, err = tr.db.Exec("insert into task(devid, fid) values(1, 10)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := q.claimBatch(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 {
+		t.Fatalf("unexpected number of claimed tasks: %d", len(tasks))
+	}
+	// Claimed task is not given to another consumer until the claim times out.
+	tasks, err = q.claimBatch(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 0 {
+		t.Fatalf("claimed task is claimed again: %v", tasks)
+	}
+	_, err = tr.db.Exec("update task set claimed_at="+tr.db.addSeconds("current_timestamp", "?"), -int64(2*taskClaimTimeout/time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tasks are processed after the claim is committed, so the database is not locked meanwhile.
+	n, err := q.processBatch(1, func(fid int64) error {
+		_, err := tr.db.Exec("insert into task(devid, fid) values(2, ?)", fid)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("task with timed out claim is not claimed again")
+	}
+}
+
+func TestDeleteOutbox(t *testing.T) {
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	q, err := newDeleteQueue(TasksConfig{Queue: "amqp"}, tr.db, nil, tr.workers, tr.log, tr.shutdown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	countUnsent := func() int {
+		var count int
+		err := tr.db.QueryRow("select count(*) from delete_outbox where sent_at is null").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	// Tasks of a transaction that is rolled back are never sent.
+	tx, err := tr.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.enqueue(tx, []int64{1, 2}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countUnsent(); n != 0 {
+		t.Fatalf("unexpected number of tasks in outbox: %d", n)
+	}
+	// Relay does not connect to the broker when there is nothing to send.
+	err = q.(*amqpDeleteQueue).relayOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err = tr.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.enqueue(tx, []int64{1, 2}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countUnsent(); n != 2 {
+		t.Fatalf("unexpected number of tasks in outbox: %d", n)
+	}
+
+	// Claimed tasks are not claimed by another relay until they are released.
+	aq := q.(*amqpDeleteQueue)
+	tasks, err := aq.claimOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("unexpected number of claimed tasks: %d", len(tasks))
+	}
+	claimed, err := aq.claimOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 0 {
+		t.Fatalf("claimed tasks are claimed again: %v", claimed)
+	}
+	aq.releaseOutbox(tasks[1:])
+	claimed, err = aq.claimOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 || claimed[0] != tasks[1] {
+		t.Fatalf("unexpected claimed tasks after release: %v", claimed)
+	}
+}
+
+func TestRelayDeclaresDeleteQueue(t *testing.T) {
+	conn, err := amqp.Dial(testConfig.AMQP.URL)
+	if err != nil {
+		t.Skipf("amqp is not reachable: %s", err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	const devid = 999
+	_, err = ch.QueueDelete(deleteQueueName(devid), false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	r, err := amqpredialer.New(testConfig.AMQP.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.Run()
+	defer r.Close()
+	q := &amqpDeleteQueue{db: tr.db, amqp: r, log: tr.log, shutdown: tr.shutdown}
+	_, err = tr.db.Exec("insert into delete_outbox(devid, fid) values(?, 42)", devid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Queue of device does not exist until relay declares it, otherwise the task would be dropped by the broker.
+	err = q.relayOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dq, err := ch.QueueDeclarePassive(deleteQueueName(devid), true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dq.Messages != 1 {
+		t.Fatalf("unexpected number of messages in delete queue: %d", dq.Messages)
+	}
+}
+
+func TestParseDeadDeleteTask(t *testing.T) {
+	msg := amqp.Delivery{
+		Body:    []byte("42"),
+		Headers: amqp.Table{retriesHeader: int32(5), devidHeader: int64(3), errorHeader: "input/output error"},
+	}
+	task, err := parseDeadDeleteTask(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.fid != 42 || task.devid != 3 || task.retries != 5 || task.err != "input/output error" {
+		t.Fatalf("unexpected task: %+v", task)
+	}
+	if deleteTaskRetries(amqp.Delivery{Body: []byte("42")}) != 0 {
+		t.Fatal("task without header must have no retries")
+	}
+	_, err = parseDeadDeleteTask(amqp.Delivery{Body: []byte("42")})
+	if err == nil {
+		t.Fatal("task without devid must not be parsed")
+	}
+}
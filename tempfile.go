@@ -1,9 +1,6 @@
 package main
 
 import (
-	"database/sql"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/getsentry/sentry-go"
@@ -17,9 +14,14 @@ func (t *Tracker) tempfileCleaner() {
 	t.log.Notice("Starting tempfile cleaner...")
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
+	t.workers.beat("tempfile-cleaner")
 	for {
 		select {
 		case <-ticker.C:
+			t.workers.beat("tempfile-cleaner")
+			if !t.leader.IsLeader() {
+				continue
+			}
 			err := t.removeOldTempfiles()
 			if err != nil {
 				t.log.Errorln("cannot delete old tempfile records:", err.Error())
@@ -33,53 +35,31 @@ func (t *Tracker) tempfileCleaner() {
 }
 
 func (t *Tracker) removeOldTempfiles() error {
+	defer observeDB("remove_old_tempfiles", time.Now())
 	tx, err := t.db.Begin()
 	if err != nil {
 		return err
 	}
-	tempfiles, err := t.removeOldTempfilesFromDB(tx)
+	tempfiles, err := t.meta.expireTempfiles(tx, time.Duration(t.config.Tracker.TempfileTooOld))
 	if err != nil {
 		logRollbackTx(t.log, tx)
 		return err
 	}
+	for _, tf := range tempfiles {
+		err = t.deletes.enqueue(tx, []int64{tf.devid}, tf.fid)
+		if err != nil {
+			logRollbackTx(t.log, tx)
+			return err
+		}
+	}
 	err = tx.Commit()
 	if err != nil {
 		return err
 	}
+	tempfilesCleaned.Add(float64(len(tempfiles)))
 	for _, tf := range tempfiles {
-		go t.publishDeleteTask([]int64{tf.devid}, tf.fid)
+		t.events.Publish(FileEvent{Event: eventFileDeleted, Fid: tf.fid, Devids: []int64{tf.devid}, Reason: "tempfile-expired"})
 	}
 	t.log.Infoln(len(tempfiles), "old tempfile records are deleted")
 	return nil
 }
-
-func (t *Tracker) removeOldTempfilesFromDB(tx *sql.Tx) (tempfiles []Tempfile, err error) {
-	tempfileTooOld := time.Duration(t.config.Tracker.TempfileTooOld) / time.Microsecond
-	rows, err := tx.Query("select fid, devid from tempfile where created_at < CURRENT_TIMESTAMP - INTERVAL ? MICROSECOND for update", tempfileTooOld)
-	if err != nil {
-		return
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var tf Tempfile
-		err = rows.Scan(&tf.fid, &tf.devid)
-		if err != nil {
-			return
-		}
-		tempfiles = append(tempfiles, tf)
-	}
-	err = rows.Err()
-	if err != nil {
-		return
-	}
-	if len(tempfiles) == 0 {
-		t.log.Debug("no stale tempfile found")
-		return
-	}
-	fids := make([]string, len(tempfiles))
-	for i, tf := range tempfiles {
-		fids[i] = strconv.FormatInt(tf.fid, 10)
-	}
-	_, err = tx.Exec("delete from tempfile where fid in (" + strings.Join(fids, ",") + ")")
-	return
-}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// topologyField is a column of a topology table that can be set with admin API.
+type topologyField struct {
+	param    string
+	column   string
+	usage    string
+	required bool
+	validate func(ctx context.Context, db *store, value string) error
+}
+
+// topologyChild is a table referencing a topology table.
+// A row cannot be removed while it has children.
+type topologyChild struct {
+	table  string
+	column string
+}
+
+// topologyEntity describes a table in zone > rack > subnet/host > device hierarchy.
+type topologyEntity struct {
+	name     string
+	table    string
+	idColumn string
+	fields   []topologyField
+	children []topologyChild
+}
+
+var topologyEntities = []topologyEntity{
+	{
+		name:     "zone",
+		table:    "zone",
+		idColumn: "zoneid",
+		fields: []topologyField{
+			{param: "name", column: "name", usage: "zone name", required: true, validate: validateName},
+		},
+		children: []topologyChild{{"rack", "zoneid"}},
+	},
+	{
+		name:     "rack",
+		table:    "rack",
+		idColumn: "rackid",
+		fields: []topologyField{
+			{param: "zone", column: "zoneid", usage: "zone id", required: true, validate: validateReference("zone", "zoneid")},
+			{param: "name", column: "name", usage: "rack name", required: true, validate: validateName},
+		},
+		children: []topologyChild{{"subnet", "rackid"}, {"host", "rackid"}},
+	},
+	{
+		name:     "subnet",
+		table:    "subnet",
+		idColumn: "subnetid",
+		fields: []topologyField{
+			{param: "rack", column: "rackid", usage: "rack id", required: true, validate: validateReference("rack", "rackid")},
+			{param: "subnet", column: "subnet", usage: "subnet in CIDR notation", required: true, validate: validateCIDR},
+		},
+	},
+	{
+		name:     "host",
+		table:    "host",
+		idColumn: "hostid",
+		fields: []topologyField{
+			{param: "rack", column: "rackid", usage: "rack id", required: true, validate: validateReference("rack", "rackid")},
+			{param: "hostname", column: "hostname", usage: "hostname", required: true, validate: validateName},
+			{param: "hostip", column: "hostip", usage: "IP address of host", required: true, validate: validateIP},
+			{param: "status", column: "status", usage: "alive, down or dead", validate: validateEnum("alive", "down", "dead")},
+		},
+		children: []topologyChild{{"device", "hostid"}},
+	},
+	{
+		name:     "device",
+		table:    "device",
+		idColumn: "devid",
+		fields: []topologyField{
+			{param: "host", column: "hostid", usage: "host id", required: true, validate: validateReference("host", "hostid")},
+			{param: "read-port", column: "read_port", usage: "port of read server", validate: validatePort},
+			{param: "write-port", column: "write_port", usage: "port of write server", validate: validatePort},
+		},
+		children: []topologyChild{{"file_on", "devid"}, {"tempfile", "devid"}},
+	},
+}
+
+var (
+	errInvalidTopology = errors.New("invalid value")
+	errTopologyInUse   = errors.New("in use")
+)
+
+func validateName(ctx context.Context, db *store, value string) error {
+	if value == "" || len(value) > 40 {
+		return errors.New("must be between 1 and 40 characters")
+	}
+	return nil
+}
+
+func validateCIDR(ctx context.Context, db *store, value string) error {
+	_, _, err := net.ParseCIDR(value)
+	if err != nil || len(value) > 18 {
+		return errors.New("must be an IPv4 subnet in CIDR notation")
+	}
+	return nil
+}
+
+func validateIP(ctx context.Context, db *store, value string) error {
+	if net.ParseIP(value) == nil {
+		return errors.New("must be an IP address")
+	}
+	return nil
+}
+
+func validatePort(ctx context.Context, db *store, value string) error {
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || port == 0 {
+		return errors.New("must be a port number")
+	}
+	return nil
+}
+
+func validateEnum(values ...string) func(ctx context.Context, db *store, value string) error {
+	return func(ctx context.Context, db *store, value string) error {
+		if !inStringList(value, values) {
+			return fmt.Errorf("must be one of: %s", strings.Join(values, ", "))
+		}
+		return nil
+	}
+}
+
+func validateReference(table, column string) func(ctx context.Context, db *store, value string) error {
+	return func(ctx context.Context, db *store, value string) error {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		var exists bool
+		err = db.QueryRowContext(ctx, "select exists(select 1 from "+table+" where "+column+"=?)", id).Scan(&exists) // nolint: gosec
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%s %d does not exist", table, id)
+		}
+		return nil
+	}
+}
+
+// parseParams validates form values for the entity.
+// If all is true, required fields must be present.
+func (e *topologyEntity) parseParams(r *http.Request, db *store, all bool) (id int64, columns []string, values []interface{}, err error) {
+	id, err = strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, nil, nil, fmt.Errorf("%w: id must be a positive integer", errInvalidTopology)
+	}
+	for _, f := range e.fields {
+		value, ok := r.Form[f.param]
+		if !ok || value[0] == "" {
+			if all && f.required {
+				return 0, nil, nil, fmt.Errorf("%w: required parameter: %s", errInvalidTopology, f.param)
+			}
+			continue
+		}
+		err = f.validate(r.Context(), db, value[0])
+		if err != nil {
+			return 0, nil, nil, fmt.Errorf("%w: %s %s", errInvalidTopology, f.param, err.Error())
+		}
+		columns = append(columns, f.column)
+		values = append(values, value[0])
+	}
+	return id, columns, values, nil
+}
+
+func (t *Tracker) topologyHandler(action string, e topologyEntity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch action {
+		case "add":
+			err = t.addTopology(r, e)
+		case "set":
+			err = t.setTopology(r, e)
+		case "remove":
+			err = t.removeTopology(r, e)
+		}
+		conflict, isConflict := t.db.conflict(err)
+		switch {
+		case err == nil:
+			switch e.name {
+			case "host", "device":
+				// Status or address of replicas may have changed.
+				t.paths.Purge()
+			case "rack":
+				// Zone of replicas and clients may have changed.
+				t.paths.Purge()
+				t.subnets.Purge()
+			case "zone", "subnet":
+				// Locality of clients may have changed.
+				t.subnets.Purge()
+			}
+		case errors.Is(err, errInvalidTopology):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, sql.ErrNoRows):
+			http.Error(w, e.name+" not found", http.StatusNotFound)
+		case isConflict:
+			// duplicate entry or foreign key constraint failure
+			http.Error(w, conflict, http.StatusConflict)
+		case errors.Is(err, errTopologyInUse):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			t.internalServerError("cannot "+action+" "+e.name, err, r, w)
+		}
+	}
+}
+
+func (t *Tracker) addTopology(r *http.Request, e topologyEntity) error {
+	id, columns, values, err := e.parseParams(r, t.db, true)
+	if err != nil {
+		return err
+	}
+	columns = append([]string{e.idColumn}, columns...)
+	values = append([]interface{}{id}, values...)
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")
+	_, err = t.db.ExecContext(r.Context(), "insert into "+e.table+"("+strings.Join(columns, ",")+") values("+placeholders+")", values...) // nolint: gosec
+	return err
+}
+
+func (t *Tracker) setTopology(r *http.Request, e topologyEntity) error {
+	id, columns, values, err := e.parseParams(r, t.db, false)
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("%w: nothing to set", errInvalidTopology)
+	}
+	var exists bool
+	err = t.db.QueryRowContext(r.Context(), "select exists(select 1 from "+e.table+" where "+e.idColumn+"=?)", id).Scan(&exists) // nolint: gosec
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+	assignments := make([]string, len(columns))
+	for i, c := range columns {
+		assignments[i] = c + "=?"
+	}
+	_, err = t.db.ExecContext(r.Context(), "update "+e.table+" set "+strings.Join(assignments, ",")+" where "+e.idColumn+"=?", append(values, id)...) // nolint: gosec
+	return err
+}
+
+func (t *Tracker) removeTopology(r *http.Request, e topologyEntity) error {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: id must be an integer", errInvalidTopology)
+	}
+	for _, c := range e.children {
+		var exists bool
+		err = t.db.QueryRowContext(r.Context(), "select exists(select 1 from "+c.table+" where "+c.column+"=?)", id).Scan(&exists) // nolint: gosec
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("%s %d %w by %s table", e.name, id, errTopologyInUse, c.table)
+		}
+	}
+	res, err := t.db.ExecContext(r.Context(), "delete from "+e.table+" where "+e.idColumn+"=?", id) // nolint: gosec
+	if err != nil {
+		return err
+	}
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if ra == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Topology sends an add, set or remove request for a zone, rack, subnet, host or device.
+func (c *Client) Topology(action, entity string, params url.Values) error {
+	_, err := c.request(http.MethodPost, action+"-"+entity, params, nil)
+	return err
+}
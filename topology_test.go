@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTopology(t *testing.T) {
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+
+	cases := []struct {
+		path string
+		code int
+	}{
+		{"/add-zone?id=1&name=zone1", http.StatusOK},
+		{"/add-zone?id=1&name=zone1", http.StatusConflict},
+		{"/add-rack?id=1&zone=2&name=rack1", http.StatusBadRequest},
+		{"/add-rack?id=1&zone=1", http.StatusBadRequest},
+		{"/add-rack?id=1&zone=1&name=rack1", http.StatusOK},
+		{"/add-subnet?id=1&rack=1&subnet=1.2.3.4", http.StatusBadRequest},
+		{"/add-subnet?id=1&rack=1&subnet=1.2.3.0/24", http.StatusOK},
+		{"/add-host?id=1&rack=1&hostname=foo&hostip=1.2.3.4", http.StatusOK},
+		{"/set-host?id=1&status=sleeping", http.StatusBadRequest},
+		{"/set-host?id=1&status=down", http.StatusOK},
+		{"/set-host?id=2&status=down", http.StatusNotFound},
+		{"/add-device?id=2&host=1&read-port=1234", http.StatusOK},
+		{"/remove-host?id=1", http.StatusConflict},
+		{"/remove-device?id=2", http.StatusOK},
+		{"/remove-device?id=2", http.StatusNotFound},
+		{"/remove-zone?id=1", http.StatusConflict},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest("POST", c.path, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		tr.server.Handler.ServeHTTP(rr, req)
+		if rr.Code != c.code {
+			t.Errorf("%s returned wrong status code: got %v want %v; body: %s", c.path, rr.Code, c.code, rr.Body.String())
+		}
+	}
+
+	var status string
+	err = tr.db.QueryRow("select status from host where hostid=1").Scan(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "down" {
+		t.Errorf("unexpected host status: %s", status)
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,48 +19,94 @@ import (
 	"github.com/cenkalti/redialer/amqpredialer"
 	"github.com/getsentry/sentry-go"
 	sentryhttp "github.com/getsentry/sentry-go/http"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 // Tracker tracks the info of files in database.
 // Tracker responds to client requests.
 // Tracker sends jobs to servers.
 type Tracker struct {
-	config                 *Config
-	db                     *sql.DB
-	log                    log.Logger
-	server                 http.Server
-	metricsServer          http.Server
-	amqp                   *amqpredialer.AMQPRedialer
-	shutdown               chan struct{}
-	Ready                  chan struct{}
-	tempfileCleanerStopped chan struct{}
-	amqpRedialerStopped    chan struct{}
+	config                      *Config
+	db                          *store
+	meta                        metadataStore
+	log                         log.Logger
+	server                      http.Server
+	metricsServer               http.Server
+	amqp                        *amqpredialer.AMQPRedialer
+	auth                        *authenticator
+	events                      *eventPublisher
+	deletes                     deleteQueue
+	webhooks                    *webhookNotifier
+	workers                     *workerMonitor
+	leader                      *leaderLease
+	paths                       *pathCache
+	subnets                     *subnetCache
+	proxies                     trustedProxies
+	shutdown                    chan struct{}
+	Ready                       chan struct{}
+	tempfileCleanerStopped      chan struct{}
+	amqpRedialerStopped         chan struct{}
+	changeFeedCleanerStopped    chan struct{}
+	heartbeatMonitorStopped     chan struct{}
+	leaderElectionStopped       chan struct{}
+	pathCacheInvalidatorStopped chan struct{}
+	deleteRelayStopped          chan struct{}
 }
 
 // NewTracker returns a new Tracker instance.
 func NewTracker(c *Config) (*Tracker, error) {
+	proxies, err := parseTrustedProxies(c.Auth.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
 	t := &Tracker{
-		config:                 c,
-		log:                    log.NewLogger("tracker"),
-		shutdown:               make(chan struct{}),
-		Ready:                  make(chan struct{}),
-		tempfileCleanerStopped: make(chan struct{}),
-		amqpRedialerStopped:    make(chan struct{}),
+		config:                      c,
+		log:                         log.NewLogger("tracker"),
+		shutdown:                    make(chan struct{}),
+		Ready:                       make(chan struct{}),
+		tempfileCleanerStopped:      make(chan struct{}),
+		amqpRedialerStopped:         make(chan struct{}),
+		workers:                     newWorkerMonitor(),
+		changeFeedCleanerStopped:    make(chan struct{}),
+		heartbeatMonitorStopped:     make(chan struct{}),
+		leaderElectionStopped:       make(chan struct{}),
+		pathCacheInvalidatorStopped: make(chan struct{}),
+		deleteRelayStopped:          make(chan struct{}),
+		paths:                       newPathCache(c.Tracker.PathCacheSize, time.Duration(c.Tracker.PathCacheTTL)),
+		subnets:                     newSubnetCache(time.Duration(c.Tracker.PathCacheTTL)),
+		proxies:                     proxies,
+	}
+	t.auth = &authenticator{
+		enabled: c.Auth.Enabled,
+		log:     t.log,
 	}
 	m := http.NewServeMux()
 	m.HandleFunc("/ping", t.ping)
-	m.HandleFunc("/get-path", t.getPath)
-	m.HandleFunc("/get-paths", t.getPaths)
-	m.HandleFunc("/get-devices", t.getDevices)
-	m.HandleFunc("/get-hosts", t.getHosts)
-	m.HandleFunc("/get-racks", t.getRacks)
-	m.HandleFunc("/get-zones", t.getZones)
-	m.HandleFunc("/create-open", t.createOpen)
-	m.HandleFunc("/create-close", t.createClose)
-	m.HandleFunc("/delete", t.deleteFile)
-	m.HandleFunc("/iter-files", t.iterFiles)
+	m.HandleFunc("/healthz", t.healthz)
+	m.HandleFunc("/readyz", t.readyz)
+	m.HandleFunc("/get-path", t.auth.require(scopeRead, t.getPath))
+	m.HandleFunc("/get-paths", t.auth.require(scopeRead, t.getPaths))
+	m.HandleFunc("/get-devices", t.auth.require(scopeRead, t.getDevices))
+	m.HandleFunc("/get-hosts", t.auth.require(scopeRead, t.getHosts))
+	m.HandleFunc("/get-racks", t.auth.require(scopeRead, t.getRacks))
+	m.HandleFunc("/get-zones", t.auth.require(scopeRead, t.getZones))
+	m.HandleFunc("/create-open", t.auth.require(scopeWrite, t.createOpen))
+	m.HandleFunc("/create-close", t.auth.require(scopeWrite, t.createClose))
+	m.HandleFunc("/delete", t.auth.require(scopeDelete, t.deleteFile))
+	m.HandleFunc("/iter-files", t.auth.require(scopeAdmin, t.iterFiles))
+	m.HandleFunc("/audit", t.auth.require(scopeAdmin, t.getAudit))
+	m.HandleFunc("/changes", t.auth.require(scopeAdmin, t.getChanges))
+	m.HandleFunc("/add-webhook", t.auth.require(scopeAdmin, t.addWebhook))
+	m.HandleFunc("/get-webhooks", t.auth.require(scopeAdmin, t.getWebhooks))
+	m.HandleFunc("/remove-webhook", t.auth.require(scopeAdmin, t.removeWebhook))
+	m.HandleFunc("/get-webhook-dead-letters", t.auth.require(scopeAdmin, t.getWebhookDeadLetters))
+	m.HandleFunc("/set-device-status", t.auth.require(scopeAdmin, t.setDeviceStatus))
+	for _, e := range topologyEntities {
+		for _, action := range []string{"add", "set", "remove"} {
+			m.HandleFunc("/"+action+"-"+e.name, t.auth.require(scopeAdmin, t.topologyHandler(action, e)))
+		}
+	}
 
 	sentryHandler := sentryhttp.New(sentryhttp.Options{
 		Repanic:         false,
@@ -67,31 +115,67 @@ func NewTracker(c *Config) (*Tracker, error) {
 
 	// main server
 	t.server = http.Server{
-		Handler:      sentryHandler.HandleFunc(addVersion(m)),
+		Handler:      sentryHandler.HandleFunc(addVersion(instrumentMux(m))),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
 
+	if t.config.Debug {
+		t.log.SetLevel(log.DEBUG)
+	}
+	t.db, err = openDatabase(c.Database)
+	if err != nil {
+		return nil, err
+	}
+	t.meta = observedMetadataStore{newMetadataStore(t.db)}
+	err = checkSchemaVersion(t.db)
+	if err != nil {
+		logCloseDB(t.log, t.db)
+		return nil, err
+	}
+
 	// metrics server
+	// Device collector is registered to a separate registry because
+	// it is bound to the database of this tracker instance.
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newDeviceCollector(t.db, t.log))
 	metricsMux := http.NewServeMux()
-	metricsMux.Handle("/metrics", promhttp.Handler())
+	metricsMux.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, registry}, promhttp.HandlerOpts{}))
+	metricsMux.HandleFunc("/healthz", t.healthz)
+	metricsMux.HandleFunc("/readyz", t.readyz)
 	t.metricsServer = http.Server{
 		Handler: metricsMux,
 	}
-
-	if t.config.Debug {
-		t.log.SetLevel(log.DEBUG)
+	t.auth.db = t.db
+	if c.Tasks.usesAMQP() || c.AMQP.EventExchange != "" {
+		t.amqp, err = amqpredialer.New(c.AMQP.URL)
+		if err != nil {
+			logCloseDB(t.log, t.db)
+			return nil, err
+		}
 	}
-	var err error
-	t.db, err = openDatabase(c.Database)
+	t.deletes, err = newDeleteQueue(c.Tasks, t.db, t.amqp, t.workers, t.log, t.shutdown)
 	if err != nil {
+		logCloseDB(t.log, t.db)
 		return nil, err
 	}
-	t.amqp, err = amqpredialer.New(c.AMQP.URL)
+	hostname, err := os.Hostname()
 	if err != nil {
+		logCloseDB(t.log, t.db)
 		return nil, err
 	}
+	// Publisher starts a goroutine, so it is created after the steps that can fail.
+	t.events = newEventPublisher(c.AMQP.EventExchange, t.amqp, t.log, t.shutdown)
+	t.leader = newLeaderLease(t.db, t.log, trackerLeaseName, hostname+":"+strconv.Itoa(os.Getpid()), time.Duration(c.Tracker.LeaderLeaseTTL))
+	t.workers.register("leader-election", time.Duration(c.Tracker.LeaderLeaseTTL))
+	t.workers.register("tempfile-cleaner", 3*time.Minute)
+	t.workers.register("change-feed-cleaner", 3*time.Hour)
+	t.workers.register("heartbeat-monitor", 3*time.Duration(c.Tracker.HeartbeatCheckPeriod))
+	if c.Tasks.usesAMQP() {
+		t.workers.register("delete-relay", 3*time.Minute)
+	}
+	t.webhooks = newWebhookNotifier(t.db, t.log, time.Duration(c.Tracker.WebhookTimeout), time.Duration(c.Tracker.WebhookMaxRetryTime))
 	return t, nil
 }
 
@@ -112,12 +196,22 @@ func (t *Tracker) Run() error {
 	if err != nil {
 		return err
 	}
+	go t.leaderElection()
 	go t.tempfileCleaner()
-	go func() {
-		t.log.Notice("Running amqp redialer...")
-		t.amqp.Run()
+	go t.changeFeedCleaner()
+	go t.heartbeatMonitor()
+	go t.pathCacheInvalidator()
+	go t.relayDeleteTasks()
+	t.webhooks.run()
+	if t.amqp != nil {
+		go func() {
+			t.log.Notice("Running amqp redialer...")
+			t.amqp.Run()
+			close(t.amqpRedialerStopped)
+		}()
+	} else {
 		close(t.amqpRedialerStopped)
-	}()
+	}
 	close(t.Ready)
 
 	errCh := make(chan error, 2)
@@ -165,14 +259,23 @@ func (t *Tracker) Shutdown() error {
 	}
 
 	<-t.tempfileCleanerStopped
+	<-t.changeFeedCleanerStopped
+	<-t.heartbeatMonitorStopped
+	<-t.leaderElectionStopped
+	<-t.pathCacheInvalidatorStopped
+	<-t.deleteRelayStopped
+	t.webhooks.Shutdown()
 	err = t.db.Close()
 	if err != nil {
 		t.log.Error("Error while closing database connection")
 		return err
 	}
-	err = t.amqp.Close()
-	if err != nil {
-		return err
+	t.events.Wait()
+	if t.amqp != nil {
+		err = t.amqp.Close()
+		if err != nil {
+			return err
+		}
 	}
 	<-t.amqpRedialerStopped
 	return nil
@@ -182,6 +285,28 @@ func (t *Tracker) ping(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("pong")) // nolint: errcheck
 }
 
+// healthz reports whether background workers are running and which tracker is the leader.
+func (t *Tracker) healthz(w http.ResponseWriter, r *http.Request) {
+	h := newHealthReport()
+	t.workers.check(h)
+	h.Leader = &leaderStatus{
+		Holder:   t.leader.Leader(),
+		IsLeader: t.leader.IsLeader(),
+	}
+	h.write(w)
+}
+
+// readyz reports whether tracker can serve requests.
+func (t *Tracker) readyz(w http.ResponseWriter, r *http.Request) {
+	h := newHealthReport()
+	h.add("ready", checkReady(t.Ready))
+	h.add("database", checkDatabase(r.Context(), t.db))
+	if t.amqp != nil {
+		h.add("amqp", checkAMQP(t.amqp))
+	}
+	h.write(w)
+}
+
 func (t *Tracker) internalServerError(message string, err error, r *http.Request, w http.ResponseWriter) {
 	sentry.CaptureException(err)
 	sentry.CaptureMessage(message)
@@ -193,31 +318,23 @@ func (t *Tracker) internalServerError(message string, err error, r *http.Request
 func (t *Tracker) getPath(w http.ResponseWriter, r *http.Request) {
 	var response GetPath
 	key := r.FormValue("key")
-	row := t.db.QueryRowContext(r.Context(), "select h.hostname, d.read_port, d.devid, f.fid, f.created_at "+
-		"from file f "+
-		"join file_on fo on f.fid=fo.fid "+
-		"join device d on d.devid=fo.devid "+
-		"join host h on h.hostid=d.hostid "+
-		"where h.status='alive' "+
-		"and d.status in ('alive', 'drain') "+
-		"and f.dkey=?", key)
-	var hostname string
-	var httpPort int64
-	var devid int64
-	var fid int64
-	var createdAt sql.NullTime
-	err := row.Scan(&hostname, &httpPort, &devid, &fid, &createdAt)
-	if err == sql.ErrNoRows {
-		http.Error(w, "file not found", http.StatusNotFound)
+	if !keyAllowed(r, key) {
+		http.Error(w, "key is not allowed for token", http.StatusForbidden)
 		return
 	}
+	replicas, err := t.getReplicas(r.Context(), key, getClientHost(r))
 	if err != nil {
-		t.internalServerError("cannot scan rows", err, r, w)
+		t.internalServerError("cannot select paths", err, r, w)
 		return
 	}
+	if len(replicas) == 0 {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	rp := replicas[0]
 	w.Header().Set("content-type", "application/json")
-	response.Path = fmt.Sprintf("http://%s:%d/dev%d/%s", hostname, httpPort, devid, vivify(fid))
-	response.CreatedAt = createdAt.Time.Format(time.RFC3339)
+	response.Path = t.readURL(r, rp.hostname, rp.httpPort, rp.devid, rp.fid)
+	response.CreatedAt = rp.createdAt.Time.Format(time.RFC3339)
 	encoder := json.NewEncoder(w)
 	encoder.Encode(response) // nolint: errcheck
 }
@@ -227,50 +344,93 @@ func (t *Tracker) getPaths(w http.ResponseWriter, r *http.Request) {
 		Paths: make([]GetPath, 0),
 	}
 	key := r.FormValue("key")
-	rows, err := t.db.QueryContext(r.Context(), "select h.hostname, d.read_port, d.devid, f.fid, f.created_at "+
-		"from file f "+
-		"join file_on fo on f.fid=fo.fid "+
-		"join device d on d.devid=fo.devid "+
-		"join host h on h.hostid=d.hostid "+
-		"where h.status='alive' "+
-		"and d.status in ('alive', 'drain') "+
-		"and f.dkey=?", key)
+	if !keyAllowed(r, key) {
+		http.Error(w, "key is not allowed for token", http.StatusForbidden)
+		return
+	}
+	replicas, err := t.getReplicas(r.Context(), key, getClientHost(r))
 	if err != nil {
 		t.internalServerError("cannot select paths", err, r, w)
 		return
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var hostname string
-		var httpPort int64
-		var devid int64
-		var fid int64
-		var createdAt sql.NullTime
-		err = rows.Scan(&hostname, &httpPort, &devid, &fid, &createdAt)
-		if err == sql.ErrNoRows {
-			http.Error(w, "file not found", http.StatusNotFound)
-			return
-		}
-		if err != nil {
-			t.internalServerError("cannot scan rows", err, r, w)
-			return
-		}
+	for _, rp := range replicas {
 		path := GetPath{
-			Path:      fmt.Sprintf("http://%s:%d/dev%d/%s", hostname, httpPort, devid, vivify(fid)),
-			CreatedAt: createdAt.Time.Format(time.RFC3339),
+			Path:      t.readURL(r, rp.hostname, rp.httpPort, rp.devid, rp.fid),
+			CreatedAt: rp.createdAt.Time.Format(time.RFC3339),
 		}
 		response.Paths = append(response.Paths, path)
 	}
-	err = rows.Err()
-	if err != nil {
-		t.internalServerError("cannot scan rows", err, r, w)
-		return
-	}
 	w.Header().Set("content-type", "application/json")
 	encoder := json.NewEncoder(w)
 	encoder.Encode(response) // nolint: errcheck
 }
 
+// getReplicas returns readable replicas of key ordered by preference for the client.
+// Keys without replicas are not cached so that new files can be read immediately.
+func (t *Tracker) getReplicas(ctx context.Context, key, clientIP string) ([]replica, error) {
+	replicas, ok := t.paths.Get(key)
+	if !ok {
+		var err error
+		gen := t.paths.Generation()
+		replicas, err = t.meta.selectReplicas(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if len(replicas) > 0 {
+			t.paths.Add(key, replicas, gen)
+		}
+	}
+	if len(replicas) < 2 {
+		return replicas, nil
+	}
+	subnets, err := t.subnets.Get(t.meta.getSubnets)
+	if err != nil {
+		return nil, err
+	}
+	return sortReplicas(replicas, clientIP, subnets), nil
+}
+
+// Locality of a replica relative to the client, nearest first.
+const (
+	localitySameHost = iota
+	localitySameRack
+	localitySameZone
+	localityRemote
+)
+
+// sortReplicas returns a copy of replicas ordered by locality to the client,
+// same as the preference of findAliveDevice: same host, then same rack, then same zone.
+// Replicas with the same locality are ordered by IO utilization, least busy first.
+// Devices with unknown utilization come last.
+func sortReplicas(replicas []replica, clientIP string, subnets []subnet) []replica {
+	rackID, zoneID, rackKnown := getRackID(subnets, clientIP)
+	locality := func(rp replica) int {
+		switch {
+		case rp.hostip == clientIP:
+			return localitySameHost
+		case rackKnown && rp.rackid == rackID:
+			return localitySameRack
+		case rackKnown && rp.zoneid == zoneID:
+			return localitySameZone
+		default:
+			return localityRemote
+		}
+	}
+	sorted := make([]replica, len(replicas))
+	copy(sorted, replicas)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if la, lb := locality(a), locality(b); la != lb {
+			return la < lb
+		}
+		if a.ioUtilization.Valid != b.ioUtilization.Valid {
+			return a.ioUtilization.Valid
+		}
+		return a.ioUtilization.Int64 < b.ioUtilization.Int64
+	})
+	return sorted
+}
+
 func (t *Tracker) createOpen(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
@@ -288,23 +448,18 @@ func (t *Tracker) createOpen(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	d, err := findAliveDevice(t.db, int64(size), nil, getClientIP(r))
-	if err == errNoDeviceAvailable {
-		http.Error(w, "no device available", http.StatusServiceUnavailable)
-		return
-	}
+	devices, err := findAliveDevices(t.meta, int64(size), nil, getClientIP(r))
 	if err != nil {
 		t.internalServerError("cannot find a device", err, r, w)
 		return
 	}
-	res, err := t.db.ExecContext(r.Context(), "insert into tempfile(devid) values(?)", d.devid)
-	if err != nil {
-		t.internalServerError("cannot insert tempfile", err, r, w)
+	d, fid, err := reserveTempfile(r.Context(), t.meta, devices, int64(size))
+	if err == errNoDeviceAvailable {
+		http.Error(w, "no device available", http.StatusServiceUnavailable)
 		return
 	}
-	fid, err := res.LastInsertId()
 	if err != nil {
-		t.internalServerError("cannot get last insert id", err, r, w)
+		t.internalServerError("cannot insert tempfile", err, r, w)
 		return
 	}
 	response := CreateOpen{
@@ -332,73 +487,80 @@ func (d *aliveDevice) PatchURL(fid int64) string {
 	return fmt.Sprintf("http://%s:%d/dev%d/%s", d.hostname, d.httpPort, d.devid, vivify(fid))
 }
 
-func findAliveDevice(db *sql.DB, size int64, devids []int64, clientIP string) (*aliveDevice, error) {
-	var devidsSQL string
-	if len(devids) > 0 {
-		var devidsString []string
-		for _, devid := range devids {
-			devidsString = append(devidsString, strconv.FormatInt(devid, 10))
+// reserveTempfile reserves size bytes on the first of devices that still has room for them
+// and returns the device with the fid of new tempfile.
+// Size is reserved on the device until the tempfile is closed or expired.
+func reserveTempfile(ctx context.Context, meta metadataStore, devices []aliveDevice, size int64) (*aliveDevice, int64, error) {
+	for i := range devices {
+		fid, ok, err := meta.reserveTempfile(ctx, devices[i].devid, size)
+		if err != nil {
+			return nil, 0, err
 		}
-		devidsSQL = "and d.status in ('alive', 'drain') and d.devid in (" + strings.Join(devidsString, ",") + ") "
-	} else {
-		devidsSQL = "and d.status='alive' "
-	}
-	rows, err := db.Query("select z.zoneid, r.rackid, h.hostid, h.hostip, h.hostname, d.devid, d.write_port "+ // nolint: gosec
-		"from device d "+
-		"join host h on d.hostid=h.hostid "+
-		"join rack r on h.rackid=r.rackid "+
-		"join zone z on r.zoneid=z.zoneid "+
-		"where h.status='alive' "+
-		"and bytes_free>= ? "+
-		devidsSQL+
-		"and timestampdiff(second, updated_at, current_timestamp) < 60 "+
-		"order by bytes_free desc", size)
+		if ok {
+			return &devices[i], fid, nil
+		}
+	}
+	return nil, 0, errNoDeviceAvailable
+}
+
+// findAliveDevice returns a device that has room for size bytes, preferring devices close to client.
+func findAliveDevice(meta metadataStore, size int64, devids []int64, clientIP string) (*aliveDevice, error) {
+	devices, err := findAliveDevices(meta, size, devids, clientIP)
 	if err != nil {
 		return nil, err
 	}
-	devices := make([]aliveDevice, 0)
-	defer rows.Close()
-	for rows.Next() {
-		var d aliveDevice
-		err = rows.Scan(&d.zoneid, &d.rackid, &d.hostid, &d.hostip, &d.hostname, &d.devid, &d.httpPort)
-		if err != nil {
-			return nil, err
-		}
-		devices = append(devices, d)
+	if len(devices) == 0 {
+		return nil, errNoDeviceAvailable
 	}
-	err = rows.Err()
+	return &devices[0], nil
+}
+
+// findAliveDevices returns devices that have room for size bytes in order of preference.
+// Devices close to client come first. Among them, one of the half with most free space is picked at random
+// so that concurrent uploads are spread.
+func findAliveDevices(meta metadataStore, size int64, devids []int64, clientIP string) ([]aliveDevice, error) {
+	devices, err := meta.findAliveDevices(size, devids)
 	if err != nil {
 		return nil, err
 	}
-	sameHostDevices := filterSameHost(devices, clientIP)
-	if len(sameHostDevices) > 0 { // nolint: nestif
-		devices = sameHostDevices
-	} else {
-		subnets, err := getSubnets(db)
+	preferred := filterSameHost(devices, clientIP)
+	if len(preferred) == 0 { // nolint: nestif
+		subnets, err := meta.getSubnets()
 		if err != nil {
 			return nil, err
 		}
 		rackID, zoneID, ok := getRackID(subnets, clientIP)
 		if ok {
-			sameRackDevices := filterSameRack(devices, rackID)
-			if len(sameRackDevices) > 0 {
-				devices = sameRackDevices
-			} else {
-				sameZoneDevices := filterSameZone(devices, zoneID)
-				if len(sameZoneDevices) > 0 {
-					devices = sameZoneDevices
-				}
+			preferred = filterSameRack(devices, rackID)
+			if len(preferred) == 0 {
+				preferred = filterSameZone(devices, zoneID)
 			}
 		}
 	}
-	if len(devices) == 0 {
-		return nil, errNoDeviceAvailable
+	if len(preferred) == 0 {
+		preferred = devices
 	}
-	if len(devices) == 1 {
-		return &devices[0], nil
+	if len(preferred) > 1 {
+		i := rand.Intn(len(preferred) / 2) // nolint: gosec
+		preferred[0], preferred[i] = preferred[i], preferred[0]
 	}
-	devices = devices[:len(devices)/2]
-	return &devices[rand.Intn(len(devices))], nil // nolint: gosec
+	// Other devices are tried if the preferred ones are filled by concurrent uploads.
+	result := preferred
+	for _, d := range devices {
+		if !containsDevice(preferred, d.devid) {
+			result = append(result, d)
+		}
+	}
+	return result, nil
+}
+
+func containsDevice(devices []aliveDevice, devid int64) bool {
+	for _, d := range devices {
+		if d.devid == devid {
+			return true
+		}
+	}
+	return false
 }
 
 func getRackID(subnets []subnet, clientIP string) (rackid, zoneid int64, ok bool) {
@@ -460,24 +622,6 @@ type subnet struct {
 	subnet   string
 }
 
-func getSubnets(db *sql.DB) ([]subnet, error) {
-	var ret []subnet
-	rows, err := db.Query("select subnetid, r.rackid, z.zoneid, subnet from subnet s join rack r on s.rackid=r.rackid join zone z on z.zoneid=r.zoneid")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var s subnet
-		err = rows.Scan(&s.subnetid, &s.rackid, &s.zoneid, &s.subnet)
-		if err != nil {
-			return nil, err
-		}
-		ret = append(ret, s)
-	}
-	return ret, rows.Err()
-}
-
 func (t *Tracker) createClose(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
@@ -493,15 +637,28 @@ func (t *Tracker) createClose(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "required parameter: key", http.StatusBadRequest)
 		return
 	}
+	if !keyAllowed(r, key) {
+		http.Error(w, "key is not allowed for token", http.StatusForbidden)
+		return
+	}
+	// Size is optional for compatibility with older clients.
+	var size sql.NullInt64
+	if sizeStr := r.FormValue("size"); sizeStr != "" {
+		size.Int64, err = strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil || size.Int64 < 0 {
+			http.Error(w, "invalid param: size", http.StatusBadRequest)
+			return
+		}
+		size.Valid = true
+	}
+	defer observeDB("create_close", time.Now())
 	tx, err := t.db.BeginTx(r.Context(), nil)
 	if err != nil {
 		t.internalServerError("cannot begin transaction", err, r, w)
 		return
 	}
 	defer tx.Rollback() // nolint: errcheck
-	var devid int64
-	row := tx.QueryRow("select devid from tempfile where fid=? for update", fid)
-	err = row.Scan(&devid)
+	devid, err := t.meta.closeTempfile(tx, fid)
 	if err == sql.ErrNoRows {
 		http.Error(w, "no tempfile found", http.StatusNotFound)
 		return
@@ -510,64 +667,82 @@ func (t *Tracker) createClose(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "duplicate create-close call", http.StatusConflict)
 		return
 	}
-	_, err = tx.Exec("delete from tempfile where fid=?", fid)
-	if err != nil {
-		t.internalServerError("cannot delete tempfile", err, r, w)
-		return
-	}
 	// Remove existing fids with same dkey if there is any.
-	var oldfid int64
 	var olddevids []int64
-	row = tx.QueryRow("select fid from file where dkey=? for update", key)
-	err = row.Scan(&oldfid)
+	oldfid, err := t.meta.lockFidOfKey(tx, key)
 	switch err {
 	case sql.ErrNoRows:
 	case nil:
-		olddevids, err = t.deleteFidOnDB(tx, oldfid)
+		olddevids, err = t.meta.deleteFile(tx, oldfid)
 		if err != nil {
 			t.internalServerError("cannot delete fid", err, r, w)
 			return
 		}
+		err = writeAudit(tx, auditRecord{
+			operation: auditOverwrite,
+			key:       key,
+			fid:       oldfid,
+			devids:    olddevids,
+			clientIP:  t.proxies.clientHost(r),
+			actor:     auditActor(r),
+		})
+		if err != nil {
+			t.internalServerError("cannot write audit record", err, r, w)
+			return
+		}
 	default:
 		t.internalServerError("cannot select old fid record", err, r, w)
 		return
 	}
-	// After removing old fids above, a new fid may come with the same dkey.
-	// Use REPLACE INTO feature of MySQL to prevent "duplicate entry" errors.
-	// This is not thread-safe and may result stale "file_on" records with no fid present in "file" table.
-	// It is a very rare case and cleanDevice() job will eventually remove stale records on "file_on" table.
-	_, err = tx.Exec("replace into file(fid, dkey, created_at) values(?,?,now())", fid, key)
+	err = t.meta.replaceFile(tx, fid, key, size, devid)
 	if err != nil {
 		t.internalServerError("cannot insert or replace file", err, r, w)
 		return
 	}
-	_, err = tx.Exec("insert into file_on(fid, devid) values(?, ?)", fid, devid)
+	err = writeAudit(tx, auditRecord{
+		operation: auditCreate,
+		key:       key,
+		fid:       fid,
+		devids:    []int64{devid},
+		clientIP:  t.proxies.clientHost(r),
+		actor:     auditActor(r),
+	})
 	if err != nil {
-		t.internalServerError("cannot insert file_on record", err, r, w)
+		t.internalServerError("cannot write audit record", err, r, w)
 		return
 	}
-	row = tx.QueryRow("select h.hostname, d.read_port "+
-		"from device d join host h on h.hostid=d.hostid "+
-		"where d.devid=?", devid)
-	var hostname string
-	var httpPort int64
-	err = row.Scan(&hostname, &httpPort)
+	hostname, httpPort, err := t.meta.getReadAddress(tx, devid)
 	if err != nil {
 		t.internalServerError("cannot select host ip", err, r, w)
 		return
 	}
+	event := changeCreate
+	if olddevids != nil {
+		event = changeOverwrite
+		t.log.Debugf("Enqueueing delete task because of create-close. olddevids: %v oldfid: %v", olddevids, oldfid)
+		err = t.deletes.enqueue(tx, olddevids, oldfid)
+		if err != nil {
+			t.internalServerError("cannot enqueue delete task", err, r, w)
+			return
+		}
+	}
+	err = recordChange(tx, event, key, fid)
+	if err != nil {
+		t.internalServerError("cannot record change", err, r, w)
+		return
+	}
 	err = tx.Commit()
 	if err != nil {
 		t.internalServerError("cannot commit transaction", err, r, w)
 		return
 	}
 	if olddevids != nil {
-		t.log.Debugf("Publishing delete task because of create-close. olddevids: %v oldfid: %v", olddevids, oldfid)
-		go t.publishDeleteTask(olddevids, oldfid)
+		t.notify(FileEvent{Event: eventFileDeleted, Key: key, Fid: oldfid, Devids: olddevids, Reason: "overwrite"})
 	}
+	t.notify(FileEvent{Event: eventFileCreated, Key: key, Fid: fid, Devids: []int64{devid}})
 	w.Header().Set("content-type", "application/json")
 	var response CreateClose
-	response.Path = fmt.Sprintf("http://%s:%d/dev%d/%s", hostname, httpPort, devid, vivify(fid))
+	response.Path = t.readURL(r, hostname, httpPort, devid, fid)
 	encoder := json.NewEncoder(w)
 	encoder.Encode(response) // nolint: errcheck
 }
@@ -583,6 +758,7 @@ func (t *Tracker) deleteFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "required parameter: key or fid", http.StatusBadRequest)
 		return
 	}
+	defer observeDB("delete", time.Now())
 	tx, err := t.db.BeginTx(r.Context(), nil)
 	if err != nil {
 		t.internalServerError("cannot begin transaction", err, r, w)
@@ -590,8 +766,7 @@ func (t *Tracker) deleteFile(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback() // nolint: errcheck
 	if fid == 0 {
-		row := tx.QueryRow("select fid from file where dkey=? for update", key)
-		err = row.Scan(&fid)
+		fid, err = t.meta.lockFidOfKey(tx, key)
 		if err == sql.ErrNoRows {
 			return
 		}
@@ -599,98 +774,67 @@ func (t *Tracker) deleteFile(w http.ResponseWriter, r *http.Request) {
 			t.internalServerError("cannot select rows", err, r, w)
 			return
 		}
+	} else {
+		// Find the key of fid for checking token prefix and writing audit record.
+		key, err = t.meta.lockKeyOfFid(tx, fid)
+		if err == sql.ErrNoRows {
+			return
+		}
+		if err != nil {
+			t.internalServerError("cannot select rows", err, r, w)
+			return
+		}
+	}
+	if !keyAllowed(r, key) {
+		http.Error(w, "key is not allowed for token", http.StatusForbidden)
+		return
 	}
-	devids, err := t.deleteFidOnDB(tx, fid)
+	devids, err := t.meta.deleteFile(tx, fid)
 	if err != nil {
 		t.internalServerError("cannot delete fid", err, r, w)
 		return
 	}
-	err = tx.Commit()
+	err = writeAudit(tx, auditRecord{
+		operation: auditDelete,
+		key:       key,
+		fid:       fid,
+		devids:    devids,
+		clientIP:  t.proxies.clientHost(r),
+		actor:     auditActor(r),
+	})
 	if err != nil {
-		t.internalServerError("cannot commit transaction", err, r, w)
+		t.internalServerError("cannot write audit record", err, r, w)
 		return
 	}
-	t.log.Debugf("Publishing delete task because of file deletion. devids: %v fid: %v", devids, fid)
-	go t.publishDeleteTask(devids, fid)
-}
-
-func (t *Tracker) deleteFidOnDB(tx *sql.Tx, fid int64) (devids []int64, err error) {
-	devids, err = getDevicesOfFid(tx, fid)
+	err = recordChange(tx, changeDelete, key, fid)
 	if err != nil {
+		t.internalServerError("cannot record change", err, r, w)
 		return
 	}
-	_, err = tx.Exec("delete from file_on where fid=?", fid)
+	t.log.Debugf("Enqueueing delete task because of file deletion. devids: %v fid: %v", devids, fid)
+	err = t.deletes.enqueue(tx, devids, fid)
 	if err != nil {
+		t.internalServerError("cannot enqueue delete task", err, r, w)
 		return
 	}
-	_, err = tx.Exec("delete from file where fid=?", fid)
+	err = tx.Commit()
 	if err != nil {
+		t.internalServerError("cannot commit transaction", err, r, w)
 		return
 	}
-	return
+	t.notify(FileEvent{Event: eventFileDeleted, Key: key, Fid: fid, Devids: devids, Reason: "delete"})
 }
 
-func (t *Tracker) publishDeleteTask(devids []int64, fid int64) {
-	select {
-	case conn, ok := <-t.amqp.Conn():
-		if !ok {
-			t.log.Error("Cannot publish delete task. AMQP connection is closed.")
-			return
-		}
-		ch, err := conn.Channel()
-		if err != nil {
-			t.log.Errorln("cannot open amqp channel:", err.Error())
-			return
-		}
-		for _, devid := range devids {
-			err = publishDeleteTask(ch, devid, fid)
-			if err != nil {
-				t.log.Errorln("cannot publish delete task:", err.Error())
-			}
-		}
-		err = ch.Close()
-		if err != nil {
-			t.log.Errorln("cannot close amqp channel:", err.Error())
-		}
-	case <-t.shutdown:
-		t.log.Warningf("Not sending delete task for fid=%d because shutdown is requested while waiting for amqp connection", fid)
-	}
-}
-
-func publishDeleteTask(ch *amqp.Channel, devid int64, fileID int64) error {
-	body := strconv.FormatInt(fileID, 10)
-	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
-	defer cancel()
-	return ch.PublishWithContext(
-		ctx,
-		"",                     // exchange
-		deleteQueueName(devid), // routing key
-		false,                  // mandatory
-		false,                  // immediate
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        []byte(body),
-		})
+func (t *Tracker) relayDeleteTasks() {
+	defer close(t.deleteRelayStopped)
+	t.deletes.relay()
 }
 
-func getDevicesOfFid(tx *sql.Tx, fid int64) (devids []int64, err error) {
-	rows, err := tx.Query("select devid from file_on where fid=? for update", fid)
-	if err != nil {
-		return nil, err
-	}
-	devids = make([]int64, 0)
-	defer rows.Close()
-	for rows.Next() {
-		var devid int64
-		err = rows.Scan(&devid)
-		if err != nil {
-			return nil, err
-		}
-		devids = append(devids, devid)
-	}
-	err = rows.Err()
-	return
+// notify sends the event to AMQP exchange and webhooks.
+func (t *Tracker) notify(e FileEvent) {
+	t.paths.Remove(e.Key)
+	t.events.Publish(e)
+	t.webhooks.Notify(e)
 }
 
 func (t *Tracker) getDevices(w http.ResponseWriter, r *http.Request) {
@@ -698,46 +842,11 @@ func (t *Tracker) getDevices(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-
-	var err error
-	devices := make([]Device, 0)
-
-	rows, err := t.db.QueryContext(r.Context(), "select d.devid, d.hostid, h.hostname, h.status, h.rackid, r.name, r.zoneid, z.name, d.status, d.bytes_total, d.bytes_used, d.bytes_free, unix_timestamp(d.updated_at), d.io_utilization from device d join host h on h.hostid=d.hostid join rack r on r.rackid=h.rackid join zone z on z.zoneid=r.zoneid")
+	devices, err := t.meta.getDevices(r.Context())
 	if err != nil {
-		t.internalServerError("cannot select rows", err, r, w)
+		t.internalServerError("cannot select devices", err, r, w)
 		return
 	}
-
-	defer rows.Close()
-	for rows.Next() {
-		var d Device
-		var bytesTotal, bytesUsed, bytesFree sql.NullInt64
-		var ioUtilization sql.NullInt64
-		err = rows.Scan(&d.Devid, &d.Hostid, &d.HostName, &d.HostStatus, &d.Rackid, &d.RackName, &d.Zoneid, &d.ZoneName, &d.Status, &bytesTotal, &bytesUsed, &bytesFree, &d.UpdatedAt, &ioUtilization)
-		if err != nil {
-			t.internalServerError("cannot scan rows", err, r, w)
-			return
-		}
-		if bytesTotal.Valid {
-			d.BytesTotal = &bytesTotal.Int64
-		}
-		if bytesUsed.Valid {
-			d.BytesUsed = &bytesUsed.Int64
-		}
-		if bytesFree.Valid {
-			d.BytesFree = &bytesFree.Int64
-		}
-		if ioUtilization.Valid {
-			d.IoUtilization = &ioUtilization.Int64
-		}
-		devices = append(devices, d)
-	}
-	err = rows.Err()
-	if err != nil {
-		t.internalServerError("error while fetching rows", err, r, w)
-		return
-	}
-
 	var response GetDevices
 	response.Devices = devices
 
@@ -751,33 +860,11 @@ func (t *Tracker) getHosts(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-
-	var err error
-	hosts := make([]Host, 0)
-
-	var rows *sql.Rows
-	rows, err = t.db.QueryContext(r.Context(), "select hostid, status, hostname, hostip from host")
-	if err != nil {
-		t.internalServerError("cannot select rows", err, r, w)
-		return
-	}
-
-	defer rows.Close()
-	for rows.Next() {
-		var h Host
-		err = rows.Scan(&h.Hostid, &h.Status, &h.Hostname, &h.HostIP)
-		if err != nil {
-			t.internalServerError("cannot scan rows", err, r, w)
-			return
-		}
-		hosts = append(hosts, h)
-	}
-	err = rows.Err()
+	hosts, err := t.meta.getHosts(r.Context())
 	if err != nil {
-		t.internalServerError("error while fetching rows", err, r, w)
+		t.internalServerError("cannot select hosts", err, r, w)
 		return
 	}
-
 	var response GetHosts
 	response.Hosts = hosts
 
@@ -791,33 +878,11 @@ func (t *Tracker) getRacks(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-
-	var err error
-	racks := make([]Rack, 0)
-
-	var rows *sql.Rows
-	rows, err = t.db.QueryContext(r.Context(), "select rackid, zoneid, name from rack")
+	racks, err := t.meta.getRacks(r.Context())
 	if err != nil {
-		t.internalServerError("cannot select rows", err, r, w)
+		t.internalServerError("cannot select racks", err, r, w)
 		return
 	}
-
-	defer rows.Close()
-	for rows.Next() {
-		var ra Rack
-		err = rows.Scan(&ra.Rackid, &ra.Zoneid, &ra.Name)
-		if err != nil {
-			t.internalServerError("cannot scan rows", err, r, w)
-			return
-		}
-		racks = append(racks, ra)
-	}
-	err = rows.Err()
-	if err != nil {
-		t.internalServerError("error while fetching rows", err, r, w)
-		return
-	}
-
 	var response GetRacks
 	response.Racks = racks
 
@@ -831,33 +896,11 @@ func (t *Tracker) getZones(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-
-	var err error
-	zones := make([]Zone, 0)
-
-	var rows *sql.Rows
-	rows, err = t.db.QueryContext(r.Context(), "select zoneid, name from zone")
+	zones, err := t.meta.getZones(r.Context())
 	if err != nil {
-		t.internalServerError("cannot select rows", err, r, w)
+		t.internalServerError("cannot select zones", err, r, w)
 		return
 	}
-
-	defer rows.Close()
-	for rows.Next() {
-		var z Zone
-		err = rows.Scan(&z.Zoneid, &z.Name)
-		if err != nil {
-			t.internalServerError("cannot scan rows", err, r, w)
-			return
-		}
-		zones = append(zones, z)
-	}
-	err = rows.Err()
-	if err != nil {
-		t.internalServerError("error while fetching rows", err, r, w)
-		return
-	}
-
 	var response GetZones
 	response.Zones = zones
 
@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -48,6 +51,26 @@ func insertHost(t *testing.T, tr *Tracker) {
 	}
 }
 
+// setTempfileAutoIncrement makes n the next fid given to tempfiles.
+func setTempfileAutoIncrement(t *testing.T, db *store, n int64) {
+	t.Helper()
+	var err error
+	switch db.driverName() {
+	case "mysql":
+		_, err = db.Exec("alter table tempfile auto_increment = " + strconv.FormatInt(n, 10))
+	case "postgres":
+		_, err = db.Exec("select setval(pg_get_serial_sequence('tempfile', 'fid'), ?, false)", n)
+	case "sqlite":
+		_, err = db.Exec("delete from sqlite_sequence where name='tempfile'")
+		if err == nil {
+			_, err = db.Exec("insert into sqlite_sequence(name, seq) values('tempfile', ?)", n-1)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestGetPath(t *testing.T) {
 	tr, err := NewTracker(testConfig)
 	if err != nil {
@@ -101,10 +124,7 @@ func TestCreateOpen(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = tr.db.Exec("alter table tempfile auto_increment = 5")
-	if err != nil {
-		t.Fatal(err)
-	}
+	setTempfileAutoIncrement(t, tr.db, 5)
 	req, err := http.NewRequest("POST", "/create-open", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -123,6 +143,100 @@ func TestCreateOpen(t *testing.T) {
 	}
 }
 
+func TestCreateOpenReservesSize(t *testing.T) {
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	insertHost(t, tr)
+	_, err = tr.db.Exec("insert into device(devid, status, hostid, bytes_total, bytes_used, bytes_free, write_port) values(2, 'alive', 1, 1000, 500, 500, 1234)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.db.Exec("insert into device(devid, status, hostid, bytes_total, bytes_used, bytes_free, write_port) values(3, 'alive', 1, 1000, 600, 400, 1234)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	createOpen := func() (int, CreateOpen) {
+		req, err := http.NewRequest("POST", "/create-open?size=300", nil)
+		if err != nil {
+			t.Error(err)
+			return 0, CreateOpen{}
+		}
+		rr := httptest.NewRecorder()
+		tr.server.Handler.ServeHTTP(rr, req)
+		var resp CreateOpen
+		if rr.Code == http.StatusOK {
+			err = json.Unmarshal(rr.Body.Bytes(), &resp)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		return rr.Code, resp
+	}
+
+	// Each device has room for only one of the concurrent uploads.
+	const uploads = 10
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var opened []CreateOpen
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, resp := createOpen()
+			switch status {
+			case http.StatusOK:
+				mu.Lock()
+				opened = append(opened, resp)
+				mu.Unlock()
+			case http.StatusServiceUnavailable:
+			default:
+				t.Errorf("handler returned wrong status code: %v", status)
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+	if len(opened) != 2 {
+		t.Fatalf("unexpected number of opened uploads: %d", len(opened))
+	}
+	var reserved int64
+	err = tr.db.QueryRow("select sum(size) from tempfile where devid=2").Scan(&reserved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserved != 300 {
+		t.Fatalf("unexpected reserved size on device 2: %d", reserved)
+	}
+
+	// Closing the upload releases the reserved space.
+	req, err := http.NewRequest("POST", fmt.Sprintf("/create-close?fid=%d&key=foo&size=300", opened[0].Fid), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	tr.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	status, resp := createOpen()
+	if status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var size int64
+	err = tr.db.QueryRow("select size from tempfile where fid=?", resp.Fid).Scan(&size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 300 {
+		t.Fatalf("unexpected reserved size: %d", size)
+	}
+}
+
 func TestCreateOpenSameZone(t *testing.T) {
 	tr, err := NewTracker(testConfig)
 	if err != nil {
@@ -173,10 +287,7 @@ func TestCreateOpenSameZone(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = tr.db.Exec("alter table tempfile auto_increment = 5")
-	if err != nil {
-		t.Fatal(err)
-	}
+	setTempfileAutoIncrement(t, tr.db, 5)
 	req, err := http.NewRequest("POST", "/create-open?size=100", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -334,7 +445,7 @@ func TestGetDevices(t *testing.T) {
 	}
 	cleanDB(t, tr.db)
 	insertHost(t, tr)
-	_, err = tr.db.Exec("insert into device(devid, status, hostid, bytes_total, bytes_used, bytes_free, updated_at) values(2, 'alive', 1, 1000, 500, 500, from_unixtime(1510216046))")
+	_, err = tr.db.Exec("insert into device(devid, status, hostid, bytes_total, bytes_used, bytes_free, updated_at) values(2, 'alive', 1, 1000, 500, 500, " + tr.db.fromUnixtime("1510216046") + ")")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1,5 +1,7 @@
 package main
 
+import "encoding/json"
+
 type GetPath struct {
 	Path      string `json:"path"`
 	CreatedAt string `json:"created_at"`
@@ -18,6 +20,15 @@ type CreateClose struct {
 	Path string `json:"path"`
 }
 
+// IterFile is an element of iter-files response.
+type IterFile struct {
+	ID        int64   `json:"id"`
+	Key       string  `json:"key"`
+	Size      *int64  `json:"size"`
+	CreatedAt string  `json:"created_at"`
+	Devids    []int64 `json:"devids"`
+}
+
 type GetDevices struct {
 	Devices []Device `json:"devices"`
 }
@@ -68,3 +79,58 @@ type Zone struct {
 type GetZones struct {
 	Zones []Zone `json:"zones"`
 }
+
+type AuditRecord struct {
+	ID        int64   `json:"id"`
+	Time      string  `json:"time"`
+	Operation string  `json:"operation"`
+	Key       string  `json:"key"`
+	Fid       int64   `json:"fid"`
+	Devids    []int64 `json:"devids"`
+	ClientIP  string  `json:"client_ip"`
+	Actor     string  `json:"actor"`
+}
+
+type GetAudit struct {
+	Records []AuditRecord `json:"records"`
+}
+
+type Change struct {
+	Seq   uint64 `json:"seq"`
+	Time  string `json:"time"`
+	Event string `json:"event"`
+	Key   string `json:"key"`
+	Fid   int64  `json:"fid"`
+}
+
+type GetChanges struct {
+	Changes []Change `json:"changes"`
+	LastSeq uint64   `json:"last_seq"`
+}
+
+type Webhook struct {
+	ID        int64    `json:"id"`
+	URL       string   `json:"url"`
+	KeyPrefix string   `json:"key_prefix"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+}
+
+type GetWebhooks struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+type WebhookDeadLetter struct {
+	ID        int64           `json:"id"`
+	WebhookID int64           `json:"webhook_id"`
+	URL       string          `json:"url"`
+	Event     string          `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error"`
+	CreatedAt string          `json:"created_at"`
+}
+
+type GetWebhookDeadLetters struct {
+	DeadLetters []WebhookDeadLetter `json:"dead_letters"`
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+	"github.com/olekukonko/tablewriter"
+)
+
+var webhookEvents = []string{eventFileCreated, eventFileDeleted}
+
+type webhook struct {
+	id        int64
+	url       string
+	secret    string
+	keyPrefix string
+	events    []string
+}
+
+func (h *webhook) matches(e FileEvent) bool {
+	if !strings.HasPrefix(e.Key, h.keyPrefix) {
+		return false
+	}
+	return len(h.events) == 0 || inStringList(e.Event, h.events)
+}
+
+// webhookSignature returns the value of "efes-signature" header sent with webhook requests.
+// Receivers must compute HMAC-SHA256 of the request body with the webhook secret and compare.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body) // nolint: errcheck
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Number of goroutines sending webhook deliveries.
+const webhookWorkers = 4
+
+// Interval of polling webhook_delivery table for deliveries that are due.
+const webhookPollInterval = time.Second
+
+// Webhooks are read from database again after this duration,
+// so changes made on other trackers are seen by this one.
+const webhookCacheTTL = time.Minute
+
+// Delay before the first retry of a failed delivery. It is doubled on each attempt up to webhookMaxRetryDelay.
+const (
+	webhookRetryDelay    = time.Second
+	webhookMaxRetryDelay = 5 * time.Minute
+)
+
+// webhookNotifier delivers file events to webhooks registered in database.
+// Deliveries are saved to webhook_delivery table before they are sent,
+// and a fixed number of workers claim and send them, so pending deliveries survive restarts.
+// Failed deliveries are retried with exponential backoff.
+// Deliveries that cannot be completed in maxElapsedTime are moved to webhook_dead_letter table.
+type webhookNotifier struct {
+	db             *store
+	log            log.Logger
+	httpClient     http.Client
+	maxElapsedTime time.Duration
+	claimTimeout   time.Duration
+	wakeup         chan struct{}
+	m              sync.Mutex
+	hooks          []webhook
+	hooksFetchedAt time.Time
+	ctx            context.Context
+	cancel         func()
+	wg             sync.WaitGroup
+}
+
+func newWebhookNotifier(db *store, logger log.Logger, timeout, maxElapsedTime time.Duration) *webhookNotifier {
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &webhookNotifier{
+		db:             db,
+		log:            logger,
+		maxElapsedTime: maxElapsedTime,
+		// Claims of a tracker that stops while sending are taken over after this.
+		claimTimeout: timeout + time.Minute,
+		wakeup:       make(chan struct{}, 1),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+	n.httpClient.Timeout = timeout
+	return n
+}
+
+// Notify saves deliveries of e to matching webhooks and wakes up a worker to send them.
+func (n *webhookNotifier) Notify(e FileEvent) {
+	e.Time = time.Now().UTC().Format(time.RFC3339)
+	hooks, err := n.cachedWebhooks()
+	if err != nil {
+		n.log.Errorln("cannot get webhooks:", err.Error())
+		return
+	}
+	var body []byte
+	var saved bool
+	for _, h := range hooks {
+		if !h.matches(e) {
+			continue
+		}
+		if body == nil {
+			body, err = json.Marshal(e)
+			if err != nil {
+				n.log.Errorln("cannot marshal event:", err.Error())
+				return
+			}
+		}
+		_, err = n.db.Exec("insert into webhook_delivery(webhookid, event, payload, last_error) values(?, ?, ?, '')", h.id, e.Event, string(body))
+		if err != nil {
+			n.log.Errorf("cannot save webhook delivery to %s: %s", h.url, err.Error())
+			continue
+		}
+		saved = true
+	}
+	if saved {
+		select {
+		case n.wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run starts the workers that send saved deliveries. Workers stop on Shutdown.
+func (n *webhookNotifier) run() {
+	for i := 0; i < webhookWorkers; i++ {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			n.work()
+		}()
+	}
+}
+
+// Shutdown cancels deliveries in progress and waits for workers to stop.
+// Cancelled deliveries stay in webhook_delivery table and are sent again later.
+func (n *webhookNotifier) Shutdown() {
+	n.cancel()
+	n.wg.Wait()
+}
+
+func (n *webhookNotifier) work() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-n.wakeup:
+		}
+		// Keep sending while there are due deliveries so that a backlog is not limited by poll interval.
+		for n.ctx.Err() == nil {
+			d, err := n.claimDelivery()
+			if err != nil {
+				n.log.Errorln("cannot claim webhook delivery:", err.Error())
+				break
+			}
+			if d == nil {
+				break
+			}
+			n.deliver(*d)
+		}
+	}
+}
+
+// invalidate makes the next Notify read webhooks from database.
+func (n *webhookNotifier) invalidate() {
+	n.m.Lock()
+	n.hooksFetchedAt = time.Time{}
+	n.m.Unlock()
+}
+
+func (n *webhookNotifier) cachedWebhooks() ([]webhook, error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if !n.hooksFetchedAt.IsZero() && time.Since(n.hooksFetchedAt) < webhookCacheTTL {
+		return n.hooks, nil
+	}
+	hooks, err := n.getWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	n.hooks = hooks
+	n.hooksFetchedAt = time.Now()
+	return hooks, nil
+}
+
+func (n *webhookNotifier) getWebhooks() ([]webhook, error) {
+	rows, err := n.db.Query("select webhookid, url, secret, key_prefix, events from webhook")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var hooks []webhook
+	for rows.Next() {
+		var h webhook
+		var events string
+		err = rows.Scan(&h.id, &h.url, &h.secret, &h.keyPrefix, &events)
+		if err != nil {
+			return nil, err
+		}
+		if events != "" {
+			h.events = strings.Split(events, ",")
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+// webhookDelivery is a row of webhook_delivery claimed by a worker.
+type webhookDelivery struct {
+	deliveryid int64
+	hook       webhook
+	event      string
+	payload    string
+	attempts   int
+	age        int64
+}
+
+// claimDelivery marks the oldest delivery that is due and not claimed, or whose claim has timed out, as claimed and returns it.
+// It returns nil if there is no such delivery.
+func (n *webhookNotifier) claimDelivery() (*webhookDelivery, error) {
+	tx, err := n.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	var d webhookDelivery
+	err = tx.QueryRow("select deliveryid, webhookid, event, payload, attempts, "+tx.secondsSince("created_at")+" from webhook_delivery "+
+		"where (not_before is null or not_before <= current_timestamp) "+
+		"and (claimed_at is null or claimed_at < "+tx.addSeconds("current_timestamp", "?")+") "+
+		"order by deliveryid limit 1"+tx.forUpdateSkipLocked(), -int64(n.claimTimeout/time.Second)).
+		Scan(&d.deliveryid, &d.hook.id, &d.event, &d.payload, &d.attempts, &d.age)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow("select url, secret from webhook where webhookid=?", d.hook.id).Scan(&d.hook.url, &d.hook.secret)
+	if err == sql.ErrNoRows {
+		// Webhook is removed after the event.
+		_, err = tx.Exec("delete from webhook_delivery where deliveryid=?", d.deliveryid)
+		if err != nil {
+			return nil, err
+		}
+		return nil, tx.Commit()
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("update webhook_delivery set claimed_at=current_timestamp where deliveryid=?", d.deliveryid)
+	if err != nil {
+		return nil, err
+	}
+	return &d, tx.Commit()
+}
+
+// deliver sends a claimed delivery once. Failed delivery is claimed again after a backoff delay,
+// or moved to webhook_dead_letter if it is older than maxElapsedTime.
+func (n *webhookNotifier) deliver(d webhookDelivery) {
+	err := n.send(d)
+	switch {
+	case err == nil:
+		_, err = n.db.Exec("delete from webhook_delivery where deliveryid=?", d.deliveryid)
+	case n.ctx.Err() != nil:
+		// Shutting down. Release the claim without counting the attempt.
+		_, err = n.db.Exec("update webhook_delivery set claimed_at=null where deliveryid=?", d.deliveryid)
+	case time.Duration(d.age)*time.Second >= n.maxElapsedTime:
+		n.log.Errorf("giving up webhook delivery to %s after %d attempts: %s", d.hook.url, d.attempts+1, err.Error())
+		err = n.bury(d, err)
+	default:
+		delay := webhookRetryDelay << uint(d.attempts)
+		if delay > webhookMaxRetryDelay || delay <= 0 {
+			delay = webhookMaxRetryDelay
+		}
+		n.log.Warningf("webhook delivery to %s failed, retrying in %s: %s", d.hook.url, delay, err.Error())
+		_, err = n.db.Exec("update webhook_delivery set attempts=attempts+1, claimed_at=null, not_before="+n.db.addSeconds("current_timestamp", "?")+", last_error=? where deliveryid=?",
+			int64(delay/time.Second), err.Error(), d.deliveryid)
+	}
+	if err != nil {
+		n.log.Errorln("cannot update webhook delivery:", err.Error())
+	}
+}
+
+func (n *webhookNotifier) send(d webhookDelivery) error {
+	body := []byte(d.payload)
+	req, err := http.NewRequestWithContext(n.ctx, http.MethodPost, d.hook.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("efes-event", d.event)
+	req.Header.Set("efes-signature", webhookSignature(d.hook.secret, body))
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponseError(resp)
+}
+
+// bury moves the delivery to webhook_dead_letter table.
+func (n *webhookNotifier) bury(d webhookDelivery, deliveryErr error) error {
+	tx, err := n.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	_, err = tx.Exec("insert into webhook_dead_letter(webhookid, event, payload, attempts, last_error) values(?, ?, ?, ?, ?)",
+		d.hook.id, d.event, d.payload, d.attempts+1, deliveryErr.Error())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from webhook_delivery where deliveryid=?", d.deliveryid)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (t *Tracker) addWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	hookURL := r.FormValue("url")
+	u, err := url.Parse(hookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "invalid param: url", http.StatusBadRequest)
+		return
+	}
+	var events []string
+	for _, e := range strings.Split(r.FormValue("events"), ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !inStringList(e, webhookEvents) {
+			http.Error(w, "invalid event: "+e, http.StatusBadRequest)
+			return
+		}
+		events = append(events, e)
+	}
+	secret, err := generateToken()
+	if err != nil {
+		t.internalServerError("cannot generate secret", err, r, w)
+		return
+	}
+	keyPrefix := r.FormValue("prefix")
+	id, err := t.db.InsertContext(r.Context(), "insert into webhook(url, secret, key_prefix, events) values(?, ?, ?, ?)", "webhookid", hookURL, secret, keyPrefix, strings.Join(events, ","))
+	if err != nil {
+		t.internalServerError("cannot insert webhook", err, r, w)
+		return
+	}
+	t.webhooks.invalidate()
+	response := Webhook{
+		ID:        id,
+		URL:       hookURL,
+		KeyPrefix: keyPrefix,
+		Events:    events,
+		Secret:    secret,
+	}
+	w.Header().Set("content-type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(response) // nolint: errcheck
+}
+
+func (t *Tracker) getWebhooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	hooks, err := t.webhooks.getWebhooks()
+	if err != nil {
+		t.internalServerError("cannot select webhooks", err, r, w)
+		return
+	}
+	var response GetWebhooks
+	response.Webhooks = make([]Webhook, len(hooks))
+	for i, h := range hooks {
+		response.Webhooks[i] = Webhook{
+			ID:        h.id,
+			URL:       h.url,
+			KeyPrefix: h.keyPrefix,
+			Events:    h.events,
+		}
+	}
+	w.Header().Set("content-type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(response) // nolint: errcheck
+}
+
+func (t *Tracker) removeWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid param: id", http.StatusBadRequest)
+		return
+	}
+	res, err := t.db.ExecContext(r.Context(), "delete from webhook where webhookid=?", id)
+	if err != nil {
+		t.internalServerError("cannot delete webhook", err, r, w)
+		return
+	}
+	t.webhooks.invalidate()
+	ra, err := res.RowsAffected()
+	if err != nil {
+		t.internalServerError("cannot get rows affected", err, r, w)
+		return
+	}
+	if ra == 0 {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+}
+
+func (t *Tracker) getWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	rows, err := t.db.QueryContext(r.Context(), "select d.deadletterid, d.webhookid, coalesce(h.url, ''), d.event, d.payload, d.attempts, d.last_error, d.created_at "+
+		"from webhook_dead_letter d left join webhook h on h.webhookid=d.webhookid "+
+		"order by d.deadletterid desc limit 1000")
+	if err != nil {
+		t.internalServerError("cannot select rows", err, r, w)
+		return
+	}
+	defer rows.Close()
+	letters := make([]WebhookDeadLetter, 0)
+	for rows.Next() {
+		var d WebhookDeadLetter
+		var payload string
+		var createdAt sql.NullTime
+		err = rows.Scan(&d.ID, &d.WebhookID, &d.URL, &d.Event, &payload, &d.Attempts, &d.LastError, &createdAt)
+		if err != nil {
+			t.internalServerError("cannot scan rows", err, r, w)
+			return
+		}
+		d.Payload = json.RawMessage(payload)
+		d.CreatedAt = createdAt.Time.Format(time.RFC3339)
+		letters = append(letters, d)
+	}
+	err = rows.Err()
+	if err != nil {
+		t.internalServerError("error while fetching rows", err, r, w)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(GetWebhookDeadLetters{DeadLetters: letters}) // nolint: errcheck
+}
+
+// AddWebhook registers a new webhook on tracker.
+func (c *Client) AddWebhook(hookURL, keyPrefix, events string) (*Webhook, error) {
+	form := url.Values{}
+	form.Add("url", hookURL)
+	form.Add("prefix", keyPrefix)
+	form.Add("events", events)
+	var response Webhook
+	_, err := c.request(http.MethodPost, "add-webhook", form, &response)
+	return &response, err
+}
+
+// RemoveWebhook removes the webhook with id.
+func (c *Client) RemoveWebhook(id int64) error {
+	form := url.Values{}
+	form.Add("id", strconv.FormatInt(id, 10))
+	_, err := c.request(http.MethodPost, "remove-webhook", form, nil)
+	return err
+}
+
+// PrintWebhooks prints registered webhooks as a table.
+func (c *Client) PrintWebhooks() error {
+	var response GetWebhooks
+	_, err := c.request(http.MethodGet, "get-webhooks", nil, &response)
+	if err != nil {
+		return err
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetBorder(false)
+	table.SetHeader([]string{"ID", "URL", "Key prefix", "Events"})
+	for _, h := range response.Webhooks {
+		table.Append([]string{strconv.FormatInt(h.ID, 10), h.URL, h.KeyPrefix, strings.Join(h.Events, ",")})
+	}
+	table.Render()
+	return nil
+}
+
+// PrintWebhookDeadLetters prints webhook deliveries that are given up.
+func (c *Client) PrintWebhookDeadLetters() error {
+	var response GetWebhookDeadLetters
+	_, err := c.request(http.MethodGet, "get-webhook-dead-letters", nil, &response)
+	if err != nil {
+		return err
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetBorder(false)
+	table.SetHeader([]string{"ID", "Webhook", "URL", "Event", "Attempts", "Last error", "Created at", "Payload"})
+	for _, d := range response.DeadLetters {
+		table.Append([]string{
+			strconv.FormatInt(d.ID, 10),
+			strconv.FormatInt(d.WebhookID, 10),
+			d.URL,
+			d.Event,
+			strconv.Itoa(d.Attempts),
+			d.LastError,
+			d.CreatedAt,
+			string(d.Payload),
+		})
+	}
+	table.Render()
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestWebhookMatches(t *testing.T) {
+	h := webhook{keyPrefix: "foo/", events: []string{eventFileDeleted}}
+	if !h.matches(FileEvent{Event: eventFileDeleted, Key: "foo/bar"}) {
+		t.Error("webhook must match event")
+	}
+	if h.matches(FileEvent{Event: eventFileCreated, Key: "foo/bar"}) {
+		t.Error("webhook must not match event type")
+	}
+	if h.matches(FileEvent{Event: eventFileDeleted, Key: "bar/foo"}) {
+		t.Error("webhook must not match key")
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	type delivery struct {
+		body      []byte
+		signature string
+	}
+	received := make(chan delivery, 1)
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		received <- delivery{body, r.Header.Get("efes-signature")}
+	}))
+	defer hookServer.Close()
+
+	tr, err := NewTracker(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	insertHost(t, tr)
+	_, err = tr.db.Exec("insert into device(devid, hostid) values(2, 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.db.Exec("insert into file(fid, dkey) values(42, 'foo/bar')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.db.Exec("insert into file_on(fid, devid) values(42, 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go tr.Run()
+	defer tr.Shutdown()
+	<-tr.Ready
+
+	form := url.Values{"url": {hookServer.URL}, "prefix": {"foo/"}, "events": {eventFileDeleted}}
+	req, err := http.NewRequest("POST", "/add-webhook?"+form.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	tr.server.Handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	var hook Webhook
+	err = json.Unmarshal(rr.Body.Bytes(), &hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err = http.NewRequest("POST", "/delete?key=foo/bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	tr.server.Handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	select {
+	case d := <-received:
+		if d.signature != webhookSignature(hook.Secret, d.body) {
+			t.Error("invalid signature")
+		}
+		var e FileEvent
+		err = json.Unmarshal(d.body, &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Event != eventFileDeleted || e.Key != "foo/bar" || e.Fid != 42 {
+			t.Errorf("unexpected event: %#v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("webhook is not called")
+	}
+}
+
+// runWebhookTracker runs a tracker with file 42 "foo/bar" and a webhook to hookURL for its deletion.
+func runWebhookTracker(t *testing.T, cfg *Config, hookURL string) *Tracker {
+	tr, err := NewTracker(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanDB(t, tr.db)
+	insertHost(t, tr)
+	_, err = tr.db.Exec("insert into device(devid, hostid) values(2, 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertToDB(t, tr.db, 42, 2, "foo/bar")
+	go tr.Run()
+	<-tr.Ready
+	form := url.Values{"url": {hookURL}, "events": {eventFileDeleted}}
+	req, err := http.NewRequest("POST", "/add-webhook?"+form.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	tr.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("cannot add webhook: %d", rr.Code)
+	}
+	req, err = http.NewRequest("POST", "/delete?key=foo/bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	tr.server.Handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("cannot delete file: %d", rr.Code)
+	}
+	return tr
+}
+
+// waitCount waits until query returns count rows.
+func waitCount(t *testing.T, db *store, query string, count int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var n int
+		err := db.QueryRow(query).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: got %d, want %d", query, n, count)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	calls := make(chan int, 2)
+	var n int
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		calls <- n
+		if n == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		}
+	}))
+	defer hookServer.Close()
+
+	tr := runWebhookTracker(t, testConfig, hookServer.URL)
+	defer tr.Shutdown()
+
+	<-calls
+	// Failed delivery is kept in database until it is retried.
+	waitCount(t, tr.db, "select count(*) from webhook_delivery where attempts=1 and last_error<>''", 1)
+	select {
+	case <-calls:
+	case <-time.After(10 * time.Second):
+		t.Fatal("webhook is not retried")
+	}
+	waitCount(t, tr.db, "select count(*) from webhook_delivery", 0)
+	waitCount(t, tr.db, "select count(*) from webhook_dead_letter", 0)
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	defer hookServer.Close()
+
+	cfg := *testConfig
+	cfg.Tracker.WebhookMaxRetryTime = 0
+	tr := runWebhookTracker(t, &cfg, hookServer.URL)
+	defer tr.Shutdown()
+
+	waitCount(t, tr.db, "select count(*) from webhook_dead_letter where attempts=1", 1)
+	waitCount(t, tr.db, "select count(*) from webhook_delivery", 0)
+}
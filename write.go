@@ -48,7 +48,7 @@ func (c *Client) writeReadSeeker(key string, rs io.ReadSeeker, size int64) error
 	if err != nil {
 		return err
 	}
-	checksums, err := c.sendFile(path, rs, size)
+	checksums, size, err := c.sendFile(path, rs, size)
 	if err != nil {
 		return err
 	}
@@ -57,7 +57,7 @@ func (c *Client) writeReadSeeker(key string, rs io.ReadSeeker, size int64) error
 	if err != nil {
 		return err
 	}
-	return c.createClose(b.String(), fid)
+	return c.createClose(b.String(), fid, size)
 }
 
 type Checksums struct {
@@ -65,7 +65,9 @@ type Checksums struct {
 	CRC32 string
 }
 
-func (c *Client) sendFile(path string, rs io.ReadSeeker, size int64) (*Checksums, error) {
+// sendFile uploads the content of rs and returns its checksums and size.
+// Size is calculated while reading if it is not known in advance (-1).
+func (c *Client) sendFile(path string, rs io.ReadSeeker, size int64) (*Checksums, int64, error) {
 	sf := NewSha1File(rs)
 	var r io.Reader = sf
 	if c.config.Client.ShowProgress {
@@ -107,13 +109,13 @@ func (c *Client) sendFile(path string, rs io.ReadSeeker, size int64) (*Checksums
 	}
 	err := backoff.Retry(op, bo)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	localSha1 := sf.Sum(nil)
 	if !bytes.Equal(remoteSha1, localSha1) {
-		return nil, fmt.Errorf("local sha1 (%s) does not match remote sha1 (%s)", hex.EncodeToString(localSha1), hex.EncodeToString(remoteSha1))
+		return nil, 0, fmt.Errorf("local sha1 (%s) does not match remote sha1 (%s)", hex.EncodeToString(localSha1), hex.EncodeToString(remoteSha1))
 	}
-	return checksums, nil
+	return checksums, sf.Size(), nil
 }
 
 // send a patch request until and error occurs or stream is finished.
@@ -163,6 +165,7 @@ func (c *Client) patch(path string, body io.Reader, offset, size int64) (*http.R
 	if c.drainer {
 		req.Header.Add("efes-drain", "true")
 	}
+	c.setAuthorization(req)
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
@@ -176,6 +179,7 @@ func (c *Client) getOffset(path string) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	c.setAuthorization(req)
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return 0, err
@@ -204,10 +208,11 @@ func (c *Client) createOpen(size int64) (path string, fid int64, err error) {
 	return response.Path, response.Fid, err
 }
 
-func (c *Client) createClose(key string, fid int64) error {
+func (c *Client) createClose(key string, fid, size int64) error {
 	form := url.Values{}
 	form.Add("key", key)
 	form.Add("fid", strconv.FormatInt(fid, 10))
+	form.Add("size", strconv.FormatInt(size, 10))
 	_, err := c.request(http.MethodPost, "create-close", form, nil)
 	return err
 }